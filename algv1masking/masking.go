@@ -20,21 +20,24 @@ var filterMap = map[string]color.Color{
 // The value of the gray pixel is used to create a black pixel with an alpha
 // value equal to the gray pixel.
 // It returns an RGBA image suitable for use as a mask.
-func convertToAlpha(grayImage image.Gray) image.Image {
+func convertToAlpha(grayImage *image.Gray) image.Image {
 	bounds := grayImage.Bounds()
 	mask := image.NewRGBA(bounds)
-	for x := 0; x < bounds.Dx(); x++ {
-		for y := 0; y < bounds.Dy(); y++ {
-			rgbaPixel := color.RGBA{0, 0, 0, grayImage.GrayAt(x, y).Y}
-			mask.Set(x, y, rgbaPixel)
+	common.ParallelRows(bounds, func(_ int, rows image.Rectangle) {
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			src := grayImage.PixOffset(bounds.Min.X, y)
+			dst := mask.PixOffset(bounds.Min.X, y)
+			for x := 0; x < bounds.Dx(); x, src, dst = x+1, src+1, dst+4 {
+				mask.Pix[dst+3] = grayImage.Pix[src]
+			}
 		}
-	}
+	})
 
 	return mask
 }
 
 // layerColor uses a grayscale image as a mask to draw a layer of color onto another image.
-func layerColor(dst draw.Image, grayImage image.Gray, layerColor color.Color) {
+func layerColor(dst draw.Image, grayImage *image.Gray, layerColor color.Color) {
 	src := &image.Uniform{layerColor}
 	mask := convertToAlpha(grayImage)
 	draw.DrawMask(dst, grayImage.Bounds(), src, image.ZP, mask, image.ZP, draw.Over)
@@ -42,7 +45,7 @@ func layerColor(dst draw.Image, grayImage image.Gray, layerColor color.Color) {
 
 // CombineImages runs the v1 masking algorithm to combine a set of grayscale images into
 // a "true" color image.
-func CombineImages(imageMap common.ImageMap, root string) error {
+func CombineImages(config common.ConfigFile, imageMap common.ImageMap, root string) error {
 	// LoadImages validates the presence of RGB images and that they all share the same bounds.
 	blueImage := imageMap[common.BLUE].Image
 	imageBounds := blueImage.Bounds()
@@ -53,7 +56,9 @@ func CombineImages(imageMap common.ImageMap, root string) error {
 	layerColor(composedImage, imageMap[common.GREEN].Image, filterMap[common.GREEN])
 	layerColor(composedImage, imageMap[common.RED].Image, filterMap[common.RED])
 
-	err := common.WriteImage(path.Join(root, "output_v1_alpha.jpg"), composedImage)
+	meta := common.NewMetadata("v1 masking", config, imageMap)
+	meta.SetParameter("order", "blue,green,red")
+	err := common.WriteImage(path.Join(root, "output_v1_alpha.jpg"), composedImage, meta)
 	if err != nil {
 		return err
 	}
@@ -64,5 +69,7 @@ func CombineImages(imageMap common.ImageMap, root string) error {
 	layerColor(composedImage2, imageMap[common.GREEN].Image, filterMap[common.GREEN])
 	layerColor(composedImage2, imageMap[common.BLUE].Image, filterMap[common.BLUE])
 
-	return common.WriteImage(path.Join(root, "output_v1_beta.jpg"), composedImage2)
+	meta = common.NewMetadata("v1 masking", config, imageMap)
+	meta.SetParameter("order", "red,green,blue")
+	return common.WriteImage(path.Join(root, "output_v1_beta.jpg"), composedImage2, meta)
 }
@@ -0,0 +1,18 @@
+package algv1masking
+
+import (
+	"image"
+	"testing"
+)
+
+func BenchmarkConvertToAlpha(b *testing.B) {
+	img := image.NewGray(image.Rect(0, 0, 1024, 1024))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i + i/1024)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		convertToAlpha(img)
+	}
+}
@@ -3,40 +3,55 @@ package algv2blending
 
 import (
 	"github.com/lewchuk/gostitcher/common"
+	"github.com/lewchuk/gostitcher/postprocess"
 	"image"
-	"image/color"
 	"path"
 )
 
-// blendImage combines separte RGB grayscale images into a single RGB image.
+// blendImage combines separte RGB grayscale images into a single RGB image. Rows are
+// blended in parallel bands.
 // It returns the generated image.
 func BlendImage(imageMap common.ImageMap) image.Image {
 	blueImage := imageMap[common.BLUE].Image
 	greenImage := imageMap[common.GREEN].Image
 	redImage := imageMap[common.RED].Image
 
+	// LoadImages validates that all the images share the same bounds, but each image may
+	// have its own stride, such as a sub-image, so each is indexed by its own offsets.
 	bounds := blueImage.Bounds()
 	composedImage := image.NewRGBA(bounds)
-	for x := 0; x < bounds.Dx(); x++ {
-		for y := 0; y < bounds.Dy(); y++ {
-			rgbaPixel := color.RGBA{
-				redImage.GrayAt(x, y).Y,
-				greenImage.GrayAt(x, y).Y,
-				blueImage.GrayAt(x, y).Y,
-				255}
-			composedImage.Set(x, y, rgbaPixel)
+	common.ParallelRows(bounds, func(_ int, rows image.Rectangle) {
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			red := redImage.PixOffset(bounds.Min.X, y)
+			green := greenImage.PixOffset(bounds.Min.X, y)
+			blue := blueImage.PixOffset(bounds.Min.X, y)
+			dst := composedImage.PixOffset(bounds.Min.X, y)
+			for x := 0; x < bounds.Dx(); x, dst = x+1, dst+4 {
+				composedImage.Pix[dst] = redImage.Pix[red+x]
+				composedImage.Pix[dst+1] = greenImage.Pix[green+x]
+				composedImage.Pix[dst+2] = blueImage.Pix[blue+x]
+				composedImage.Pix[dst+3] = 255
+			}
 		}
-	}
+	})
 
 	return composedImage
 }
 
 // CombineImages runs the v2 blending algorithm to combine a set of grayscale images into
-// a "true" color image.
-func CombineImages(imageMap common.ImageMap, root string) error {
+// a "true" color image. The channels aren't aligned, so the composite isn't sharpened,
+// which would only sharpen the colour fringes between them.
+func CombineImages(config common.ConfigFile, imageMap common.ImageMap, root string) error {
 	composedImage := BlendImage(imageMap)
+	config.Sharpen = nil
+
+	meta := common.NewMetadata("v2 blending", config, imageMap)
+	composedImage, err := postprocess.Apply(config, composedImage, meta, root)
+	if err != nil {
+		return err
+	}
 
-	err := common.WriteImage(path.Join(root, "output_v2_alpha.jpg"), composedImage)
+	err = common.WriteImage(path.Join(root, "output_v2_alpha.jpg"), composedImage, meta)
 	if err != nil {
 		return err
 	}
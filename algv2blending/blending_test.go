@@ -0,0 +1,31 @@
+package algv2blending
+
+import (
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"testing"
+)
+
+// syntheticFrame returns a frame of the given size filled with a repeating gradient.
+func syntheticFrame(size, seed int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i*seed + i/size)
+	}
+	return img
+}
+
+func BenchmarkBlendImage(b *testing.B) {
+	imageMap := common.ImageMap{}
+	for i, filter := range common.Filters {
+		imageMap[filter] = common.LoadedConfig{
+			Config: common.ImageConfig{Filter: filter},
+			Image:  syntheticFrame(1024, i+1),
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		BlendImage(imageMap)
+	}
+}
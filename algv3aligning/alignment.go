@@ -4,10 +4,11 @@ package algv3aligning
 import (
 	"fmt"
 	"github.com/lewchuk/gostitcher/common"
+	"github.com/lewchuk/gostitcher/postprocess"
 	"image"
 	"image/color"
-	"math"
 	"path"
+	"strings"
 )
 
 type ImageOffsets struct {
@@ -17,149 +18,406 @@ type ImageOffsets struct {
 	brY int
 }
 
-func getPixel(image common.LoadedConfig, x, y int) uint8 {
-	return image.Image.GrayAt(x-image.Config.OffsetX, y-image.Config.OffsetY).Y
+// The supported ways of treating the edges of aligned composites.
+const (
+	CROP = "crop"
+	PAD  = "pad"
+)
+
+// pixIndex finds the index in Pix of the pixel of an image at a point in the
+// coordinates of the composite, taking the offset of the image into account.
+// It returns the index and whether the point falls within the source image.
+func pixIndex(image common.LoadedConfig, x, y int) (int, bool) {
+	sourceX, sourceY := x-image.Config.OffsetX, y-image.Config.OffsetY
+	if !(sourceX >= image.Image.Rect.Min.X && sourceX < image.Image.Rect.Max.X &&
+		sourceY >= image.Image.Rect.Min.Y && sourceY < image.Image.Rect.Max.Y) {
+		return 0, false
+	}
+	return image.Image.PixOffset(sourceX, sourceY), true
 }
 
-func subtractImages(baseImage, layerImage common.LoadedConfig) (image.Image, int) {
-	// TODO: Figure out if this actually works for the case where baseImages offsets are non 0.
-	xOffset := layerImage.Config.OffsetX - baseImage.Config.OffsetX
-	yOffset := layerImage.Config.OffsetY - baseImage.Config.OffsetY
+// getPixel reads the pixel of an image at a point in the coordinates of the composite,
+// taking the offset of the image into account.
+// It returns the value and whether the point falls within the source image.
+func getPixel(image common.LoadedConfig, x, y int) (uint8, bool) {
+	i, ok := pixIndex(image, x, y)
+	if !ok {
+		return 0, false
+	}
+	return image.Image.Pix[i], true
+}
 
-	offsetPoint := image.Pt(xOffset, yOffset)
-	bounds := baseImage.Image.Bounds()
-	offsetBounds := bounds.Add(offsetPoint)
-	overlapBounds := bounds.Intersect(offsetBounds)
-	composedImage := image.NewGray(overlapBounds)
-	totalDelta := 0
-	maxD := 0
-	for x := overlapBounds.Min.X; x < overlapBounds.Max.X; x++ {
-		for y := overlapBounds.Min.Y; y < overlapBounds.Max.Y; y++ {
-			delta := int(getPixel(baseImage, x, y)) - int(getPixel(layerImage, x, y))
-			if delta < 0 {
-				delta *= -1
-			}
-			deltaPixel := color.Gray{uint8(delta)}
-			composedImage.SetGray(x, y, deltaPixel)
-			if delta > maxD {
-				maxD = delta
-			}
-			// Ignore middle deltas which probably represent the background and overshaddow the delta of the image.
-			// Want to minimize the extreme differences of image features.
-			// Values chosen from a minimum max delta of 134 and then split into quarters preserving values in top and bottom 25%.
-			if delta > 32 && delta < 96 {
-				continue
-			}
-			totalDelta += delta
+// shiftedBounds returns the bounds an image covers in the coordinates of the composite.
+func shiftedBounds(image common.LoadedConfig) image.Rectangle {
+	return image.Image.Bounds().Add(image.Config.Offset())
+}
+
+// subtractImages draws the absolute differences of two images over their overlap. Both
+// images may be offset, the overlap is in the coordinates of the composite.
+// It returns the difference image and the sum of the differences. The difference image
+// comes from the scratch pool and must be returned with common.PutGray once written.
+func subtractImages(baseImage, layerImage common.LoadedConfig) (*image.Gray, int) {
+	composedImage := common.GetGray(overlap(baseImage, layerImage))
+	totalDelta := differenceImages(baseImage, layerImage, nil, composedImage)
+
+	return composedImage, totalDelta
+}
+
+// AlignPair searches for the offset of a layer image that best matches a base image
+// within maxOffset pixels of the current offset of the layer. Only pixels of the
+// composite within the mask, if any, count towards the cost. With a downsample factor
+// above 1 the offset is first found on images shrunk by the factor and then refined
+// within factor pixels at full resolution.
+// It returns the cost surface of the full resolution search.
+func AlignPair(baseImage, layerImage common.LoadedConfig, maxOffset, downsample int, mask *image.Alpha, metric Metric, search Search) *CostSurface {
+	costWithin := func(mask *image.Alpha) func(baseImage, layerImage common.LoadedConfig) float64 {
+		return func(baseImage, layerImage common.LoadedConfig) float64 {
+			return metric.Cost(baseImage, layerImage, mask)
 		}
 	}
 
-	return composedImage, totalDelta
+	if downsample > 1 {
+		// The coarse images both sit at no offset so the search starts from the offset
+		// of the layer relative to the base.
+		coarseBase := metric.prepare(downsampleImage(baseImage, downsample))
+		coarseLayer := metric.prepare(downsampleImage(layerImage, downsample))
+		coarseMask := downsampleMask(mask, baseImage.Config.Offset(), downsample)
+		start := layerImage.Config.Offset().Sub(baseImage.Config.Offset()).Div(downsample)
+		coarseLayer.Config.OffsetX, coarseLayer.Config.OffsetY = start.X, start.Y
+		coarseSurface := search(coarseBase, coarseLayer, (maxOffset+downsample-1)/downsample, costWithin(coarseMask))
+		metric.release(coarseBase)
+		metric.release(coarseLayer)
+
+		shift, _ := coarseSurface.Best()
+		layerImage.Config.OffsetX = baseImage.Config.OffsetX + shift.X*downsample
+		layerImage.Config.OffsetY = baseImage.Config.OffsetY + shift.Y*downsample
+		maxOffset = downsample
+	}
+
+	preparedBase := metric.prepare(baseImage)
+	preparedLayer := metric.prepare(layerImage)
+	surface := search(preparedBase, preparedLayer, maxOffset, costWithin(mask))
+	metric.release(preparedBase)
+	metric.release(preparedLayer)
+
+	return surface
 }
 
-func AlignImages(imageMap *common.ImageMap, maxOffset int) {
-	bgX, bgY, brX, brY := 0, 0, 0, 0
-	minBg, minBr := math.MaxInt32, math.MaxInt32
-	blueImage := (*imageMap)[common.BLUE]
-	for x := -1 * maxOffset; x < maxOffset; x++ {
-		for y := -1 * maxOffset; y < maxOffset; y++ {
-			greenImage := (*imageMap)[common.GREEN]
-			redImage := (*imageMap)[common.RED]
-			greenImage.Config.OffsetX = x
-			greenImage.Config.OffsetY = y
-			redImage.Config.OffsetX = x
-			redImage.Config.OffsetY = y
-			_, bgVal := subtractImages(blueImage, greenImage)
-			_, brVal := subtractImages(blueImage, redImage)
-			if bgVal < minBg {
-				minBg = bgVal
-				bgX = x
-				bgY = y
-			}
+// AlignImages finds the offsets of each RGB image that best match the reference image,
+// see AlignFilters.
+// It returns the cost surface of each aligned filter and any error encountered.
+func AlignImages(imageMap *common.ImageMap, maxOffset int, reference string, mask *image.Alpha, downsample int, metricName, searchName string) (map[string]*CostSurface, error) {
+	return AlignFilters(imageMap, common.Filters[:], maxOffset, reference, mask, downsample, metricName, searchName)
+}
 
-			if brVal < minBr {
-				minBr = brVal
-				brX = x
-				brY = y
+// AlignFilters finds the offsets of the images of each filter that best match the
+// reference image, updates the image map with them and records the quality of each
+// alignment. Each image is searched independently around the offset of the reference,
+// which keeps its own offset, see AlignPair. The metric and search strategy are
+// selected by name.
+// It returns the cost surface of each aligned filter and any error encountered.
+func AlignFilters(imageMap *common.ImageMap, filters []string, maxOffset int, reference string, mask *image.Alpha, downsample int, metricName, searchName string) (map[string]*CostSurface, error) {
+	metric, err := GetMetric(metricName)
+	if err != nil {
+		return nil, err
+	}
+	search, err := GetSearch(searchName)
+	if err != nil {
+		return nil, err
+	}
+
+	referenceImage := (*imageMap)[reference]
+	referenceImage.Config.Alignment = nil
+	(*imageMap)[reference] = referenceImage
+	surfaces := make(map[string]*CostSurface)
+
+	// Update the other configs to have proper offsets.
+	for _, filter := range filters {
+		if filter == reference {
+			continue
+		}
+		layerImage := (*imageMap)[filter]
+		// Searches start from the offset of the reference.
+		layerImage.Config.OffsetX = referenceImage.Config.OffsetX
+		layerImage.Config.OffsetY = referenceImage.Config.OffsetY
+		surface := AlignPair(referenceImage, layerImage, maxOffset, downsample, mask, metric, search)
+		surfaces[filter] = surface
+
+		best, _ := surface.Best()
+		layerImage.Config.OffsetX = best.X
+		layerImage.Config.OffsetY = best.Y
+		layerImage.Config.Alignment = MeasureQuality(reference, surface, referenceImage, layerImage, mask)
+		layerImage.Config.Alignment.MaxOffset = maxOffset
+		(*imageMap)[filter] = layerImage
+	}
+
+	return surfaces, nil
+}
+
+// SaveOffsets updates config.json with the offsets and alignment quality of the images
+// of the given filters and the alignment settings of the config they were found with.
+// Every file of a filter, such as the stacked frames, takes the offsets of the image of
+// its filter, files of other filters are left as they are. The rest of config.json is
+// kept as it was loaded, so processing stages given for the run aren't saved.
+// Returns any errors from updating the config.
+func SaveOffsets(config common.ConfigFile, imageMap common.ImageMap, filters []string, root string) error {
+	return common.UpdateConfig(root, func(saved *common.ConfigFile) {
+		saved.MaxOffset = config.MaxOffset
+		saved.Reference = config.Reference
+		saved.Metric = config.Metric
+		saved.Search = config.Search
+		saved.Downsample = config.Downsample
+		for i, sourceConfig := range saved.Files {
+			for _, filter := range filters {
+				if loaded, ok := imageMap[filter]; ok && filter == sourceConfig.Filter {
+					saved.Files[i] = loaded.Config
+					saved.Files[i].Filename, saved.Files[i].Frame = sourceConfig.Filename, sourceConfig.Frame
+				}
 			}
 		}
+	})
+}
+
+// Unaligned returns the filters other than the reference whose images haven't been
+// aligned to the reference within maxOffset pixels yet, going by the alignment saved
+// with each image. Any filter needs aligning again once the alignment settings change.
+func Unaligned(imageMap common.ImageMap, filters []string, reference string, maxOffset int) []string {
+	var unaligned []string
+	for _, filter := range filters {
+		if filter == reference {
+			continue
+		}
+		quality := imageMap[filter].Config.Alignment
+		if quality == nil || quality.Reference != reference || quality.MaxOffset < maxOffset {
+			unaligned = append(unaligned, filter)
+		}
 	}
+	return unaligned
+}
 
-	// Update the green and red configs to have proper offsets.
-	greenImage := (*imageMap)[common.GREEN]
-	greenImage.Config.OffsetX = bgX
-	greenImage.Config.OffsetY = bgY
-	(*imageMap)[common.GREEN] = greenImage
-	redImage := (*imageMap)[common.RED]
-	redImage.Config.OffsetX = brX
-	redImage.Config.OffsetY = brY
-	(*imageMap)[common.RED] = redImage
+// checkConfidence returns an error if any aligned image has a confidence below the minimum.
+func checkConfidence(imageMap common.ImageMap, minConfidence float64) error {
+	for _, filter := range common.Filters {
+		quality := imageMap[filter].Config.Alignment
+		if quality == nil {
+			continue
+		}
+		if quality.Confidence < minConfidence {
+			return fmt.Errorf("rejecting composite, %s alignment confidence %.3f is below %.3f",
+				filter, quality.Confidence, minConfidence)
+		}
+	}
+	return nil
 }
 
-func CombineImages(imageMap common.ImageMap) image.Image {
+// compositeBounds finds the region of the composite to output and the color of
+// missing pixels. With the crop edge mode the region covers only the overlap of the
+// shifted images, otherwise it covers the reference image and any pixel missing from one
+// of the images is set to the fill color.
+// It returns the bounds, the fill color and any error encountered.
+func compositeBounds(imageMap common.ImageMap, reference string, edges *common.EdgesConfig) (image.Rectangle, color.RGBA, error) {
+	bounds := shiftedBounds(imageMap[reference])
+	fill := color.RGBA{0, 0, 0, 255}
+	if edges != nil {
+		switch edges.Mode {
+		case CROP:
+			for _, filter := range common.Filters {
+				bounds = bounds.Intersect(shiftedBounds(imageMap[filter]))
+			}
+			if bounds.Empty() {
+				return bounds, fill, fmt.Errorf("aligned images do not overlap")
+			}
+		case PAD:
+			if len(edges.Fill) == 0 {
+				break
+			}
+			if len(edges.Fill) != 3 {
+				return bounds, fill, fmt.Errorf("fill color must have red, green and blue values: %v", edges.Fill)
+			}
+			for _, v := range edges.Fill {
+				if v < 0 || v > 255 {
+					return bounds, fill, fmt.Errorf("fill color values must be from 0 to 255: %v", edges.Fill)
+				}
+			}
+			fill = color.RGBA{uint8(edges.Fill[0]), uint8(edges.Fill[1]), uint8(edges.Fill[2]), 255}
+		default:
+			return bounds, fill, fmt.Errorf("unknown edge mode %q, expected %s or %s", edges.Mode, CROP, PAD)
+		}
+	}
+	return bounds, fill, nil
+}
+
+// renderComposite blends the part of the aligned images within bounds into a color
+// image, setting pixels missing from any image to the fill color.
+// It returns the generated image.
+func renderComposite(imageMap common.ImageMap, bounds image.Rectangle, fill color.RGBA) *image.RGBA {
 	blueImage := imageMap[common.BLUE]
 	greenImage := imageMap[common.GREEN]
 	redImage := imageMap[common.RED]
 
-	bounds := blueImage.Image.Bounds()
 	composedImage := image.NewRGBA(bounds)
-	for x := 0; x < bounds.Dx(); x++ {
-		for y := 0; y < bounds.Dy(); y++ {
-			rgbaPixel := color.RGBA{
-				getPixel(redImage, x, y),
-				getPixel(greenImage, x, y),
-				getPixel(blueImage, x, y),
-				255}
-			composedImage.Set(x, y, rgbaPixel)
+	common.ParallelRows(bounds, func(_ int, rows image.Rectangle) {
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			dst := composedImage.PixOffset(bounds.Min.X, y)
+			for x := bounds.Min.X; x < bounds.Max.X; x, dst = x+1, dst+4 {
+				red, redOk := pixIndex(redImage, x, y)
+				green, greenOk := pixIndex(greenImage, x, y)
+				blue, blueOk := pixIndex(blueImage, x, y)
+				if !redOk || !greenOk || !blueOk {
+					composedImage.Pix[dst], composedImage.Pix[dst+1], composedImage.Pix[dst+2], composedImage.Pix[dst+3] =
+						fill.R, fill.G, fill.B, fill.A
+					continue
+				}
+				composedImage.Pix[dst] = redImage.Image.Pix[red]
+				composedImage.Pix[dst+1] = greenImage.Image.Pix[green]
+				composedImage.Pix[dst+2] = blueImage.Image.Pix[blue]
+				composedImage.Pix[dst+3] = 255
+			}
 		}
-	}
+	})
 
 	return composedImage
 }
 
-func OutputImageDiffs(imageMap common.ImageMap, root string) error {
-	bgImg, _ := subtractImages(imageMap[common.BLUE], imageMap[common.GREEN])
-	brImg, _ := subtractImages(imageMap[common.BLUE], imageMap[common.RED])
-
-	err := common.WriteImage(path.Join(root, fmt.Sprintf("output_v3_bg_align_%d%d.jpg", imageMap[common.GREEN].Config.OffsetX, imageMap[common.GREEN].Config.OffsetY)), bgImg)
+// CombineImages blends the aligned images into a color image covering the bounds chosen
+// by the edge mode.
+// It returns the generated image and any error encountered.
+func CombineImages(imageMap common.ImageMap, reference string, edges *common.EdgesConfig) (image.Image, error) {
+	bounds, fill, err := compositeBounds(imageMap, reference, edges)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return renderComposite(imageMap, bounds, fill), nil
+}
 
-	err = common.WriteImage(path.Join(root, fmt.Sprintf("output_v3_br_align_%d%d.jpg", imageMap[common.RED].Config.OffsetX, imageMap[common.RED].Config.OffsetY)), brImg)
+// CombineTiles blends the aligned images tile by tile and streams them to outputPath,
+// see common.WriteTiles, so the whole composite is never held in memory.
+// Returns any errors from combining or writing the tiles.
+func CombineTiles(imageMap common.ImageMap, reference string, edges *common.EdgesConfig, tiles common.TilesConfig, outputPath string, meta *common.Metadata) error {
+	bounds, fill, err := compositeBounds(imageMap, reference, edges)
 	if err != nil {
 		return err
 	}
+	return common.WriteTiles(outputPath, bounds, tiles.Size, func(r image.Rectangle) (image.Image, error) {
+		return renderComposite(imageMap, r, fill), nil
+	}, meta)
+}
+
+// OutputImageDiffs writes the differences between the reference image and each other
+// image at their current offsets, named for the first letters of the filters.
+// Returns any errors from the writes.
+func OutputImageDiffs(imageMap common.ImageMap, reference string, root string) error {
+	for _, filter := range common.Filters {
+		if filter == reference {
+			continue
+		}
+		diffImg, _ := subtractImages(imageMap[reference], imageMap[filter])
+		pair := strings.ToLower(reference[:1] + filter[:1])
+		offset := imageMap[filter].Config.Offset().Sub(imageMap[reference].Config.Offset())
+		err := common.WriteImage(path.Join(root, fmt.Sprintf("output_v3_%s_align_%d%d.jpg", pair, offset.X, offset.Y)), diffImg, nil)
+		common.PutGray(diffImg)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
 func CombineAndAlignImages(config common.ConfigFile, imageMap common.ImageMap, maxOffset int, root string) error {
+	if err := postprocess.CheckTiles(config); err != nil {
+		return err
+	}
+
+	reference, err := chooseReference(imageMap, config.Reference)
+	if err != nil {
+		return err
+	}
+
 	if maxOffset > config.MaxOffset {
 		// Output unalingned/last best aligned diffs.
-		OutputImageDiffs(imageMap, root)
+		OutputImageDiffs(imageMap, reference, root)
+
+		mask, err := roiMask(config.ROI, imageMap[reference])
+		if err != nil {
+			return err
+		}
+		if mask != nil {
+			if err := common.WriteImage(path.Join(root, "output_v3_roi.png"), &image.Gray{Pix: mask.Pix, Stride: mask.Stride, Rect: mask.Rect}, nil); err != nil {
+				return err
+			}
+		}
 
 		// Run the alignment algorithm to update the imageMap.
-		AlignImages(&imageMap, maxOffset)
+		fmt.Println("Aligning images to:", reference)
+		surfaces, err := AlignImages(&imageMap, maxOffset, reference, mask, config.Downsample, config.Metric, config.Search)
+		if err != nil {
+			return err
+		}
+		for _, filter := range common.Filters {
+			if imageMap[filter].Config.Alignment != nil {
+				fmt.Println(DescribeQuality(imageMap[filter]))
+			}
+		}
 
-		// Update the config file with new data
-		config.MaxOffset = maxOffset
-		for i, sourceConfig := range config.Files {
-			config.Files[i] = imageMap[sourceConfig.Filter].Config
+		if config.OutputSurface {
+			if err := OutputSurfaces(surfaces, reference, root); err != nil {
+				return err
+			}
 		}
 
-		if err := common.WriteConfig(root, config); err != nil {
+		// Update the config file with new data. Offsets found on drizzled images are in
+		// drizzled pixels rather than the pixels of the files so they aren't saved.
+		config.MaxOffset = maxOffset
+		if config.Drizzle != nil {
+			fmt.Println("Offsets of drizzled images are not saved to config.json")
+		} else if err := SaveOffsets(config, imageMap, common.Filters[:], root); err != nil {
 			return err
 		}
 	}
 
 	// Output new/current best diffs.
-	OutputImageDiffs(imageMap, root)
+	OutputImageDiffs(imageMap, reference, root)
+
+	if err := checkConfidence(imageMap, config.MinConfidence); err != nil {
+		return fmt.Errorf("%s: %s", root, err)
+	}
+
+	meta := common.NewMetadata("v3 aligning", config, imageMap)
+	meta.SetParameter("maxOffset", config.MaxOffset)
+	meta.SetParameter("reference", reference)
+	if config.ROI != nil {
+		meta.SetParameter("roi", config.ROI.Mode)
+	}
+	if config.Metric != "" {
+		meta.SetParameter("metric", config.Metric)
+	}
+	if config.Search != "" {
+		meta.SetParameter("search", config.Search)
+	}
+	if config.Downsample > 1 {
+		meta.SetParameter("downsample", config.Downsample)
+	}
+
+	if config.Tiles != nil {
+		output := config.Tiles.Output
+		if output == "" {
+			output = "output_v3_tiles"
+		}
+		return CombineTiles(imageMap, reference, config.Edges, *config.Tiles, path.Join(root, output), meta)
+	}
 
 	// Create combined colour image.
-	composedImage := CombineImages(imageMap)
+	composedImage, err := CombineImages(imageMap, reference, config.Edges)
+	if err != nil {
+		return err
+	}
+	composedImage, err = postprocess.Apply(config, composedImage, meta, root)
+	if err != nil {
+		return err
+	}
 
-	err := common.WriteImage(path.Join(root, "output_v3.jpg"), composedImage)
+	err = common.WriteImage(path.Join(root, "output_v3.jpg"), composedImage, meta)
 	if err != nil {
 		return err
 	}
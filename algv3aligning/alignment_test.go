@@ -0,0 +1,46 @@
+package algv3aligning
+
+import (
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// syntheticImages returns an image of each RGB filter of the given size filled with a
+// repeating gradient, each shifted by a few pixels from the blue image.
+func syntheticImages(size int) common.ImageMap {
+	imageMap := common.ImageMap{}
+	for i, filter := range common.Filters {
+		img := image.NewGray(image.Rect(0, 0, size, size))
+		for j := range img.Pix {
+			img.Pix[j] = uint8(j*(i+1) + j/size)
+		}
+		imageMap[filter] = common.LoadedConfig{
+			Config: common.ImageConfig{Filter: filter, OffsetX: 3 * i, OffsetY: -2 * i},
+			Image:  img,
+		}
+	}
+	return imageMap
+}
+
+func BenchmarkRenderComposite(b *testing.B) {
+	imageMap := syntheticImages(1024)
+	bounds := imageMap[common.BLUE].Image.Bounds()
+	fill := color.RGBA{0, 0, 0, 255}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		renderComposite(imageMap, bounds, fill)
+	}
+}
+
+func BenchmarkSubtractImages(b *testing.B) {
+	imageMap := syntheticImages(1024)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		img, _ := subtractImages(imageMap[common.BLUE], imageMap[common.RED])
+		common.PutGray(img)
+	}
+}
@@ -0,0 +1,190 @@
+package algv3aligning
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Number of intensity bins per image used by the mutual information metric.
+const mutualInformationBins = 32
+
+// Metric measures how badly a layer image matches a base image at their current
+// offsets. Costs are never negative and lower costs are better matches.
+type Metric struct {
+	// Prepare optionally transforms each image once before the search starts. Prepared
+	// images are scratch images returned with common.PutGray after the search.
+	Prepare func(img *image.Gray) *image.Gray
+	// Cost compares the overlap of two prepared images, only counting pixels within the
+	// mask if there is one.
+	Cost func(baseImage, layerImage common.LoadedConfig, mask *image.Alpha) float64
+}
+
+// Metrics are the alignment metrics that can be selected by name.
+var Metrics = map[string]Metric{
+	// Sum of absolute differences, ignoring middle differences.
+	"sad": {Cost: func(baseImage, layerImage common.LoadedConfig, mask *image.Alpha) float64 {
+		return float64(differenceImages(baseImage, layerImage, mask, nil))
+	}},
+	// Zero mean normalized cross correlation, insensitive to differences in brightness
+	// and contrast between filters.
+	"ncc": {Cost: func(baseImage, layerImage common.LoadedConfig, mask *image.Alpha) float64 {
+		return 1 - normalizedCrossCorrelation(baseImage, layerImage, mask)
+	}},
+	// Normalized mutual information, only assumes the intensities of the images are
+	// related rather than proportional.
+	"mi": {Cost: func(baseImage, layerImage common.LoadedConfig, mask *image.Alpha) float64 {
+		return 1 - mutualInformation(baseImage, layerImage, mask)
+	}},
+	// Correlation of the gradient magnitudes, matching edges such as limbs and craters
+	// rather than the intensities of the filters.
+	"gradient": {
+		Prepare: gradientMagnitude,
+		Cost: func(baseImage, layerImage common.LoadedConfig, mask *image.Alpha) float64 {
+			return 1 - normalizedCrossCorrelation(baseImage, layerImage, mask)
+		},
+	},
+}
+
+// GetMetric looks up an alignment metric by name, defaulting to sad.
+// It returns the metric and any error encountered.
+func GetMetric(name string) (Metric, error) {
+	if name == "" {
+		name = "sad"
+	}
+	metric, ok := Metrics[name]
+	if !ok {
+		var names []string
+		for name := range Metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return metric, fmt.Errorf("unknown alignment metric %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return metric, nil
+}
+
+// prepare applies the metric's preparation to an image.
+func (m Metric) prepare(loaded common.LoadedConfig) common.LoadedConfig {
+	if m.Prepare != nil {
+		loaded.Image = m.Prepare(loaded.Image)
+	}
+	return loaded
+}
+
+// release returns an image made by prepare to the scratch pool.
+func (m Metric) release(prepared common.LoadedConfig) {
+	if m.Prepare != nil {
+		common.PutGray(prepared.Image)
+	}
+}
+
+// differenceImages sums the absolute differences of two images over their masked
+// overlap, ignoring middle differences. If diff is provided the differences are also
+// drawn on it. Rows are compared in parallel bands.
+// It returns the sum of the differences.
+func differenceImages(baseImage, layerImage common.LoadedConfig, mask *image.Alpha, diff *image.Gray) int {
+	overlapBounds := maskedOverlap(baseImage, layerImage, mask)
+	bandDeltas := make([]int, common.Bands(overlapBounds))
+	common.ParallelRows(overlapBounds, func(band int, rows image.Rectangle) {
+		bandDelta := 0
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			// Both images cover the whole overlap so each row is contiguous in both.
+			base, _ := pixIndex(baseImage, rows.Min.X, y)
+			layer, _ := pixIndex(layerImage, rows.Min.X, y)
+			for x := rows.Min.X; x < rows.Max.X; x, base, layer = x+1, base+1, layer+1 {
+				if !inMask(mask, x, y) {
+					continue
+				}
+				delta := int(baseImage.Image.Pix[base]) - int(layerImage.Image.Pix[layer])
+				if delta < 0 {
+					delta *= -1
+				}
+				if diff != nil {
+					diff.Pix[diff.PixOffset(x, y)] = uint8(delta)
+				}
+				// Ignore middle deltas which probably represent the background and overshaddow the delta of the image.
+				// Want to minimize the extreme differences of image features.
+				// Values chosen from a minimum max delta of 134 and then split into quarters preserving values in top and bottom 25%.
+				if delta > 32 && delta < 96 {
+					continue
+				}
+				bandDelta += delta
+			}
+		}
+		bandDeltas[band] = bandDelta
+	})
+
+	totalDelta := 0
+	for _, delta := range bandDeltas {
+		totalDelta += delta
+	}
+	return totalDelta
+}
+
+// mutualInformation computes the mutual information of the intensities of two images
+// over their masked overlap, normalized by the entropy of the bins to lie between 0 and 1.
+func mutualInformation(baseImage, layerImage common.LoadedConfig, mask *image.Alpha) float64 {
+	const bins = mutualInformationBins
+	var joint [bins][bins]float64
+	var baseHist, layerHist [bins]float64
+	n := 0.0
+
+	bounds := maskedOverlap(baseImage, layerImage, mask)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if !inMask(mask, x, y) {
+				continue
+			}
+			base, _ := getPixel(baseImage, x, y)
+			layer, _ := getPixel(layerImage, x, y)
+			b, l := int(base)*bins/256, int(layer)*bins/256
+			joint[b][l]++
+			baseHist[b]++
+			layerHist[l]++
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+
+	information := 0.0
+	for b := 0; b < bins; b++ {
+		for l := 0; l < bins; l++ {
+			if joint[b][l] == 0 {
+				continue
+			}
+			pJoint := joint[b][l] / n
+			information += pJoint * math.Log(pJoint/(baseHist[b]/n*layerHist[l]/n))
+		}
+	}
+
+	return information / math.Log(bins)
+}
+
+// gradientMagnitude computes the Sobel gradient magnitude of an image.
+func gradientMagnitude(img *image.Gray) *image.Gray {
+	bounds := img.Bounds()
+	magnitude := common.GetGray(bounds)
+	at := func(x, y int) float64 {
+		x = int(common.Clamp(float64(x), float64(bounds.Min.X), float64(bounds.Max.X-1)))
+		y = int(common.Clamp(float64(y), float64(bounds.Min.Y), float64(bounds.Max.Y-1)))
+		return float64(img.GrayAt(x, y).Y)
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+			// The largest possible magnitude is 4 * 255 * sqrt(2).
+			magnitude.SetGray(x, y, color.Gray{uint8(math.Min(255, math.Hypot(gx, gy)/4))})
+		}
+	}
+
+	return magnitude
+}
@@ -0,0 +1,59 @@
+package algv3aligning
+
+import (
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+)
+
+// downsampleGray shrinks an image by an integer factor, averaging each factor by factor
+// block of pixels. Partial blocks at the right and bottom edges are dropped.
+func downsampleGray(img *image.Gray, factor int) *image.Gray {
+	bounds := img.Bounds()
+	small := image.NewGray(image.Rect(0, 0, bounds.Dx()/factor, bounds.Dy()/factor))
+	common.ParallelRows(small.Rect, func(_ int, rows image.Rectangle) {
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := 0; x < small.Rect.Dx(); x++ {
+				sum := 0
+				for dy := 0; dy < factor; dy++ {
+					i := img.PixOffset(bounds.Min.X+x*factor, bounds.Min.Y+y*factor+dy)
+					for _, v := range img.Pix[i : i+factor] {
+						sum += int(v)
+					}
+				}
+				small.Pix[small.PixOffset(x, y)] = uint8(sum / (factor * factor))
+			}
+		}
+	})
+	return small
+}
+
+// downsampleMask shrinks a mask of the composite, where the reference image sits at
+// origin, to the coordinates of a downsampled reference image at no offset. A block is
+// part of the small mask if any of its pixels are.
+func downsampleMask(mask *image.Alpha, origin image.Point, factor int) *image.Alpha {
+	if mask == nil {
+		return nil
+	}
+	bounds := mask.Rect.Sub(origin)
+	small := image.NewAlpha(image.Rect(bounds.Min.X/factor, bounds.Min.Y/factor, bounds.Max.X/factor, bounds.Max.Y/factor))
+	for y := small.Rect.Min.Y; y < small.Rect.Max.Y; y++ {
+		for x := small.Rect.Min.X; x < small.Rect.Max.X; x++ {
+			block := image.Rect(x*factor, y*factor, (x+1)*factor, (y+1)*factor).Add(origin)
+			for by := block.Min.Y; by < block.Max.Y; by++ {
+				for bx := block.Min.X; bx < block.Max.X; bx++ {
+					if inMask(mask, bx, by) {
+						small.Pix[small.PixOffset(x, y)] = 255
+					}
+				}
+			}
+		}
+	}
+	return small
+}
+
+// downsampleImage shrinks a loaded image by a factor, placing it at no offset.
+func downsampleImage(loaded common.LoadedConfig, factor int) common.LoadedConfig {
+	loaded.Image = downsampleGray(loaded.Image, factor)
+	loaded.Config.OffsetX, loaded.Config.OffsetY = 0, 0
+	return loaded
+}
@@ -0,0 +1,263 @@
+package algv3aligning
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"math"
+)
+
+// Alternative minima closer than this many pixels to the best offset are part of the
+// same peak and are ignored when finding the second best offset.
+const peakRadius = 2
+
+// CostSurface holds the alignment cost of every offset tried for a pair of images.
+// Costs[y][x] is the cost of the offset (Min.X + x, Min.Y + y), offsets that were not
+// evaluated are NaN.
+type CostSurface struct {
+	Min   image.Point
+	Costs [][]float64
+}
+
+// NewCostSurface creates an empty surface for offsets within r.
+func NewCostSurface(r image.Rectangle) *CostSurface {
+	costs := make([][]float64, r.Dy())
+	for i := range costs {
+		costs[i] = make([]float64, r.Dx())
+		for j := range costs[i] {
+			costs[i][j] = math.NaN()
+		}
+	}
+	return &CostSurface{r.Min, costs}
+}
+
+// Bounds returns the offsets covered by the surface, an empty rectangle when no offsets
+// were searched.
+func (s *CostSurface) Bounds() image.Rectangle {
+	if len(s.Costs) == 0 || len(s.Costs[0]) == 0 {
+		return image.Rectangle{s.Min, s.Min}
+	}
+	return image.Rect(0, 0, len(s.Costs[0]), len(s.Costs)).Add(s.Min)
+}
+
+// Set records the cost of an offset.
+func (s *CostSurface) Set(offset image.Point, cost float64) {
+	s.Costs[offset.Y-s.Min.Y][offset.X-s.Min.X] = cost
+}
+
+// At returns the cost of an offset, NaN if it was not evaluated.
+func (s *CostSurface) At(offset image.Point) float64 {
+	return s.Costs[offset.Y-s.Min.Y][offset.X-s.Min.X]
+}
+
+// Best returns the offset with the lowest cost and its cost.
+func (s *CostSurface) Best() (image.Point, float64) {
+	best, bestCost := s.Min, math.Inf(1)
+	for y, row := range s.Costs {
+		for x, cost := range row {
+			if cost < bestCost {
+				best, bestCost = s.Min.Add(image.Pt(x, y)), cost
+			}
+		}
+	}
+	return best, bestCost
+}
+
+// SubPixelBest refines the best offset to a fraction of a pixel by fitting a parabola
+// through its cost and the costs of its neighbours along each axis. Axes where a
+// neighbour wasn't evaluated keep the whole pixel offset.
+// It returns the refined x and y offsets.
+func (s *CostSurface) SubPixelBest() (float64, float64) {
+	best, cost := s.Best()
+	refine := func(step image.Point) float64 {
+		before, after := best.Sub(step), best.Add(step)
+		bounds := s.Bounds()
+		if !before.In(bounds) || !after.In(bounds) {
+			return 0
+		}
+		a, b := s.At(before), s.At(after)
+		curvature := a - 2*cost + b
+		if math.IsNaN(curvature) || math.IsInf(curvature, 0) || curvature <= 0 {
+			return 0
+		}
+		return common.Clamp((a-b)/(2*curvature), -0.5, 0.5)
+	}
+	return float64(best.X) + refine(image.Pt(1, 0)), float64(best.Y) + refine(image.Pt(0, 1))
+}
+
+// secondBest returns the cost of the lowest local minimum that isn't part of the peak
+// around the best offset, or false if there is no such minimum.
+func (s *CostSurface) secondBest(best image.Point) (float64, bool) {
+	second, found := math.Inf(1), false
+	for y, row := range s.Costs {
+		for x, cost := range row {
+			offset := s.Min.Add(image.Pt(x, y))
+			delta := offset.Sub(best)
+			if delta.X <= peakRadius && delta.X >= -peakRadius && delta.Y <= peakRadius && delta.Y >= -peakRadius {
+				continue
+			}
+			if math.IsNaN(cost) || cost >= second || !s.isLocalMinimum(x, y) {
+				continue
+			}
+			second, found = cost, true
+		}
+	}
+	return second, found
+}
+
+func (s *CostSurface) isLocalMinimum(x, y int) bool {
+	cost := s.Costs[y][x]
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			if y+dy < 0 || y+dy >= len(s.Costs) || x+dx < 0 || x+dx >= len(s.Costs[y+dy]) {
+				continue
+			}
+			if s.Costs[y+dy][x+dx] < cost {
+				return false
+			}
+			// Minima next to offsets that weren't evaluated may not be minima at all.
+			if math.IsNaN(s.Costs[y+dy][x+dx]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// sharpness measures how far the best cost stands out from the rest of the surface in
+// standard deviations. Flat surfaces have a sharpness close to 0. Offsets with an
+// infinite cost were rejected rather than measured and are left out.
+func (s *CostSurface) sharpness() float64 {
+	var sum, sumSq, count float64
+	for _, row := range s.Costs {
+		for _, cost := range row {
+			if math.IsNaN(cost) || math.IsInf(cost, 0) {
+				continue
+			}
+			sum += cost
+			sumSq += cost * cost
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	mean := sum / count
+	std := math.Sqrt(math.Max(0, sumSq/count-mean*mean))
+	if std == 0 {
+		return 0
+	}
+	_, best := s.Best()
+	return (mean - best) / std
+}
+
+// overlap returns the region of the composite covered by both images.
+func overlap(baseImage, layerImage common.LoadedConfig) image.Rectangle {
+	return shiftedBounds(baseImage).Intersect(shiftedBounds(layerImage))
+}
+
+// maskedOverlap returns the region of the composite covered by both images and the
+// mask, if any.
+func maskedOverlap(baseImage, layerImage common.LoadedConfig, mask *image.Alpha) image.Rectangle {
+	bounds := overlap(baseImage, layerImage)
+	if mask != nil {
+		bounds = bounds.Intersect(mask.Rect)
+	}
+	return bounds
+}
+
+// inMask returns whether a point of the composite is part of the mask, every point is
+// when there is no mask.
+func inMask(mask *image.Alpha, x, y int) bool {
+	return mask == nil || mask.AlphaAt(x, y).A != 0
+}
+
+// normalizedCrossCorrelation computes the zero mean normalized cross correlation of the
+// masked overlap of two images at their current offsets. 1 is a perfect match, 0 is no
+// correlation.
+func normalizedCrossCorrelation(baseImage, layerImage common.LoadedConfig, mask *image.Alpha) float64 {
+	bounds := maskedOverlap(baseImage, layerImage, mask)
+	var sumB, sumL, sumBB, sumLL, sumBL, n float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if !inMask(mask, x, y) {
+				continue
+			}
+			base, _ := getPixel(baseImage, x, y)
+			layer, _ := getPixel(layerImage, x, y)
+			b, l := float64(base), float64(layer)
+			sumB += b
+			sumL += l
+			sumBB += b * b
+			sumLL += l * l
+			sumBL += b * l
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	covariance := sumBL - sumB*sumL/n
+	varianceB := sumBB - sumB*sumB/n
+	varianceL := sumLL - sumL*sumL/n
+	if varianceB <= 0 || varianceL <= 0 {
+		return 0
+	}
+	return covariance / math.Sqrt(varianceB*varianceL)
+}
+
+// meanAbsoluteDifference computes the mean absolute difference in intensity over the
+// masked overlap of two images at their current offsets.
+func meanAbsoluteDifference(baseImage, layerImage common.LoadedConfig, mask *image.Alpha) float64 {
+	bounds := maskedOverlap(baseImage, layerImage, mask)
+	total, n := 0.0, 0.0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if !inMask(mask, x, y) {
+				continue
+			}
+			base, _ := getPixel(baseImage, x, y)
+			layer, _ := getPixel(layerImage, x, y)
+			total += math.Abs(float64(base) - float64(layer))
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return total / n
+}
+
+// MeasureQuality summarizes how trustworthy the alignment of a layer image to a base
+// image is, given the cost surface the alignment was chosen from. The layer must
+// already be at its chosen offset. The image measures only use pixels within the mask.
+func MeasureQuality(reference string, surface *CostSurface, baseImage, layerImage common.LoadedConfig, mask *image.Alpha) *common.AlignmentQuality {
+	best, bestCost := surface.Best()
+
+	ratio := 0.0
+	if second, ok := surface.secondBest(best); ok {
+		ratio = 1
+		if second > 0 {
+			ratio = bestCost / second
+		}
+	}
+
+	ncc := normalizedCrossCorrelation(baseImage, layerImage, mask)
+
+	return &common.AlignmentQuality{
+		Reference:       reference,
+		Confidence:      math.Max(0, ncc) * (1 - ratio),
+		Sharpness:       surface.sharpness(),
+		SecondBestRatio: ratio,
+		NCC:             ncc,
+		Residual:        meanAbsoluteDifference(baseImage, layerImage, mask),
+	}
+}
+
+// DescribeQuality returns a one line summary of the alignment of an image.
+func DescribeQuality(layerImage common.LoadedConfig) string {
+	quality := layerImage.Config.Alignment
+	return fmt.Sprintf("%s aligned to %s at (%d, %d): confidence %.3f, sharpness %.2f, second best ratio %.3f, ncc %.3f, residual %.2f",
+		layerImage.Config.Filter, quality.Reference, layerImage.Config.OffsetX, layerImage.Config.OffsetY,
+		quality.Confidence, quality.Sharpness, quality.SecondBestRatio, quality.NCC, quality.Residual)
+}
@@ -0,0 +1,106 @@
+package algv3aligning
+
+import (
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"math"
+	"testing"
+)
+
+// bowlSurface returns a surface over offsets -3 to 3 whose cost is the lowest of the
+// squared distances to each minimum plus the depth of that minimum.
+func bowlSurface(minima map[image.Point]float64) *CostSurface {
+	surface := NewCostSurface(image.Rect(-3, -3, 4, 4))
+	for y := -3; y <= 3; y++ {
+		for x := -3; x <= 3; x++ {
+			offset := image.Pt(x, y)
+			cost := math.Inf(1)
+			for minimum, depth := range minima {
+				d := offset.Sub(minimum)
+				cost = math.Min(cost, float64(d.X*d.X+d.Y*d.Y)+depth)
+			}
+			surface.Set(offset, cost)
+		}
+	}
+	return surface
+}
+
+// gradientImage returns an image filled with a gradient, inverted when invert is set.
+func gradientImage(filter string, invert bool) common.LoadedConfig {
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 4)
+		if invert {
+			img.Pix[i] = 255 - img.Pix[i]
+		}
+	}
+	return common.LoadedConfig{Config: common.ImageConfig{Filter: filter}, Image: img}
+}
+
+func TestMeasureQuality(t *testing.T) {
+	tests := []struct {
+		name           string
+		surface        *CostSurface
+		invert         bool
+		wantRatio      float64
+		wantConfidence float64
+	}{
+		{
+			name:           "single minimum",
+			surface:        bowlSurface(map[image.Point]float64{{0, 0}: 1}),
+			wantRatio:      0,
+			wantConfidence: 1,
+		},
+		{
+			name:           "second minimum twice the best cost",
+			surface:        bowlSurface(map[image.Point]float64{{-3, 0}: 1, {3, 0}: 2}),
+			wantRatio:      0.5,
+			wantConfidence: 0.5,
+		},
+		{
+			name:           "two equal minima",
+			surface:        bowlSurface(map[image.Point]float64{{-3, 0}: 1, {3, 0}: 1}),
+			wantRatio:      1,
+			wantConfidence: 0,
+		},
+		{
+			name:           "second minimum with zero cost",
+			surface:        bowlSurface(map[image.Point]float64{{-3, 0}: -1, {3, 0}: 0}),
+			wantRatio:      1,
+			wantConfidence: 0,
+		},
+		{
+			name:           "minima within the peak",
+			surface:        bowlSurface(map[image.Point]float64{{0, 0}: 1, {2, 0}: 1}),
+			wantRatio:      0,
+			wantConfidence: 1,
+		},
+		{
+			name:           "anticorrelated images",
+			surface:        bowlSurface(map[image.Point]float64{{0, 0}: 1}),
+			invert:         true,
+			wantRatio:      0,
+			wantConfidence: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := gradientImage(common.BLUE, false)
+			layer := gradientImage(common.RED, test.invert)
+			quality := MeasureQuality(common.BLUE, test.surface, base, layer, nil)
+			if quality.Reference != common.BLUE {
+				t.Errorf("reference = %q, want %q", quality.Reference, common.BLUE)
+			}
+			if math.Abs(quality.SecondBestRatio-test.wantRatio) > 1e-9 {
+				t.Errorf("second best ratio = %g, want %g", quality.SecondBestRatio, test.wantRatio)
+			}
+			if math.Abs(quality.Confidence-test.wantConfidence) > 1e-9 {
+				t.Errorf("confidence = %g, want %g", quality.Confidence, test.wantConfidence)
+			}
+			if quality.Confidence < 0 || quality.Confidence > 1 {
+				t.Errorf("confidence = %g, want between 0 and 1", quality.Confidence)
+			}
+		})
+	}
+}
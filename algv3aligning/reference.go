@@ -0,0 +1,57 @@
+package algv3aligning
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+)
+
+// AUTO chooses the alignment reference or region of interest from the images.
+const AUTO = "auto"
+
+// laplacianVariance measures the sharpness of an image as the variance of its
+// Laplacian. Blurred or noisy frames score lower than frames with crisp detail.
+func laplacianVariance(loaded common.LoadedConfig) float64 {
+	img := loaded.Image
+	bounds := img.Bounds()
+	var sum, sumSq, n float64
+	for y := bounds.Min.Y + 1; y < bounds.Max.Y-1; y++ {
+		for x := bounds.Min.X + 1; x < bounds.Max.X-1; x++ {
+			laplacian := 4*float64(img.GrayAt(x, y).Y) -
+				float64(img.GrayAt(x-1, y).Y) - float64(img.GrayAt(x+1, y).Y) -
+				float64(img.GrayAt(x, y-1).Y) - float64(img.GrayAt(x, y+1).Y)
+			sum += laplacian
+			sumSq += laplacian * laplacian
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	mean := sum / n
+	return sumSq/n - mean*mean
+}
+
+// chooseReference resolves the name of the reference filter the other images are
+// aligned to. An empty name is blue and auto is the sharpest image.
+// It returns the reference filter and any error encountered.
+func chooseReference(imageMap common.ImageMap, name string) (string, error) {
+	switch name {
+	case "":
+		return common.BLUE, nil
+	case AUTO:
+		reference, sharpest := "", -1.0
+		for _, filter := range common.Filters {
+			if sharpness := laplacianVariance(imageMap[filter]); sharpness > sharpest {
+				reference, sharpest = filter, sharpness
+			}
+		}
+		return reference, nil
+	}
+
+	for _, filter := range common.Filters {
+		if filter == name {
+			return filter, nil
+		}
+	}
+	return "", fmt.Errorf("unknown reference %q, expected %s or one of %v", name, AUTO, common.Filters)
+}
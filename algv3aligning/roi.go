@@ -0,0 +1,188 @@
+package algv3aligning
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"image/color"
+)
+
+// The supported kinds of alignment region of interest, besides auto for the brightest
+// object.
+const (
+	RECT    = "rect"
+	POLYGON = "polygon"
+)
+
+// roiMask builds the mask of the pixels of the reference image that count towards the
+// alignment cost, in the coordinates of the composite. Regions are given in the pixel
+// coordinates of the reference image.
+// It returns the mask, nil if there is no region of interest, and any error encountered.
+func roiMask(roi *common.ROIConfig, referenceImage common.LoadedConfig) (*image.Alpha, error) {
+	if roi == nil {
+		return nil, nil
+	}
+
+	bounds := referenceImage.Image.Bounds()
+	mask := image.NewAlpha(bounds)
+	switch roi.Mode {
+	case RECT:
+		if roi.Rect == nil {
+			return nil, fmt.Errorf("rect region of interest requires a rect")
+		}
+		region := roi.Rect.Rectangle().Intersect(bounds)
+		for y := region.Min.Y; y < region.Max.Y; y++ {
+			for x := region.Min.X; x < region.Max.X; x++ {
+				mask.SetAlpha(x, y, color.Alpha{255})
+			}
+		}
+	case POLYGON:
+		if len(roi.Polygon) < 3 {
+			return nil, fmt.Errorf("polygon region of interest requires at least 3 vertices: %v", roi.Polygon)
+		}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if insidePolygon(roi.Polygon, float64(x)+0.5, float64(y)+0.5) {
+					mask.SetAlpha(x, y, color.Alpha{255})
+				}
+			}
+		}
+	case AUTO:
+		brightestObject(referenceImage.Image, mask)
+	default:
+		return nil, fmt.Errorf("unknown region of interest %q, expected %s, %s or %s", roi.Mode, RECT, POLYGON, AUTO)
+	}
+
+	mask = growMask(mask, roi.Margin)
+
+	count := 0
+	for _, a := range mask.Pix {
+		if a != 0 {
+			count++
+		}
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("region of interest does not cover any pixels of %s", referenceImage.Config.Filter)
+	}
+	fmt.Printf("Aligning on %d pixels of %s\n", count, referenceImage.Config.Filter)
+
+	// Move the mask to where the reference image sits in the composite.
+	mask.Rect = mask.Rect.Add(referenceImage.Config.Offset())
+	return mask, nil
+}
+
+// insidePolygon tests whether a point is inside a polygon with the even-odd rule.
+func insidePolygon(polygon [][2]int, x, y float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		xi, yi := float64(polygon[i][0]), float64(polygon[i][1])
+		xj, yj := float64(polygon[j][0]), float64(polygon[j][1])
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// brightestObject marks the connected region above an Otsu threshold with the largest
+// total brightness, e.g. the disc of the target rather than a faint moon or ring.
+// Regions touching the edge of the frame, such as a bright background or a planet
+// filling the view, are only chosen if there is nothing else.
+func brightestObject(img *image.Gray, mask *image.Alpha) {
+	threshold := otsuThreshold(img)
+	bounds := img.Bounds()
+	labels := make([]int, len(img.Pix))
+	best, bestBrightness, bestEdge := 0, 0, true
+	label := 0
+
+	for start := range img.Pix {
+		if labels[start] != 0 || img.Pix[start] <= threshold {
+			continue
+		}
+		label++
+		labels[start] = label
+		brightness, edge := 0, false
+		stack := []int{start}
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			brightness += int(img.Pix[i])
+			x, y := i%bounds.Dx(), i/bounds.Dx()
+			for _, n := range [4][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+				if n[0] < 0 || n[0] >= bounds.Dx() || n[1] < 0 || n[1] >= bounds.Dy() {
+					edge = true
+					continue
+				}
+				j := n[1]*bounds.Dx() + n[0]
+				if labels[j] == 0 && img.Pix[j] > threshold {
+					labels[j] = label
+					stack = append(stack, j)
+				}
+			}
+		}
+		if (bestEdge && !edge) || (edge == bestEdge && brightness > bestBrightness) {
+			best, bestBrightness, bestEdge = label, brightness, edge
+		}
+	}
+
+	for i, l := range labels {
+		if l == best && best != 0 {
+			mask.Pix[i] = 255
+		}
+	}
+}
+
+// otsuThreshold returns the intensity that best separates an image into foreground and
+// background by maximizing the variance between the two classes.
+func otsuThreshold(img *image.Gray) uint8 {
+	var histogram [256]float64
+	for _, v := range img.Pix {
+		histogram[v]++
+	}
+
+	total, sum := float64(len(img.Pix)), 0.0
+	for v, count := range histogram {
+		sum += float64(v) * count
+	}
+
+	var threshold uint8
+	var backgroundCount, backgroundSum, bestVariance float64
+	for v, count := range histogram {
+		backgroundCount += count
+		backgroundSum += float64(v) * count
+		foregroundCount := total - backgroundCount
+		if backgroundCount == 0 || foregroundCount == 0 {
+			continue
+		}
+		meanBackground := backgroundSum / backgroundCount
+		meanForeground := (sum - backgroundSum) / foregroundCount
+		variance := backgroundCount * foregroundCount * (meanBackground - meanForeground) * (meanBackground - meanForeground)
+		if variance > bestVariance {
+			threshold, bestVariance = uint8(v), variance
+		}
+	}
+	return threshold
+}
+
+// growMask dilates a mask by margin pixels in every direction.
+func growMask(mask *image.Alpha, margin int) *image.Alpha {
+	if margin <= 0 {
+		return mask
+	}
+	bounds := mask.Bounds()
+	grown := image.NewAlpha(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if mask.AlphaAt(x, y).A == 0 {
+				continue
+			}
+			region := image.Rect(x-margin, y-margin, x+margin+1, y+margin+1).Intersect(bounds)
+			for gy := region.Min.Y; gy < region.Max.Y; gy++ {
+				for gx := region.Min.X; gx < region.Max.X; gx++ {
+					grown.SetAlpha(gx, gy, color.Alpha{255})
+				}
+			}
+		}
+	}
+	return grown
+}
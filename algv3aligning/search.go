@@ -0,0 +1,102 @@
+package algv3aligning
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"math"
+)
+
+// The supported alignment search strategies.
+const (
+	EXHAUSTIVE = "exhaustive"
+	DESCENT    = "descent"
+)
+
+// A Search finds the offsets of a layer image relative to a base image within
+// maxOffset pixels of the starting offset of the layer, evaluating offsets with a metric.
+// It returns the surface of the costs it evaluated, offsets it skipped are NaN.
+type Search func(baseImage, layerImage common.LoadedConfig, maxOffset int, cost func(baseImage, layerImage common.LoadedConfig) float64) *CostSurface
+
+// Searches are the alignment search strategies that can be selected by name.
+var Searches = map[string]Search{
+	EXHAUSTIVE: exhaustiveSearch,
+	DESCENT:    descentSearch,
+}
+
+// GetSearch looks up a search strategy by name, defaulting to exhaustive.
+// It returns the search and any error encountered.
+func GetSearch(name string) (Search, error) {
+	if name == "" {
+		name = EXHAUSTIVE
+	}
+	search, ok := Searches[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown alignment search %q, expected %s or %s", name, EXHAUSTIVE, DESCENT)
+	}
+	return search, nil
+}
+
+// searchBounds returns the offsets a search may try for a layer image.
+func searchBounds(layerImage common.LoadedConfig, maxOffset int) image.Rectangle {
+	return image.Rect(-maxOffset, -maxOffset, maxOffset, maxOffset).Add(layerImage.Config.Offset())
+}
+
+// evaluate computes the cost of a layer image at an offset.
+func evaluate(baseImage, layerImage common.LoadedConfig, offset image.Point, cost func(baseImage, layerImage common.LoadedConfig) float64) float64 {
+	layerImage.Config.OffsetX = offset.X
+	layerImage.Config.OffsetY = offset.Y
+	return cost(baseImage, layerImage)
+}
+
+// exhaustiveSearch tries every offset.
+func exhaustiveSearch(baseImage, layerImage common.LoadedConfig, maxOffset int, cost func(baseImage, layerImage common.LoadedConfig) float64) *CostSurface {
+	offsets := searchBounds(layerImage, maxOffset)
+	surface := NewCostSurface(offsets)
+	for x := offsets.Min.X; x < offsets.Max.X; x++ {
+		for y := offsets.Min.Y; y < offsets.Max.Y; y++ {
+			offset := image.Pt(x, y)
+			surface.Set(offset, evaluate(baseImage, layerImage, offset, cost))
+		}
+	}
+	return surface
+}
+
+// descentSearch starts at the offset of the layer image and repeatedly moves to the
+// best neighbouring offset until none of them improve the cost. It is much faster than
+// an exhaustive search when the cost surface has a single minimum but can get stuck in
+// a local minimum otherwise.
+func descentSearch(baseImage, layerImage common.LoadedConfig, maxOffset int, cost func(baseImage, layerImage common.LoadedConfig) float64) *CostSurface {
+	offsets := searchBounds(layerImage, maxOffset)
+	surface := NewCostSurface(offsets)
+
+	costAt := func(offset image.Point) float64 {
+		if existing := surface.At(offset); !math.IsNaN(existing) {
+			return existing
+		}
+		value := evaluate(baseImage, layerImage, offset, cost)
+		surface.Set(offset, value)
+		return value
+	}
+
+	current := layerImage.Config.Offset()
+	currentCost := costAt(current)
+	for {
+		next, nextCost := current, currentCost
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				neighbour := current.Add(image.Pt(dx, dy))
+				if !neighbour.In(offsets) {
+					continue
+				}
+				if neighbourCost := costAt(neighbour); neighbourCost < nextCost {
+					next, nextCost = neighbour, neighbourCost
+				}
+			}
+		}
+		if next == current {
+			return surface
+		}
+		current, currentCost = next, nextCost
+	}
+}
@@ -0,0 +1,121 @@
+package algv3aligning
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"path"
+)
+
+// Heatmaps are scaled up so each offset covers at least this many pixels across.
+const heatmapCellSize = 4
+
+// CSV writes the surface as a grid with x offsets across the first row and y offsets
+// down the first column. An empty surface only has the header.
+func (s *CostSurface) CSV() []byte {
+	var b bytes.Buffer
+
+	b.WriteString("y\\x")
+	bounds := s.Bounds()
+	for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		fmt.Fprintf(&b, ",%d", x)
+	}
+	b.WriteString("\n")
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := s.Costs[y-s.Min.Y]
+		fmt.Fprintf(&b, "%d", y)
+		for _, cost := range row {
+			if math.IsNaN(cost) {
+				b.WriteString(",")
+				continue
+			}
+			fmt.Fprintf(&b, ",%g", cost)
+		}
+		b.WriteString("\n")
+	}
+
+	return b.Bytes()
+}
+
+// Heatmap renders the surface as a false color image where low costs are dark. The
+// best offset is marked in white, offsets that weren't evaluated are black and offsets
+// rejected with an infinite cost take the brightest color. An empty surface is a single
+// black cell.
+func (s *CostSurface) Heatmap(colormap common.Colormap) image.Image {
+	bounds := s.Bounds()
+	if bounds.Empty() {
+		heatmap := image.NewRGBA(image.Rect(0, 0, heatmapCellSize, heatmapCellSize))
+		draw.Draw(heatmap, heatmap.Bounds(), image.Black, image.Point{}, draw.Src)
+		return heatmap
+	}
+
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, row := range s.Costs {
+		for _, cost := range row {
+			if math.IsNaN(cost) || math.IsInf(cost, 0) {
+				continue
+			}
+			low = math.Min(low, cost)
+			high = math.Max(high, cost)
+		}
+	}
+	scale := high - low
+	if scale == 0 {
+		scale = 1
+	}
+
+	best, _ := s.Best()
+	best = best.Sub(s.Min)
+
+	heatmap := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*heatmapCellSize, bounds.Dy()*heatmapCellSize))
+	for y, row := range s.Costs {
+		for x, cost := range row {
+			cellColor := colormap.At((cost - low) / scale)
+			if math.IsNaN(cost) {
+				cellColor = color.RGBA{0, 0, 0, 255}
+			}
+			if x == best.X && y == best.Y {
+				cellColor.R, cellColor.G, cellColor.B = 255, 255, 255
+			}
+			for dy := 0; dy < heatmapCellSize; dy++ {
+				for dx := 0; dx < heatmapCellSize; dx++ {
+					heatmap.SetRGBA(x*heatmapCellSize+dx, y*heatmapCellSize+dy, cellColor)
+				}
+			}
+		}
+	}
+
+	return heatmap
+}
+
+// OutputSurfaces writes the cost surface of each aligned filter as a CSV file and a
+// heatmap image named for the reference and aligned filters.
+// Returns any errors from the writes.
+func OutputSurfaces(surfaces map[string]*CostSurface, reference, root string) error {
+	colormap, err := common.GetColormap("inferno")
+	if err != nil {
+		return err
+	}
+
+	for filter, surface := range surfaces {
+		name := fmt.Sprintf("output_v3_surface_%s_%s", reference, filter)
+
+		csvPath := path.Join(root, name+".csv")
+		fmt.Println("Writing cost surface to:", csvPath)
+		if err := ioutil.WriteFile(csvPath, surface.CSV(), 0644); err != nil {
+			return fmt.Errorf("cannot write cost surface to %s: %s", csvPath, err)
+		}
+
+		if err := common.WriteImage(path.Join(root, name+".png"), surface.Heatmap(colormap), nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package algv3aligning
+
+import (
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"testing"
+)
+
+func TestSurfaceOutputs(t *testing.T) {
+	colormap, err := common.GetColormap("inferno")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evaluated := NewCostSurface(image.Rect(-1, 0, 1, 2))
+	evaluated.Set(image.Pt(-1, 0), 2)
+	evaluated.Set(image.Pt(0, 0), 1)
+	evaluated.Set(image.Pt(-1, 1), 3)
+
+	tests := []struct {
+		name       string
+		surface    *CostSurface
+		wantCSV    string
+		wantBounds image.Rectangle
+	}{
+		{
+			name:       "no offsets searched",
+			surface:    NewCostSurface(image.Rectangle{}),
+			wantCSV:    "y\\x\n",
+			wantBounds: image.Rect(0, 0, heatmapCellSize, heatmapCellSize),
+		},
+		{
+			name:       "no offsets across",
+			surface:    &CostSurface{image.Pt(2, 2), [][]float64{{}}},
+			wantCSV:    "y\\x\n",
+			wantBounds: image.Rect(0, 0, heatmapCellSize, heatmapCellSize),
+		},
+		{
+			name:       "partly evaluated",
+			surface:    evaluated,
+			wantCSV:    "y\\x,-1,0\n0,2,1\n1,3,\n",
+			wantBounds: image.Rect(0, 0, 2*heatmapCellSize, 2*heatmapCellSize),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if csv := string(test.surface.CSV()); csv != test.wantCSV {
+				t.Errorf("CSV() = %q, want %q", csv, test.wantCSV)
+			}
+			if bounds := test.surface.Heatmap(colormap).Bounds(); bounds != test.wantBounds {
+				t.Errorf("Heatmap() bounds = %v, want %v", bounds, test.wantBounds)
+			}
+			test.surface.SubPixelBest()
+		})
+	}
+}
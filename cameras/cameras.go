@@ -0,0 +1,489 @@
+// A package containing the functions for combining the frames of the narrow and wide angle
+// cameras of an observation, coloring the detail of the narrow angle frame with the color
+// of the wide angle frames around it.
+package cameras
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/algv3aligning"
+	"github.com/lewchuk/gostitcher/common"
+	"github.com/lewchuk/gostitcher/lrgb"
+	"github.com/lewchuk/gostitcher/postprocess"
+	"image"
+	"image/color"
+	"math"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Shrunk narrow angle frames are matched on images downsampled until they are about this
+// many pixels across before the match is refined at full resolution.
+const coarseSize = 16
+
+// The color the footprint of the narrow angle frame is outlined with in the context image.
+var outlineColor = color.RGBA{255, 220, 0, 255}
+
+// camerasDefaults fills in any unset camera parameters, the scale from the sizes of the
+// frames as full frames of both cameras cover their whole fields of view.
+func camerasDefaults(config common.CamerasConfig, wide, narrow image.Rectangle) common.CamerasConfig {
+	if config.Scale == 0 {
+		config.Scale = common.NarrowScale * float64(wide.Dx()) / float64(narrow.Dx())
+	}
+	if config.ScaleRange == 0 {
+		config.ScaleRange = 0.1
+	}
+	if config.MinCorrelation == 0 {
+		config.MinCorrelation = 0.8
+	}
+	if config.Space == "" {
+		config.Space = lrgb.LAB
+	}
+	return config
+}
+
+// Footprint places the narrow angle frame in the wide angle frame: the point (x, y) of the
+// narrow angle frame falls on the point (X + x * Scale, Y + y * Scale) of the wide angle
+// frame.
+type Footprint struct {
+	Scale float64
+	X, Y  float64
+	// Correlation is the normalized cross correlation of the frames at the footprint.
+	Correlation float64
+}
+
+// toWide returns the point of the wide angle frame a point of the narrow angle frame falls on.
+func (f Footprint) toWide(x, y float64) (float64, float64) {
+	return f.X + x*f.Scale, f.Y + y*f.Scale
+}
+
+// Bounds returns the pixels of the wide angle frame covered by a narrow angle frame.
+func (f Footprint) Bounds(narrow image.Rectangle) image.Rectangle {
+	x0, y0 := f.toWide(float64(narrow.Min.X), float64(narrow.Min.Y))
+	x1, y1 := f.toWide(float64(narrow.Max.X), float64(narrow.Max.Y))
+	return image.Rect(int(math.Floor(x0)), int(math.Floor(y0)), int(math.Ceil(x1)), int(math.Ceil(y1)))
+}
+
+// Split divides the files of a config between the cameras.
+// It returns a config with the wide angle files, a config with the narrow angle files
+// and any error encountered.
+func Split(config common.ConfigFile) (common.ConfigFile, common.ConfigFile, error) {
+	wide, narrow := config, config
+	wide.Files, narrow.Files = nil, nil
+	for _, file := range config.Files {
+		switch file.Camera {
+		case common.WIDE:
+			wide.Files = append(wide.Files, file)
+		case common.NARROW:
+			narrow.Files = append(narrow.Files, file)
+		default:
+			return wide, narrow, fmt.Errorf("%s has camera %q, expected %s or %s", file.Filename, file.Camera, common.NARROW, common.WIDE)
+		}
+	}
+	if len(wide.Files) == 0 || len(narrow.Files) == 0 {
+		return wide, narrow, fmt.Errorf("combining cameras needs files of both the %s and %s cameras", common.NARROW, common.WIDE)
+	}
+	return wide, narrow, nil
+}
+
+// DetailFilters picks the filters of the narrow angle frames used for the detail: the
+// clear filters, which have the most signal, when there are any and otherwise all of
+// them.
+// It returns the filters in sorted order.
+func DetailFilters(files []common.ImageConfig) []string {
+	seen := make(map[string]bool)
+	var clear, others []string
+	for _, file := range files {
+		if seen[file.Filter] {
+			continue
+		}
+		seen[file.Filter] = true
+		if file.Filter == common.CLEAR1 || file.Filter == common.CLEAR2 {
+			clear = append(clear, file.Filter)
+		} else {
+			others = append(others, file.Filter)
+		}
+	}
+	filters := others
+	if len(clear) > 0 {
+		filters = clear
+	}
+	sort.Strings(filters)
+	return filters
+}
+
+// Detail averages the narrow angle images of an image map into one image. The images
+// are taken moments apart so they are averaged where they are.
+// It returns the image.
+func Detail(imageMap common.ImageMap) *image.Gray {
+	var bounds image.Rectangle
+	first := true
+	for _, loaded := range imageMap {
+		if first {
+			bounds, first = loaded.Image.Bounds(), false
+		}
+		bounds = bounds.Intersect(loaded.Image.Bounds())
+	}
+
+	detail := common.NewPlane(bounds)
+	for _, loaded := range imageMap {
+		plane := common.PlaneFromGray(loaded.Image)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				detail.Set(x, y, detail.At(x, y)+plane.At(x, y)/float64(len(imageMap)))
+			}
+		}
+	}
+	return detail.Gray()
+}
+
+// coverage returns the length of the overlap of the ranges [a0, a1) and [b0, b1).
+func coverage(a0, a1, b0, b1 float64) float64 {
+	return math.Max(0, math.Min(a1, b1)-math.Max(a0, b0))
+}
+
+// span is the run of input pixels averaged into an output pixel and their weights.
+type span struct {
+	first   int
+	weights []float64
+}
+
+// shrinkAxis finds the spans that average a row of n pixels into size pixels, each
+// covering n / size input pixels.
+func shrinkAxis(n, size int) []span {
+	step := float64(n) / float64(size)
+	spans := make([]span, size)
+	for j := range spans {
+		start, end := float64(j)*step, float64(j+1)*step
+		spans[j].first = int(start)
+		for i := spans[j].first; i < n && float64(i) < end; i++ {
+			spans[j].weights = append(spans[j].weights, coverage(float64(i), float64(i+1), start, end)/step)
+		}
+	}
+	return spans
+}
+
+// shrink averages a plane down to width by height pixels at the origin.
+// It returns the shrunk plane.
+func shrink(plane *common.Plane, width, height int) *common.Plane {
+	bounds := plane.Rect
+	columns, rows := shrinkAxis(bounds.Dx(), width), shrinkAxis(bounds.Dy(), height)
+
+	// Shrink each row and then each column of the result.
+	narrowed := common.NewPlane(image.Rect(0, 0, width, bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x, column := range columns {
+			sum := 0.0
+			for i, w := range column.weights {
+				sum += w * plane.At(bounds.Min.X+column.first+i, bounds.Min.Y+y)
+			}
+			narrowed.Set(x, y, sum)
+		}
+	}
+	shrunk := common.NewPlane(image.Rect(0, 0, width, height))
+	for y, row := range rows {
+		for x := 0; x < width; x++ {
+			sum := 0.0
+			for i, w := range row.weights {
+				sum += w * narrowed.At(x, row.first+i)
+			}
+			shrunk.Set(x, y, sum)
+		}
+	}
+	return shrunk
+}
+
+// withinFrame wraps a metric so offsets where the shrunk narrow angle frame isn't
+// entirely within the wide angle frame get an infinite cost, rather than NaN which
+// searches take for an offset they haven't evaluated yet.
+func withinFrame(metric algv3aligning.Metric) algv3aligning.Metric {
+	cost := metric.Cost
+	metric.Cost = func(baseImage, layerImage common.LoadedConfig, mask *image.Alpha) float64 {
+		base := baseImage.Image.Bounds().Add(baseImage.Config.Offset())
+		if !layerImage.Image.Bounds().Add(layerImage.Config.Offset()).In(base) {
+			return math.Inf(1)
+		}
+		return cost(baseImage, layerImage, mask)
+	}
+	return metric
+}
+
+// match is where the narrow angle frame shrunk to a width best matches the wide angle
+// frame: the position of its top left corner and the cost of the match.
+type match struct {
+	x, y float64
+	cost float64
+}
+
+// locate matches a shrunk narrow angle frame within the base image, searching maxOffset
+// pixels around start.
+// It returns the match.
+func locate(base, layer common.LoadedConfig, start image.Point, maxOffset int, metric algv3aligning.Metric, search algv3aligning.Search) match {
+	layer.Config.OffsetX, layer.Config.OffsetY = start.X, start.Y
+	surface := algv3aligning.AlignPair(base, layer, maxOffset, 1, nil, metric, search)
+	_, cost := surface.Best()
+	x, y := surface.SubPixelBest()
+	return match{x, y, cost}
+}
+
+// Register finds the footprint of the narrow angle frame in the wide angle frame by
+// normalized cross correlation. The narrow angle frame is first shrunk to the widths
+// within the scale range and matched anywhere in frames downsampled to a few pixels per
+// width, then the width is refined one wide angle pixel at a time with the offset of
+// each width searched around the coarse match. The scale is finally refined between the
+// best width and its neighbours.
+// It returns the footprint and any error encountered.
+func Register(wide, narrow *image.Gray, config common.CamerasConfig) (Footprint, error) {
+	settings := camerasDefaults(config, wide.Bounds(), narrow.Bounds())
+	metric, err := algv3aligning.GetMetric("ncc")
+	if err != nil {
+		return Footprint{}, err
+	}
+	metric = withinFrame(metric)
+	exhaustive, err := algv3aligning.GetSearch(algv3aligning.EXHAUSTIVE)
+	if err != nil {
+		return Footprint{}, err
+	}
+	descent, err := algv3aligning.GetSearch(algv3aligning.DESCENT)
+	if err != nil {
+		return Footprint{}, err
+	}
+
+	// The wide angle frame is searched from the origin so positions are relative to it.
+	origin := wide.Bounds().Min
+	widePlane := common.PlaneFromGray(wide)
+	widePlane.Rect = widePlane.Rect.Sub(origin)
+	size := widePlane.Rect.Size()
+	narrowPlane := common.PlaneFromGray(narrow)
+	n, m := narrow.Bounds().Dx(), narrow.Bounds().Dy()
+	heightOf := func(width int) int {
+		return int(math.Round(float64(m) * float64(width) / float64(n)))
+	}
+
+	minWidth := int(math.Ceil(float64(n) * settings.Scale * (1 - settings.ScaleRange)))
+	maxWidth := int(math.Floor(float64(n) * settings.Scale * (1 + settings.ScaleRange)))
+	if minWidth < coarseSize {
+		return Footprint{}, fmt.Errorf("the narrow angle frame covers only %d wide angle pixels at scale %.3f", minWidth, settings.Scale)
+	}
+	if maxWidth > size.X || heightOf(maxWidth) > size.Y {
+		return Footprint{}, fmt.Errorf("the narrow angle frame is larger than the wide angle frame at scale %.3f", settings.Scale)
+	}
+
+	// Match the frames downsampled so the narrow angle frame is about coarseSize pixels
+	// across, trying every coarse width anywhere in the wide angle frame.
+	factor := minWidth / coarseSize
+	coarse := common.LoadedConfig{Image: shrink(widePlane, size.X/factor, size.Y/factor).Gray()}
+	scaleX := float64(size.X) / float64(coarse.Image.Rect.Dx())
+	scaleY := float64(size.Y) / float64(coarse.Image.Rect.Dy())
+	var centerX, centerY float64
+	best, bestCost := 0, math.Inf(1)
+	for width := int(float64(minWidth) / scaleX); float64(width) <= math.Ceil(float64(maxWidth)/scaleX); width++ {
+		layer := common.LoadedConfig{Image: shrink(narrowPlane, width, heightOf(width)).Gray()}
+		spare := coarse.Image.Rect.Size().Sub(layer.Image.Rect.Size())
+		if spare.X < 0 || spare.Y < 0 {
+			break
+		}
+		maxOffset := (int(math.Max(float64(spare.X), float64(spare.Y)))+1)/2 + 1
+		found := locate(coarse, layer, spare.Div(2), maxOffset, metric, exhaustive)
+		if found.cost < bestCost {
+			best, bestCost = width, found.cost
+			centerX = (found.x + float64(width)/2) * scaleX
+			centerY = (found.y + float64(layer.Image.Rect.Dy())/2) * scaleY
+		}
+	}
+	if best == 0 {
+		return Footprint{}, fmt.Errorf("the narrow angle frame couldn't be matched in the wide angle frame")
+	}
+
+	// Refine the width at full resolution, moving to a neighbouring width while it
+	// matches better.
+	base := common.LoadedConfig{Image: widePlane.Gray()}
+	matches := make(map[int]match)
+	measure := func(width int) (match, bool) {
+		if width < minWidth || width > maxWidth {
+			return match{}, false
+		}
+		if found, ok := matches[width]; ok {
+			return found, true
+		}
+		height := heightOf(width)
+		layer := common.LoadedConfig{Image: shrink(narrowPlane, width, height).Gray()}
+		start := image.Pt(
+			int(common.Clamp(math.Round(centerX-float64(width)/2), 0, float64(size.X-width))),
+			int(common.Clamp(math.Round(centerY-float64(height)/2), 0, float64(size.Y-height))))
+		matches[width] = locate(base, layer, start, factor+2, metric, descent)
+		return matches[width], true
+	}
+	width := int(common.Clamp(math.Round(float64(best)*scaleX), float64(minWidth), float64(maxWidth)))
+	current, _ := measure(width)
+	for {
+		next := width
+		for _, neighbour := range []int{width - 1, width + 1} {
+			if found, ok := measure(neighbour); ok && found.cost < matches[next].cost {
+				next = neighbour
+			}
+		}
+		if next == width {
+			break
+		}
+		width, current = next, matches[next]
+		centerX = current.x + float64(width)/2
+		centerY = current.y + float64(heightOf(width))/2
+	}
+
+	correlation := 1 - current.cost
+	if math.IsNaN(current.cost) || math.IsInf(current.cost, 1) || correlation < settings.MinCorrelation {
+		return Footprint{}, fmt.Errorf("the narrow angle frame matched the wide angle frame with a correlation of only %.3f", correlation)
+	}
+
+	// Fit a parabola through the costs of the neighbouring widths to refine the scale,
+	// keeping the center of the footprint where the best width put it.
+	scale := float64(width) / float64(n)
+	centerX = current.x + float64(n)*scale/2
+	centerY = current.y + float64(m)*scale/2
+	refined := float64(width)
+	before, okBefore := matches[width-1]
+	after, okAfter := matches[width+1]
+	if curvature := before.cost - 2*current.cost + after.cost; okBefore && okAfter && curvature > 0 && !math.IsInf(curvature, 1) {
+		refined += common.Clamp((before.cost-after.cost)/(2*curvature), -0.5, 0.5)
+	}
+	scale = refined / float64(n)
+
+	return Footprint{
+		Scale:       scale,
+		X:           float64(origin.X) + centerX - float64(n)*scale/2 - float64(narrow.Bounds().Min.X)*scale,
+		Y:           float64(origin.Y) + centerY - float64(m)*scale/2 - float64(narrow.Bounds().Min.Y)*scale,
+		Correlation: correlation,
+	}, nil
+}
+
+// bilinear interpolates a plane at a point given in pixel coordinates, where the
+// center of pixel (x, y) is at (x + 0.5, y + 0.5).
+func bilinear(plane *common.Plane, x, y float64) float64 {
+	x, y = x-0.5, y-0.5
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	ix, iy := int(x0), int(y0)
+	top := plane.ClampedAt(ix, iy)*(1-fx) + plane.ClampedAt(ix+1, iy)*fx
+	bottom := plane.ClampedAt(ix, iy+1)*(1-fx) + plane.ClampedAt(ix+1, iy+1)*fx
+	return top*(1-fy) + bottom*fy
+}
+
+// Combine colors the narrow angle detail with the wide angle color image, resampling the
+// color onto the narrow angle frame at its footprint and replacing its lightness with
+// that of the detail in the Lab or HSL color space, see lrgb.Combine.
+// It returns the combined image, cropped to the part of the narrow angle frame within the
+// wide angle frame, and any error encountered.
+func Combine(wide *image.RGBA, detail *image.Gray, footprint Footprint, space string) (*image.RGBA, error) {
+	wideBounds := wide.Bounds()
+	bounds := detail.Bounds()
+	// Keep the narrow angle pixels whose centers fall within the wide angle frame.
+	inside := func(min, max int, start float64) (int, int) {
+		first := int(math.Ceil((float64(min)-start)/footprint.Scale - 0.5))
+		last := int(math.Floor((float64(max)-start)/footprint.Scale - 0.5))
+		return first, last + 1
+	}
+	x0, x1 := inside(wideBounds.Min.X, wideBounds.Max.X, footprint.X)
+	y0, y1 := inside(wideBounds.Min.Y, wideBounds.Max.Y, footprint.Y)
+	overlap := bounds.Intersect(image.Rect(x0, y0, x1, y1))
+	if overlap.Empty() {
+		return nil, fmt.Errorf("the narrow angle frame falls outside the wide angle frame")
+	}
+
+	widePlanes := common.PlanesFromRGBA(wide)
+	planes := [3]*common.Plane{common.NewPlane(overlap), common.NewPlane(overlap), common.NewPlane(overlap)}
+	common.ParallelRows(overlap, func(_ int, rows image.Rectangle) {
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := rows.Min.X; x < rows.Max.X; x++ {
+				wx, wy := footprint.toWide(float64(x)+0.5, float64(y)+0.5)
+				for i, plane := range widePlanes {
+					planes[i].Set(x, y, bilinear(plane, wx, wy))
+				}
+			}
+		}
+	})
+
+	combined, _, _, err := lrgb.Combine(common.RGBAFromPlanes(planes), common.LoadedConfig{Image: detail}, overlap, space)
+	return combined, err
+}
+
+// Context outlines the footprint of the narrow angle frame on a copy of the wide angle
+// color image.
+// It returns the outlined image.
+func Context(wide *image.RGBA, detail image.Rectangle, footprint Footprint) *image.RGBA {
+	context := image.NewRGBA(wide.Bounds())
+	copy(context.Pix, wide.Pix)
+	outline := footprint.Bounds(detail)
+	for x := outline.Min.X; x < outline.Max.X; x++ {
+		context.SetRGBA(x, outline.Min.Y, outlineColor)
+		context.SetRGBA(x, outline.Max.Y-1, outlineColor)
+	}
+	for y := outline.Min.Y; y < outline.Max.Y; y++ {
+		context.SetRGBA(outline.Min.X, y, outlineColor)
+		context.SetRGBA(outline.Max.X-1, y, outlineColor)
+	}
+	return context
+}
+
+// CombineImages blends the wide angle RGB images at their offsets into a color image,
+// registers the detail of the narrow angle images to it and colors the detail with it,
+// writing the post-processed result to <name>.jpg and the wide angle image with the
+// footprint of the narrow angle frame outlined to <name>_context.jpg.
+// It returns the result, its metadata and any error encountered.
+func CombineImages(config common.ConfigFile, wide, narrow common.ImageMap, root, name string) (image.Image, *common.Metadata, error) {
+	settings := common.CamerasConfig{}
+	if config.Cameras != nil {
+		settings = *config.Cameras
+	}
+
+	composite, err := algv3aligning.CombineImages(wide, common.BLUE, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	wideColor := composite.(*image.RGBA)
+	detail := Detail(narrow)
+
+	// The wide angle frame is matched in gray as the detail averages its filters.
+	widePlanes := common.PlanesFromRGBA(wideColor)
+	wideGray := common.NewPlane(wideColor.Bounds())
+	for i := range wideGray.Pix {
+		wideGray.Pix[i] = (widePlanes[0].Pix[i] + widePlanes[1].Pix[i] + widePlanes[2].Pix[i]) / 3
+	}
+	footprint, err := Register(wideGray.Gray(), detail, settings)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", root, err)
+	}
+	fmt.Printf("Narrow angle frame at (%.1f, %.1f) in the wide angle frame, scale %.4f, correlation %.3f\n",
+		footprint.X, footprint.Y, footprint.Scale, footprint.Correlation)
+
+	settings = camerasDefaults(settings, wideColor.Bounds(), detail.Bounds())
+	combined, err := Combine(wideColor, detail, footprint, settings.Space)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", root, err)
+	}
+
+	var filters []string
+	for filter := range narrow {
+		filters = append(filters, filter)
+	}
+	sort.Strings(filters)
+	meta := common.NewMetadata("cameras", config, wide)
+	meta.Sources = config.Files
+	meta.SetParameter("detail", strings.Join(filters, ","))
+	meta.SetParameter("scale", footprint.Scale)
+	meta.SetParameter("footprint", fmt.Sprintf("%.1f,%.1f", footprint.X, footprint.Y))
+	meta.SetParameter("correlation", footprint.Correlation)
+	meta.SetParameter("space", settings.Space)
+
+	if err := common.WriteImage(path.Join(root, name+"_context.jpg"), Context(wideColor, detail.Bounds(), footprint), meta); err != nil {
+		return nil, nil, err
+	}
+	output, err := postprocess.Apply(config, combined, meta, root)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := common.WriteImage(path.Join(root, name+".jpg"), output, meta); err != nil {
+		return nil, nil, err
+	}
+	return output, meta, nil
+}
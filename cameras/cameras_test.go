@@ -0,0 +1,167 @@
+package cameras
+
+import (
+	"github.com/lewchuk/gostitcher/algv3aligning"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// craters are the centres of the features of the scene, scattered so no two parts of it
+// look alike.
+var craters = func() []image.Point {
+	random := rand.New(rand.NewSource(1))
+	points := make([]image.Point, 120)
+	for i := range points {
+		points[i] = image.Pt(random.Intn(160), random.Intn(160))
+	}
+	return points
+}()
+
+// scene is the brightness of a field of soft craters both cameras image, in wide angle
+// pixels.
+func scene(x, y float64) float64 {
+	v := 40.0
+	for _, c := range craters {
+		dx, dy := x-float64(c.X), y-float64(c.Y)
+		v += 120 * math.Exp(-(dx*dx+dy*dy)/(2*3*3))
+	}
+	return v
+}
+
+// render samples the scene at the centre of every pixel of an image, each pixel covering
+// scale wide angle pixels from (x0, y0).
+func render(width, height int, x0, y0, scale float64) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := scene(x0+(float64(x)+0.5)*scale, y0+(float64(y)+0.5)*scale)
+			img.SetGray(x, y, color.Gray{uint8(common.Clamp(math.Round(v), 0, 255))})
+		}
+	}
+	return img
+}
+
+func TestRegister(t *testing.T) {
+	wide := render(160, 160, 0, 0, 1)
+
+	tests := []struct {
+		name    string
+		narrow  *image.Gray
+		config  common.CamerasConfig
+		want    Footprint
+		wantErr bool
+	}{
+		{
+			name:   "footprint inside the frame",
+			narrow: render(120, 120, 50.3, 70.6, 0.3),
+			config: common.CamerasConfig{Scale: 0.3},
+			want:   Footprint{Scale: 0.3, X: 50.3, Y: 70.6},
+		},
+		{
+			name:   "scale off by a few percent",
+			narrow: render(120, 90, 20, 35, 0.31),
+			config: common.CamerasConfig{Scale: 0.3},
+			want:   Footprint{Scale: 0.31, X: 20, Y: 35},
+		},
+		{
+			name:    "footprint too small to match",
+			narrow:  render(120, 120, 50, 70, 0.1),
+			config:  common.CamerasConfig{Scale: 0.1},
+			wantErr: true,
+		},
+		{
+			name:    "footprint larger than the frame",
+			narrow:  render(120, 120, 0, 0, 1.5),
+			config:  common.CamerasConfig{Scale: 1.5},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			footprint, err := Register(wide, test.narrow, test.config)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Register() error = %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if math.Abs(footprint.Scale-test.want.Scale) > 0.01 ||
+				math.Abs(footprint.X-test.want.X) > 1 || math.Abs(footprint.Y-test.want.Y) > 1 {
+				t.Errorf("Register() = %+v, want %+v", footprint, test.want)
+			}
+			if footprint.Correlation < 0.9 {
+				t.Errorf("correlation = %g, want above 0.9", footprint.Correlation)
+			}
+		})
+	}
+}
+
+func TestWithinFrame(t *testing.T) {
+	metric, err := algv3aligning.GetMetric("ncc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric = withinFrame(metric)
+	base := common.LoadedConfig{Image: render(32, 32, 0, 0, 1)}
+	layer := common.LoadedConfig{Image: render(8, 8, 10, 12, 1)}
+
+	tests := []struct {
+		name     string
+		offset   image.Point
+		rejected bool
+	}{
+		{name: "inside", offset: image.Pt(10, 12)},
+		{name: "touching the corner", offset: image.Pt(24, 24)},
+		{name: "past the right edge", offset: image.Pt(25, 12), rejected: true},
+		{name: "above the top", offset: image.Pt(10, -1), rejected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layer.Config.OffsetX, layer.Config.OffsetY = test.offset.X, test.offset.Y
+			cost := metric.Cost(base, layer, nil)
+			if math.IsNaN(cost) {
+				t.Fatalf("cost = NaN, which searches take for an offset they haven't evaluated")
+			}
+			if math.IsInf(cost, 1) != test.rejected {
+				t.Errorf("cost = %g, want rejected %v", cost, test.rejected)
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name       string
+		cameras    []string
+		wantWide   int
+		wantNarrow int
+		wantErr    bool
+	}{
+		{name: "both cameras", cameras: []string{common.WIDE, common.NARROW, common.WIDE}, wantWide: 2, wantNarrow: 1},
+		{name: "only narrow", cameras: []string{common.NARROW, common.NARROW}, wantErr: true},
+		{name: "unknown camera", cameras: []string{common.WIDE, common.NARROW, ""}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var config common.ConfigFile
+			for _, camera := range test.cameras {
+				config.Files = append(config.Files, common.ImageConfig{Filename: camera + ".jpg", Camera: camera})
+			}
+			wide, narrow, err := Split(config)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Split() error = %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && (len(wide.Files) != test.wantWide || len(narrow.Files) != test.wantNarrow) {
+				t.Errorf("Split() = %d wide and %d narrow files, want %d and %d",
+					len(wide.Files), len(narrow.Files), test.wantWide, test.wantNarrow)
+			}
+		})
+	}
+}
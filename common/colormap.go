@@ -0,0 +1,73 @@
+package common
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Colormap maps values between 0 and 1 to colors by interpolating between evenly
+// spaced stops.
+type Colormap []color.RGBA
+
+// Colormaps are the named colormaps, approximating the matplotlib colormaps of the
+// same names.
+var Colormaps = map[string]Colormap{
+	"gray": {
+		{0, 0, 0, 255}, {255, 255, 255, 255},
+	},
+	"viridis": {
+		{68, 1, 84, 255}, {72, 40, 120, 255}, {62, 74, 137, 255}, {49, 104, 142, 255},
+		{38, 130, 142, 255}, {31, 158, 137, 255}, {53, 183, 121, 255}, {109, 205, 89, 255},
+		{180, 222, 44, 255}, {253, 231, 37, 255},
+	},
+	"inferno": {
+		{0, 0, 4, 255}, {27, 12, 65, 255}, {74, 12, 107, 255}, {120, 28, 109, 255},
+		{165, 44, 96, 255}, {207, 68, 70, 255}, {237, 105, 37, 255}, {251, 155, 6, 255},
+		{247, 209, 61, 255}, {252, 255, 164, 255},
+	},
+	"magma": {
+		{0, 0, 4, 255}, {24, 15, 61, 255}, {68, 15, 118, 255}, {114, 31, 129, 255},
+		{158, 47, 127, 255}, {205, 64, 113, 255}, {241, 96, 93, 255}, {253, 149, 103, 255},
+		{254, 201, 141, 255}, {252, 253, 191, 255},
+	},
+	"jet": {
+		{0, 0, 128, 255}, {0, 0, 255, 255}, {0, 128, 255, 255}, {0, 255, 255, 255},
+		{128, 255, 128, 255}, {255, 255, 0, 255}, {255, 128, 0, 255}, {255, 0, 0, 255},
+		{128, 0, 0, 255},
+	},
+}
+
+// GetColormap looks up a colormap by name.
+// It returns the colormap and any error encountered.
+func GetColormap(name string) (Colormap, error) {
+	colormap, ok := Colormaps[name]
+	if !ok {
+		var names []string
+		for name := range Colormaps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown colormap %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return colormap, nil
+}
+
+// At returns the color for a value, clamping it to [0, 1].
+func (c Colormap) At(v float64) color.RGBA {
+	if math.IsNaN(v) {
+		v = 0
+	}
+	position := Clamp(v, 0, 1) * float64(len(c)-1)
+	i := int(position)
+	if i >= len(c)-1 {
+		return c[len(c)-1]
+	}
+	t := position - float64(i)
+	lerp := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a) + t*(float64(b)-float64(a))))
+	}
+	return color.RGBA{lerp(c[i].R, c[i+1].R), lerp(c[i].G, c[i+1].G), lerp(c[i].B, c[i+1].B), 255}
+}
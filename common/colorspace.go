@@ -0,0 +1,134 @@
+package common
+
+import (
+	"math"
+)
+
+// The D65 white point of sRGB in XYZ.
+const (
+	whiteX = 0.95047
+	whiteY = 1.0
+	whiteZ = 1.08883
+)
+
+// srgbToLinear removes the sRGB transfer curve from a value between 0 and 1.
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB applies the sRGB transfer curve to a linear value between 0 and 1.
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// labF is the cube root used by CIELAB, replaced by a line close to black.
+func labF(t float64) float64 {
+	const delta = 6.0 / 29
+	if t > delta*delta*delta {
+		return math.Cbrt(t)
+	}
+	return t/(3*delta*delta) + 4.0/29
+}
+
+// labFInverse inverts labF.
+func labFInverse(t float64) float64 {
+	const delta = 6.0 / 29
+	if t > delta {
+		return t * t * t
+	}
+	return 3 * delta * delta * (t - 4.0/29)
+}
+
+// RGBToLab converts an sRGB color with channels between 0 and 1 to CIELAB.
+// It returns the lightness (0-100) and the a and b color opponents.
+func RGBToLab(r, g, b float64) (float64, float64, float64) {
+	r, g, b = srgbToLinear(r), srgbToLinear(g), srgbToLinear(b)
+	x := (0.4124*r + 0.3576*g + 0.1805*b) / whiteX
+	y := (0.2126*r + 0.7152*g + 0.0722*b) / whiteY
+	z := (0.0193*r + 0.1192*g + 0.9505*b) / whiteZ
+	fx, fy, fz := labF(x), labF(y), labF(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+// LabToRGB converts a CIELAB color to sRGB, clamping colors outside the sRGB gamut.
+// It returns the red, green and blue channels between 0 and 1.
+func LabToRGB(l, a, b float64) (float64, float64, float64) {
+	fy := (l + 16) / 116
+	x := labFInverse(fy+a/500) * whiteX
+	y := labFInverse(fy) * whiteY
+	z := labFInverse(fy-b/200) * whiteZ
+	red := 3.2406*x - 1.5372*y - 0.4986*z
+	green := -0.9689*x + 1.8758*y + 0.0415*z
+	blue := 0.0557*x - 0.2040*y + 1.0570*z
+	return linearToSRGB(Clamp(red, 0, 1)), linearToSRGB(Clamp(green, 0, 1)), linearToSRGB(Clamp(blue, 0, 1))
+}
+
+// RGBToHSL converts a color with channels between 0 and 1 to hue, saturation and
+// lightness.
+// It returns the hue in degrees (0-360), the saturation and the lightness (0-1).
+func RGBToHSL(r, g, b float64) (float64, float64, float64) {
+	max, min := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+	l := (max + min) / 2
+	if max == min {
+		return 0, 0, l
+	}
+
+	chroma := max - min
+	s := chroma / (1 - math.Abs(2*l-1))
+	var h float64
+	switch max {
+	case r:
+		h = math.Mod((g-b)/chroma, 6)
+	case g:
+		h = (b-r)/chroma + 2
+	default:
+		h = (r-g)/chroma + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return h, s, l
+}
+
+// HSLToRGB converts hue in degrees, saturation and lightness to a color.
+// It returns the red, green and blue channels between 0 and 1.
+func HSLToRGB(h, s, l float64) (float64, float64, float64) {
+	chroma := (1 - math.Abs(2*l-1)) * s
+	sector := h / 60
+	x := chroma * (1 - math.Abs(math.Mod(sector, 2)-1))
+	var r, g, b float64
+	switch {
+	case sector < 1:
+		r, g, b = chroma, x, 0
+	case sector < 2:
+		r, g, b = x, chroma, 0
+	case sector < 3:
+		r, g, b = 0, chroma, x
+	case sector < 4:
+		r, g, b = 0, x, chroma
+	case sector < 5:
+		r, g, b = x, 0, chroma
+	default:
+		r, g, b = chroma, 0, x
+	}
+	m := l - chroma/2
+	return Clamp(r+m, 0, 1), Clamp(g+m, 0, 1), Clamp(b+m, 0, 1)
+}
+
+// HSVToRGB converts hue in degrees, saturation and value to a color.
+// It returns the red, green and blue channels between 0 and 1.
+func HSVToRGB(h, s, v float64) (float64, float64, float64) {
+	// HSV and HSL share their hues, only the lightness of the chroma differs.
+	l := v * (1 - s/2)
+	if l == 0 || l == 1 {
+		return l, l, l
+	}
+	return HSLToRGB(h, (v-l)/math.Min(l, 1-l), l)
+}
@@ -0,0 +1,50 @@
+package common
+
+import (
+	"math"
+	"testing"
+)
+
+func TestColorSpaceRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		r, g, b float64
+		// Colors with known values also check the Lab lightness and the HSL components.
+		wantL         float64
+		wantH, wantS  float64
+		wantLightness float64
+		known         bool
+	}{
+		{name: "black", wantL: 0, known: true},
+		{name: "white", r: 1, g: 1, b: 1, wantL: 100, wantLightness: 1, known: true},
+		{name: "mid gray", r: 0.5, g: 0.5, b: 0.5, wantL: 53.39, wantLightness: 0.5, known: true},
+		{name: "red", r: 1, wantL: 53.24, wantH: 0, wantS: 1, wantLightness: 0.5, known: true},
+		{name: "green", g: 1, wantL: 87.73, wantH: 120, wantS: 1, wantLightness: 0.5, known: true},
+		{name: "blue", b: 1, wantL: 32.30, wantH: 240, wantS: 1, wantLightness: 0.5, known: true},
+		{name: "dark orange", r: 0.6, g: 0.3, b: 0.05},
+		{name: "pale teal", r: 0.55, g: 0.8, b: 0.75},
+		{name: "near black violet", r: 0.02, g: 0.01, b: 0.03},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, a, b := RGBToLab(test.r, test.g, test.b)
+			if test.known && math.Abs(l-test.wantL) > 0.05 {
+				t.Errorf("Lab lightness = %g, want %g", l, test.wantL)
+			}
+			r, g, bl := LabToRGB(l, a, b)
+			if math.Abs(r-test.r) > 1e-3 || math.Abs(g-test.g) > 1e-3 || math.Abs(bl-test.b) > 1e-3 {
+				t.Errorf("LabToRGB(RGBToLab()) = (%g, %g, %g), want (%g, %g, %g)", r, g, bl, test.r, test.g, test.b)
+			}
+
+			h, s, lightness := RGBToHSL(test.r, test.g, test.b)
+			if test.known && (math.Abs(h-test.wantH) > 1e-9 || math.Abs(s-test.wantS) > 1e-9 || math.Abs(lightness-test.wantLightness) > 1e-9) {
+				t.Errorf("RGBToHSL() = (%g, %g, %g), want (%g, %g, %g)", h, s, lightness, test.wantH, test.wantS, test.wantLightness)
+			}
+			r, g, bl = HSLToRGB(h, s, lightness)
+			if math.Abs(r-test.r) > 1e-9 || math.Abs(g-test.g) > 1e-9 || math.Abs(bl-test.b) > 1e-9 {
+				t.Errorf("HSLToRGB(RGBToHSL()) = (%g, %g, %g), want (%g, %g, %g)", r, g, bl, test.r, test.g, test.b)
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package common
+
+import (
+	"encoding/json"
+	"image"
+	"reflect"
+	"strings"
+)
+
+// ProcessingConfig holds the optional processing stages applied to a set of images.
+// It is embedded in ConfigFile so the settings can be saved in config.json and can
+// also be provided on the command line for a single run.
+type ProcessingConfig struct {
+	Stack        *StackConfig        `json:"stack,omitempty"`
+	HDR          *HDRConfig          `json:"hdr,omitempty"`
+	Drizzle      *DrizzleConfig      `json:"drizzle,omitempty"`
+	Cosmic       *CosmicConfig       `json:"cosmic,omitempty"`
+	Background   *BackgroundConfig   `json:"background,omitempty"`
+	Denoise      *DenoiseConfig      `json:"denoise,omitempty"`
+	LRGB         *LRGBConfig         `json:"lrgb,omitempty"`
+	Edges        *EdgesConfig        `json:"edges,omitempty"`
+	Sharpen      *SharpenConfig      `json:"sharpen,omitempty"`
+	Stretch      *StretchConfig      `json:"stretch,omitempty"`
+	WhiteBalance *WhiteBalanceConfig `json:"whiteBalance,omitempty"`
+}
+
+// Merge overrides any stages configured in other.
+func (c *ProcessingConfig) Merge(other ProcessingConfig) {
+	if other.Stack != nil {
+		c.Stack = other.Stack
+	}
+	if other.HDR != nil {
+		c.HDR = other.HDR
+	}
+	if other.Drizzle != nil {
+		c.Drizzle = other.Drizzle
+	}
+	if other.Cosmic != nil {
+		c.Cosmic = other.Cosmic
+	}
+	if other.Background != nil {
+		c.Background = other.Background
+	}
+	if other.Denoise != nil {
+		c.Denoise = other.Denoise
+	}
+	if other.LRGB != nil {
+		c.LRGB = other.LRGB
+	}
+	if other.Edges != nil {
+		c.Edges = other.Edges
+	}
+	if other.Sharpen != nil {
+		c.Sharpen = other.Sharpen
+	}
+	if other.Stretch != nil {
+		c.Stretch = other.Stretch
+	}
+	if other.WhiteBalance != nil {
+		c.WhiteBalance = other.WhiteBalance
+	}
+}
+
+// Parameters returns the settings of each enabled stage as JSON keyed by the name of
+// the stage, suitable for recording in image metadata.
+func (c ProcessingConfig) Parameters() map[string]string {
+	parameters := make(map[string]string)
+	value := reflect.ValueOf(c)
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if field.Kind() != reflect.Ptr || field.IsNil() {
+			continue
+		}
+		name := strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		settings, err := json.Marshal(field.Interface())
+		if err != nil {
+			continue
+		}
+		parameters[name] = string(settings)
+	}
+	return parameters
+}
+
+// Rect is a rectangle in image coordinates as stored in config.json.
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Rectangle converts the rect to an image.Rectangle.
+func (r Rect) Rectangle() image.Rectangle {
+	return image.Rect(r.X, r.Y, r.X+r.Width, r.Y+r.Height)
+}
+
+// ROIConfig restricts the pixels of the reference image that count towards the
+// alignment cost.
+type ROIConfig struct {
+	// Mode is one of rect, polygon or auto for the brightest object.
+	Mode string `json:"mode"`
+	// Rect is the region for the rect mode.
+	Rect *Rect `json:"rect,omitempty"`
+	// Polygon is the list of x, y vertices for the polygon mode.
+	Polygon [][2]int `json:"polygon,omitempty"`
+	// Margin grows the region by this many pixels, e.g. to keep the limb of an auto
+	// detected object.
+	Margin int `json:"margin,omitempty"`
+}
+
+// MosaicConfig configures stitching frames of overlapping pointings into a mosaic.
+type MosaicConfig struct {
+	// Filter is the filter frames are registered with, green by default.
+	Filter string `json:"filter,omitempty"`
+	// MinOverlap is the smallest fraction of a frame two frames must share for their
+	// offset to be measured, 0.1 by default.
+	MinOverlap float64 `json:"minOverlap,omitempty"`
+	// MinCorrelation is the lowest normalized cross correlation of a measured offset
+	// used in the registration, 0.5 by default.
+	MinCorrelation float64 `json:"minCorrelation,omitempty"`
+	// Feather is the width in pixels over which frames are blended into each other at
+	// their edges, 0 blends across the whole frame.
+	Feather int `json:"feather,omitempty"`
+}
+
+// FalseColorConfig configures a false color image made from bands, each either the image
+// of a filter such as MT3 or the ratio of the images of two filters such as MT3/CB3.
+type FalseColorConfig struct {
+	// Name names the output image, output_false_<name>.jpg.
+	Name string `json:"name"`
+	// Red, Green and Blue are the bands mapped to the channels of the image.
+	Red   string `json:"red,omitempty"`
+	Green string `json:"green,omitempty"`
+	Blue  string `json:"blue,omitempty"`
+	// Band is a single band mapped through the colormap instead of to channels.
+	Band string `json:"band,omitempty"`
+	// Colormap is the name of the colormap used for Band, viridis by default.
+	Colormap string `json:"colormap,omitempty"`
+	// LUT is a custom colormap of evenly spaced red, green and blue stops used for Band
+	// instead of a named colormap.
+	LUT [][3]uint8 `json:"lut,omitempty"`
+	// Low and High are the percentiles (0-100) of each band mapped to black and white.
+	Low  float64 `json:"low,omitempty"`
+	High float64 `json:"high,omitempty"`
+}
+
+// PolarizationConfig configures combining images taken through polarizers into maps of
+// the total intensity, degree of linear polarization and angle of polarization.
+type PolarizationConfig struct {
+	// Filters are the polarizers combined, P0, P60 and P120 when config.json has all of
+	// them and IRP0 and IRP90 otherwise.
+	Filters []string `json:"filters,omitempty"`
+	// MaxDegree is the degree of polarization (0-1) shown fully saturated, the 99th
+	// percentile of the degree by default.
+	MaxDegree float64 `json:"maxDegree,omitempty"`
+}
+
+// CamerasConfig configures combining the frames of the narrow and wide angle cameras of
+// an observation, the wide angle frames giving the color of the detail of the narrow
+// angle frames.
+type CamerasConfig struct {
+	// Scale is the size of a narrow angle pixel in wide angle pixels, by default
+	// NarrowScale adjusted for the sizes of the frames.
+	Scale float64 `json:"scale,omitempty"`
+	// ScaleRange is the fraction of Scale searched either side of it, 0.1 by default.
+	ScaleRange float64 `json:"scaleRange,omitempty"`
+	// MinCorrelation is the lowest normalized cross correlation the narrow angle frame
+	// may match the wide angle frame with, 0.8 by default.
+	MinCorrelation float64 `json:"minCorrelation,omitempty"`
+	// Space is the color space the lightness of the wide angle color is replaced in,
+	// lab or hsl, lab by default.
+	Space string `json:"space,omitempty"`
+}
+
+// TilesConfig writes large outputs one tile at a time instead of as a single image.
+type TilesConfig struct {
+	// Size is the width and height of the tiles, a multiple of 16 for TIFF output.
+	Size int `json:"size,omitempty"`
+	// Output is a .tif path for a tiled TIFF or any other path for a directory of tiles.
+	Output string `json:"output,omitempty"`
+}
+
+// SharpenConfig configures the sharpening applied to each channel of composite images.
+type SharpenConfig struct {
+	// Method is either richardson-lucy deconvolution or unsharp masking.
+	Method string `json:"method"`
+	// Sigma is the standard deviation in pixels of the gaussian PSF deconvolved, or of
+	// the blur subtracted by unsharp masking.
+	Sigma float64 `json:"sigma,omitempty"`
+	// PSF maps filters to images of their PSF, relative to the folder of config.json,
+	// which are deconvolved instead of the gaussian.
+	PSF map[string]string `json:"psf,omitempty"`
+	// Iterations is the number of Richardson-Lucy iterations.
+	Iterations int `json:"iterations,omitempty"`
+	// Amount scales the detail added back by unsharp masking.
+	Amount float64 `json:"amount,omitempty"`
+}
+
+// StretchConfig configures the contrast stretch applied to composite images.
+type StretchConfig struct {
+	// Method is one of linear, gamma, asinh or clahe.
+	Method string `json:"method"`
+	// Low and High are the percentiles (0-100) mapped to black and white.
+	Low  float64 `json:"low,omitempty"`
+	High float64 `json:"high,omitempty"`
+	// Gamma is the display gamma used by the gamma method.
+	Gamma float64 `json:"gamma,omitempty"`
+	// Softening controls how strongly the asinh method brightens faint values.
+	Softening float64 `json:"softening,omitempty"`
+	// ClipLimit and Tiles control the contrast limit and the tiles per side for clahe.
+	ClipLimit float64 `json:"clipLimit,omitempty"`
+	Tiles     int     `json:"tiles,omitempty"`
+	// PerChannel stretches each channel independently instead of linking the
+	// channels to preserve color ratios.
+	PerChannel bool `json:"perChannel,omitempty"`
+}
+
+// WhiteBalanceConfig configures the white balance applied to composite images.
+type WhiteBalanceConfig struct {
+	// Mode is one of gray-world, region or filter.
+	Mode string `json:"mode"`
+	// Region is the part of the image that should be neutral for the region mode.
+	Region *Rect `json:"region,omitempty"`
+	// Gains overrides the per filter gains used by the filter mode.
+	Gains map[string]float64 `json:"gains,omitempty"`
+	// Curves lists a file of the transmission curve of each filter for the filter mode,
+	// relative to the folder, with a wavelength and a transmission on each line.
+	Curves map[string]string `json:"curves,omitempty"`
+	// Spectrum is a file of the spectrum of the light, such as the solar spectrum, the
+	// curves are weighted by in the same format, a flat spectrum if not given.
+	Spectrum string `json:"spectrum,omitempty"`
+}
+
+// StackConfig configures registering and stacking all the frames of each filter into a
+// single image with less noise.
+type StackConfig struct {
+	// Method is mean, median or sigma for a mean of the values within Sigma standard
+	// deviations.
+	Method string `json:"method"`
+	// Sigma is the clipping threshold in standard deviations for the sigma method.
+	Sigma float64 `json:"sigma,omitempty"`
+	// MaxOffset is how far frames are searched around the first frame of their filter.
+	MaxOffset int `json:"maxOffset,omitempty"`
+}
+
+// HDRConfig configures merging frames of each filter taken with different exposures into
+// a high dynamic range image, which is tone mapped back to 8 bits for blending.
+type HDRConfig struct {
+	// ToneMap is reinhard, log or linear.
+	ToneMap string `json:"toneMap,omitempty"`
+	// Key is the brightness (0-1) the average of the scene is mapped to by reinhard.
+	Key float64 `json:"key,omitempty"`
+	// Saturation is the value (0-1) above which pixels are treated as saturated.
+	Saturation float64 `json:"saturation,omitempty"`
+	// MaxOffset is how far frames are searched around the first frame of their filter.
+	MaxOffset int `json:"maxOffset,omitempty"`
+}
+
+// DrizzleConfig configures combining the frames of each filter onto a finer grid than
+// the frames themselves, recovering resolution from the pointing jitter between frames.
+type DrizzleConfig struct {
+	// Scale is how many output pixels span one input pixel.
+	Scale float64 `json:"scale,omitempty"`
+	// PixFrac is the width of the drop each input pixel is shrunk to, as a fraction of
+	// the input pixel.
+	PixFrac float64 `json:"pixfrac,omitempty"`
+	// MaxOffset is how far frames are searched around the first frame of their filter.
+	MaxOffset int `json:"maxOffset,omitempty"`
+}
+
+// CosmicConfig configures the removal of cosmic ray hits and hot pixels from each
+// filter image.
+type CosmicConfig struct {
+	// Method is either median, comparing each pixel to the median of its neighbours,
+	// or laplacian, looking for the sharp edges of cosmic ray hits.
+	Method string `json:"method"`
+	// Sigma is the detection threshold in standard deviations of the noise.
+	Sigma float64 `json:"sigma,omitempty"`
+	// Mask writes an image of the replaced pixels of each filter.
+	Mask bool `json:"mask,omitempty"`
+}
+
+// BackgroundConfig configures the background estimation subtracted from each filter
+// image before alignment and blending.
+type BackgroundConfig struct {
+	// Mode is either sky, a single sigma clipped sky level, or polynomial, a low order
+	// 2-D polynomial fitted to the sky to remove gradients.
+	Mode string `json:"mode"`
+	// Order is the order of the polynomial.
+	Order int `json:"order,omitempty"`
+	// Sigma is the clipping threshold in standard deviations.
+	Sigma float64 `json:"sigma,omitempty"`
+	// Output writes the background model of each filter for inspection.
+	Output bool `json:"output,omitempty"`
+}
+
+// DenoiseConfig configures the noise reduction applied to each filter image before
+// alignment and blending.
+type DenoiseConfig struct {
+	// Method is bilateral, nlm for non-local means or wavelet for thresholding the
+	// detail of an a trous wavelet transform.
+	Method string `json:"method"`
+	// Strength scales how aggressively noise is removed relative to the noise level
+	// estimated from the image, 1 by default.
+	Strength float64 `json:"strength,omitempty"`
+	// Radius is the neighbourhood averaged by bilateral and searched by nlm.
+	Radius int `json:"radius,omitempty"`
+	// Levels is the number of wavelet scales thresholded.
+	Levels int `json:"levels,omitempty"`
+}
+
+// LRGBConfig configures combining a clear filter image, used as the luminance, with the
+// color of the RGB images.
+type LRGBConfig struct {
+	// Space is the color space the luminance is replaced in, lab or hsl.
+	Space string `json:"space,omitempty"`
+	// Luminance is the clear filter used as the luminance, the first of CL1 and CL2
+	// present by default.
+	Luminance string `json:"luminance,omitempty"`
+	// MaxOffset is how far the RGB images are searched around the luminance image.
+	MaxOffset int `json:"maxOffset,omitempty"`
+}
+
+// EdgesConfig configures how composites of aligned images treat the edges where the
+// shifted images no longer overlap.
+type EdgesConfig struct {
+	// Mode is either crop, to crop to the overlap of all images, or pad, to keep the
+	// bounds of the reference image and fill pixels missing from any image.
+	Mode string `json:"mode"`
+	// Fill is the red, green and blue color of padded pixels, each from 0 to 255.
+	Fill []int `json:"fill,omitempty"`
+}
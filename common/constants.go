@@ -12,22 +12,131 @@ const (
 
 var Filters = [3]string{BLUE, GREEN, RED}
 
+// The clear filters of the ISS cameras, which pass most of the visible spectrum and give
+// frames with a higher signal to noise ratio than the color filters.
+const (
+	CLEAR1 = "CL1"
+	CLEAR2 = "CL2"
+)
+
+var ClearFilters = [2]string{CLEAR1, CLEAR2}
+
+// The cameras of ISS, which share their filters.
+const (
+	NARROW = "narrow"
+	WIDE   = "wide"
+)
+
+// NarrowScale is the size of a narrow angle camera pixel in wide angle camera pixels for
+// full frames of the same size, the ratio of their fields of view of 6 and 60
+// microradians.
+const NarrowScale = 0.1
+
+// The polarizing filters of the ISS cameras, three visible polarizers 60 degrees apart
+// and two infrared polarizers 90 degrees apart.
+const (
+	P0    = "P0"
+	P60   = "P60"
+	P120  = "P120"
+	IRP0  = "IRP0"
+	IRP90 = "IRP90"
+)
+
+var PolarizerFilters = [3]string{P0, P60, P120}
+var IRPolarizerFilters = [2]string{IRP0, IRP90}
+
+// PolarizerAngles is the angle in degrees of the transmission axis of each polarizer.
+var PolarizerAngles = map[string]float64{
+	P0:    0,
+	P60:   60,
+	P120:  120,
+	IRP0:  0,
+	IRP90: 90,
+}
+
 // The type for marshalling a config.json file from a folder with images.
 type ImageConfig struct {
 	Filename string `json:"filename"`
 	Filter   string `json:"filter"`
 	OffsetX  int    `json:"offsetX"`
 	OffsetY  int    `json:"offsetY"`
+	// Exposure is the exposure time of the image in seconds, used to merge frames with
+	// different exposures.
+	Exposure float64 `json:"exposure,omitempty"`
+	// Frame groups the filter images taken together when a config holds several, such as
+	// the pointings of a mosaic.
+	Frame int `json:"frame,omitempty"`
+	// Camera is narrow or wide when a config holds the frames of both cameras.
+	Camera string `json:"camera,omitempty"`
+	// Alignment records the quality of the offsets found by aligning the image.
+	Alignment *AlignmentQuality `json:"alignment,omitempty"`
+}
+
+// AlignmentQuality describes how trustworthy the offsets found for an image are.
+type AlignmentQuality struct {
+	// Reference is the filter the image was aligned to.
+	Reference string `json:"reference"`
+	// MaxOffset is how many pixels around the reference the offset was searched.
+	MaxOffset int `json:"maxOffset,omitempty"`
+	// Confidence combines the correlation and the second best ratio into a score
+	// between 0 (unreliable) and 1.
+	Confidence float64 `json:"confidence"`
+	// Sharpness is how many standard deviations the best cost is below the mean cost.
+	Sharpness float64 `json:"sharpness"`
+	// SecondBestRatio is the ratio of the best cost to the next best local minimum,
+	// values close to 1 mean the alignment was ambiguous.
+	SecondBestRatio float64 `json:"secondBestRatio"`
+	// NCC is the normalized cross correlation of the images at the chosen offset.
+	NCC float64 `json:"ncc"`
+	// Residual is the mean absolute difference of the images at the chosen offset.
+	Residual float64 `json:"residual"`
+}
+
+// Offset returns the offset of the image as a point.
+func (c ImageConfig) Offset() image.Point {
+	return image.Pt(c.OffsetX, c.OffsetY)
 }
 
 type ConfigFile struct {
 	Files     []ImageConfig `json:"files"`
 	MaxOffset int           `json:"maxOffset"`
+	// Reference is the filter the other images are aligned to, blue by default or auto
+	// for the sharpest image.
+	Reference string `json:"reference,omitempty"`
+	// ROI restricts the alignment to a region of the reference image.
+	ROI *ROIConfig `json:"roi,omitempty"`
+	// Downsample finds offsets on images shrunk by this factor before refining them.
+	Downsample int `json:"downsample,omitempty"`
+	// Metric and Search select the alignment cost function and search strategy.
+	Metric string `json:"metric,omitempty"`
+	Search string `json:"search,omitempty"`
+	// MinConfidence rejects aligned composites when any image has a lower alignment confidence.
+	MinConfidence float64 `json:"minConfidence,omitempty"`
+	// OutputSurface writes the alignment cost surface of each aligned image.
+	OutputSurface bool `json:"outputSurface,omitempty"`
+	// Mosaic stitches the frames of the config into a mosaic instead of compositing a
+	// single frame.
+	Mosaic *MosaicConfig `json:"mosaic,omitempty"`
+	// FalseColor lists false color products made from any filters instead of compositing
+	// the RGB filters.
+	FalseColor []FalseColorConfig `json:"falseColor,omitempty"`
+	// Polarization combines the images of polarizers into maps of the intensity and
+	// linear polarization instead of compositing the RGB filters.
+	Polarization *PolarizationConfig `json:"polarization,omitempty"`
+	// Cameras combines the frames of the narrow and wide angle cameras instead of
+	// compositing the RGB filters of a single camera.
+	Cameras *CamerasConfig `json:"cameras,omitempty"`
+	// Tiles streams the aligned composite to disk tile by tile.
+	Tiles  *TilesConfig `json:"tiles,omitempty"`
+	Credit string       `json:"credit,omitempty"`
+	ProcessingConfig
 }
 
+// LoadedConfig pairs an image with its config. The image is shared rather than copied
+// as the loaded config moves through the pipeline.
 type LoadedConfig struct {
 	Config ImageConfig
-	Image  image.Gray
+	Image  *image.Gray
 }
 
 // ImageMap is a type alias for a map of filter strings to gray images.
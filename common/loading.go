@@ -4,23 +4,87 @@ import (
 	"encoding/json"
 	"fmt"
 	"image"
-	"image/jpeg"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+
+	_ "golang.org/x/image/tiff"
 )
 
+// LoadImage decodes an image in any registered format (JPEG, PNG, GIF or TIFF) and
+// converts it to grayscale. Images stored as 16 bit gray, paletted or RGB are accepted
+// as long as every pixel is gray.
+// It returns the image as a Gray image and any error encountered.
 func LoadImage(data io.Reader) (*image.Gray, error) {
-	img, err := jpeg.Decode(data)
+	img, format, err := image.Decode(data)
 
 	if err != nil {
 		return nil, fmt.Errorf("error decoding image: %s", err)
 	}
 
-	grayImg, ok := img.(*image.Gray)
-	if !ok {
-		return nil, fmt.Errorf("image not grayscale (%s), can't process", img.ColorModel())
+	grayImg, err := toGray(img)
+	if err != nil {
+		return nil, fmt.Errorf("%s image not grayscale (%T), can't process: %s", format, img, err)
+	}
+
+	return grayImg, nil
+}
+
+// grayTolerance is how far apart the red, green and blue values of a pixel may be for
+// it to count as gray, as gray JPEGs stored in YCbCr decode to values a step or two
+// apart.
+const grayTolerance = 2
+
+// spread returns the difference between the largest and smallest of the values.
+func spread(values ...uint32) uint32 {
+	low, high := values[0], values[0]
+	for _, v := range values[1:] {
+		if v < low {
+			low = v
+		}
+		if v > high {
+			high = v
+		}
+	}
+	return high - low
+}
+
+// toGray converts an image to an 8 bit Gray image. Gray16 images keep their most
+// significant byte, all other images must have red, green and blue values within
+// grayTolerance of each other at every pixel, which are averaged.
+func toGray(img image.Image) (*image.Gray, error) {
+	bounds := img.Bounds()
+
+	switch src := img.(type) {
+	case *image.Gray:
+		return src, nil
+	case *image.Gray16:
+		grayImg := image.NewGray(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				grayImg.SetGray(x, y, color.Gray{uint8(src.Gray16At(x, y).Y >> 8)})
+			}
+		}
+		return grayImg, nil
+	}
+
+	grayImg := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			r, g, b = r>>8, g>>8, b>>8
+			if spread(r, g, b) > grayTolerance {
+				return nil, fmt.Errorf("pixel (%d, %d) has multiple channels (%d, %d, %d)",
+					x, y, r, g, b)
+			}
+			grayImg.SetGray(x, y, color.Gray{uint8((r + g + b + 1) / 3)})
+		}
 	}
 
 	return grayImg, nil
@@ -44,29 +108,36 @@ func LoadImageFromPath(imagePath string) (*image.Gray, error) {
 	return image, nil
 }
 
+// ValidateImageMap checks that a map of filters to images holds a complete RGB set.
+// It returns an error naming the first missing filter.
 func ValidateImageMap(imageMap map[string]string) error {
-	for _, filter := range Filters {
+	return ValidateFilters(imageMap, Filters[:])
+}
+
+// ValidateFilters checks that a map of filters to images holds every one of the filters.
+// It returns an error naming the first missing filter.
+func ValidateFilters(imageMap map[string]string, filters []string) error {
+	for _, filter := range filters {
 		if _, ok := imageMap[filter]; !ok {
-			var filters []string
+			var present []string
 			for k := range imageMap {
-				filters = append(filters, k)
+				present = append(present, k)
 			}
-			return fmt.Errorf("images missing one or more RGB filters: %s in %s", filter, filters)
+			sort.Strings(present)
+			return fmt.Errorf("images missing one or more of the filters %s: %s in %s", filters, filter, present)
 		}
 	}
 	return nil
 }
 
-// LoadImages loads all images based on a config file and a filesystem root.
-// The set of images will be validated as grayscale images and to ensure they
-// represent a complete RGB set of images.
-// It returns a map of filters to images and any errors encountered.
-func LoadImages(config ConfigFile, root string) (ImageMap, error) {
+// loadFiles loads the images of a list of image configs, ensuring they are grayscale
+// and all share the same bounds.
+// It returns the loaded images in the order of the configs and any errors encountered.
+func loadFiles(files []ImageConfig, root string) ([]LoadedConfig, error) {
 	var imageBounds image.Rectangle
-	imageMap := make(ImageMap)
-	filenameMap := make(ImageFilenameMap)
+	var loaded []LoadedConfig
 
-	for _, imageConfig := range config.Files {
+	for _, imageConfig := range files {
 		fmt.Println("Reading: ", imageConfig.Filename)
 		fullPath := path.Join(root, imageConfig.Filename)
 		img, err := LoadImageFromPath(fullPath)
@@ -80,18 +151,96 @@ func LoadImages(config ConfigFile, root string) (ImageMap, error) {
 				fullPath, newBounds, imageBounds)
 		}
 		imageBounds = newBounds
-		imageMap[imageConfig.Filter] = LoadedConfig{imageConfig, *img}
-		filenameMap[imageConfig.Filter] = imageConfig.Filename
+		loaded = append(loaded, LoadedConfig{imageConfig, img})
 		fmt.Println("Filter:", imageConfig.Filter)
 	}
 
-	if err := ValidateImageMap(filenameMap); err != nil {
+	return loaded, nil
+}
+
+// LoadImages loads all images based on a config file and a filesystem root.
+// The set of images will be validated as grayscale images and to ensure they
+// represent a complete RGB set of images.
+// It returns a map of filters to images and any errors encountered.
+func LoadImages(config ConfigFile, root string) (ImageMap, error) {
+	return LoadFilters(config, root, Filters[:])
+}
+
+// LoadFilters loads all images of a config file like LoadImages, requiring an image of
+// each of the given filters rather than the RGB filters.
+// It returns a map of filters to images and any errors encountered.
+func LoadFilters(config ConfigFile, root string, filters []string) (ImageMap, error) {
+	loaded, err := loadFiles(config.Files, root)
+	if err != nil {
+		return nil, err
+	}
+
+	imageMap := make(ImageMap)
+	filenameMap := make(ImageFilenameMap)
+	for _, l := range loaded {
+		imageMap[l.Config.Filter] = l
+		filenameMap[l.Config.Filter] = l.Config.Filename
+	}
+
+	if err := ValidateFilters(filenameMap, filters); err != nil {
 		return nil, fmt.Errorf("%s: %s", root, err)
 	}
 
 	return imageMap, nil
 }
 
+// LoadStacks loads every image of a config holding several frames of each filter, to be
+// stacked into a single image per filter. The images are validated like LoadImages.
+// It returns the frames of each filter in the order of the config and any errors
+// encountered.
+func LoadStacks(config ConfigFile, root string) (map[string][]LoadedConfig, error) {
+	loaded, err := loadFiles(config.Files, root)
+	if err != nil {
+		return nil, err
+	}
+
+	stacks := make(map[string][]LoadedConfig)
+	filenameMap := make(ImageFilenameMap)
+	for _, l := range loaded {
+		stacks[l.Config.Filter] = append(stacks[l.Config.Filter], l)
+		filenameMap[l.Config.Filter] = l.Config.Filename
+	}
+
+	if err := ValidateImageMap(filenameMap); err != nil {
+		return nil, fmt.Errorf("%s: %s", root, err)
+	}
+
+	return stacks, nil
+}
+
+// LoadFrames loads the images of a config holding several frames, each a complete RGB
+// set of images sharing the same bounds and frame number.
+// It returns an image map for each frame in frame order and any errors encountered.
+func LoadFrames(config ConfigFile, root string) ([]ImageMap, error) {
+	frameFiles := make(map[int][]ImageConfig)
+	var frameNumbers []int
+	for _, imageConfig := range config.Files {
+		if _, ok := frameFiles[imageConfig.Frame]; !ok {
+			frameNumbers = append(frameNumbers, imageConfig.Frame)
+		}
+		frameFiles[imageConfig.Frame] = append(frameFiles[imageConfig.Frame], imageConfig)
+	}
+	sort.Ints(frameNumbers)
+
+	var frames []ImageMap
+	for _, frame := range frameNumbers {
+		frameConfig := config
+		frameConfig.Files = frameFiles[frame]
+		imageMap, err := LoadImages(frameConfig, root)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %s", frame, err)
+		}
+		frames = append(frames, imageMap)
+	}
+
+	return frames, nil
+}
+
 func LoadConfig(root string) (ConfigFile, error) {
 	config := ConfigFile{}
 	configPath := path.Join(root, "config.json")
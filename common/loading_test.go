@@ -0,0 +1,84 @@
+package common
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// grayJPEG encodes an RGBA image of a horizontal gray ramp as a JPEG, which stores it as
+// YCbCr, and decodes it again.
+func grayJPEG(t *testing.T) image.Image {
+	rgba := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			v := uint8(x * 8)
+			rgba.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, rgba, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatalf("encoding jpeg: %s", err)
+	}
+	img, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatalf("decoding jpeg: %s", err)
+	}
+	if _, ok := img.(*image.YCbCr); !ok {
+		t.Fatalf("jpeg decoded as %T, expected *image.YCbCr", img)
+	}
+	return img
+}
+
+// chromaImage returns a YCbCr image of a single color.
+func chromaImage(y, cb, cr uint8) image.Image {
+	img := image.NewYCbCr(image.Rect(0, 0, 4, 4), image.YCbCrSubsampleRatio444)
+	for i := range img.Y {
+		img.Y[i] = y
+	}
+	for i := range img.Cb {
+		img.Cb[i], img.Cr[i] = cb, cr
+	}
+	return img
+}
+
+func TestToGray(t *testing.T) {
+	gray16 := image.NewGray16(image.Rect(0, 0, 2, 2))
+	gray16.SetGray16(1, 1, color.Gray16{0xABCD})
+
+	tests := []struct {
+		name    string
+		img     image.Image
+		wantErr bool
+		at      image.Point
+		want    uint8
+	}{
+		{"gray jpeg", grayJPEG(t), false, image.Pt(0, 0), 0},
+		{"chroma within tolerance", chromaImage(128, 128, 127), false, image.Pt(0, 0), 128},
+		{"color", chromaImage(128, 160, 100), true, image.Pt(0, 0), 0},
+		{"gray16 keeps high byte", gray16, false, image.Pt(1, 1), 0xAB},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gray, err := toGray(tt.img)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error converting a color image")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if gray.Bounds() != tt.img.Bounds() {
+				t.Errorf("bounds %v, expected %v", gray.Bounds(), tt.img.Bounds())
+			}
+			if v := gray.GrayAt(tt.at.X, tt.at.Y).Y; v != tt.want {
+				t.Errorf("pixel %v is %d, expected %d", tt.at, v, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package common
+
+import (
+	"fmt"
+	"path"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// version is the gostitcher version recorded in the metadata of output images. It can
+// be set when building with -ldflags "-X github.com/lewchuk/gostitcher/common.version=v1.0",
+// otherwise the version is taken from the build info, see Version.
+var version = ""
+
+// Version returns the version of gostitcher: the version set when building, the module
+// version when installed from a tagged release, the revision of the checkout it was
+// built from or "devel" when none is known.
+func Version() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+			return setting.Value[:12]
+		}
+	}
+	return "devel"
+}
+
+// Metadata records the provenance of a composite image: which source images and
+// offsets it was made from, the algorithm and parameters used and who to credit.
+type Metadata struct {
+	Algorithm  string
+	Parameters map[string]string
+	Sources    []ImageConfig
+	Credit     string
+}
+
+// NewMetadata creates the metadata for an image generated by an algorithm from the
+// images in an image map. The credit line and the settings of the processing stages
+// are taken from the config file.
+func NewMetadata(algorithm string, config ConfigFile, imageMap ImageMap) *Metadata {
+	var filters []string
+	for filter := range imageMap {
+		filters = append(filters, filter)
+	}
+	sort.Strings(filters)
+
+	sources := make([]ImageConfig, len(filters))
+	for i, filter := range filters {
+		sources[i] = imageMap[filter].Config
+	}
+
+	return &Metadata{
+		Algorithm:  algorithm,
+		Parameters: config.Parameters(),
+		Sources:    sources,
+		Credit:     config.Credit,
+	}
+}
+
+// SetParameter records the value of a parameter used to generate the image.
+func (m *Metadata) SetParameter(name string, value interface{}) {
+	m.Parameters[name] = fmt.Sprint(value)
+}
+
+// Software returns the name and version of the program that generated the image.
+func (m *Metadata) Software() string {
+	return fmt.Sprintf("gostitcher %s", Version())
+}
+
+// ParameterString returns the parameters as a sorted list of name=value pairs.
+func (m *Metadata) ParameterString() string {
+	var names []string
+	for name := range m.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%s", name, m.Parameters[name])
+	}
+
+	return strings.Join(pairs, "; ")
+}
+
+// SourceString returns a description of each source image: the image id, the filter
+// and the offset applied to it.
+func (m *Metadata) SourceString() string {
+	sources := make([]string, len(m.Sources))
+	for i, source := range m.Sources {
+		id := strings.TrimSuffix(source.Filename, path.Ext(source.Filename))
+		sources[i] = fmt.Sprintf("%s (%s, offset %d,%d)", id, source.Filter, source.OffsetX, source.OffsetY)
+	}
+
+	return strings.Join(sources, "; ")
+}
+
+// Description returns a single human readable summary of the metadata.
+func (m *Metadata) Description() string {
+	lines := []string{fmt.Sprintf("Algorithm: %s", m.Algorithm)}
+	if len(m.Parameters) > 0 {
+		lines = append(lines, fmt.Sprintf("Parameters: %s", m.ParameterString()))
+	}
+	lines = append(lines, fmt.Sprintf("Sources: %s", m.SourceString()))
+
+	return strings.Join(lines, "\n")
+}
+
+// xmpPacket serializes the metadata as an XMP packet.
+func (m *Metadata) xmpPacket() []byte {
+	var b strings.Builder
+
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/">` + "\n")
+	b.WriteString(`<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` + "\n")
+	b.WriteString(`<rdf:Description rdf:about=""` +
+		` xmlns:dc="http://purl.org/dc/elements/1.1/"` +
+		` xmlns:xmp="http://ns.adobe.com/xap/1.0/"` +
+		` xmlns:gostitcher="https://github.com/lewchuk/gostitcher/ns/1.0/">` + "\n")
+
+	fmt.Fprintf(&b, "<xmp:CreatorTool>%s</xmp:CreatorTool>\n", escapeXML(m.Software()))
+	fmt.Fprintf(&b, "<dc:description><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:description>\n",
+		escapeXML(m.Description()))
+	fmt.Fprintf(&b, "<dc:source>%s</dc:source>\n", escapeXML(m.SourceString()))
+	if m.Credit != "" {
+		fmt.Fprintf(&b, "<dc:rights><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:rights>\n",
+			escapeXML(m.Credit))
+	}
+	fmt.Fprintf(&b, "<gostitcher:algorithm>%s</gostitcher:algorithm>\n", escapeXML(m.Algorithm))
+	fmt.Fprintf(&b, "<gostitcher:parameters>%s</gostitcher:parameters>\n", escapeXML(m.ParameterString()))
+
+	b.WriteString("<gostitcher:sources><rdf:Seq>\n")
+	for _, source := range m.Sources {
+		fmt.Fprintf(&b, "<rdf:li rdf:parseType=\"Resource\">"+
+			"<gostitcher:filename>%s</gostitcher:filename>"+
+			"<gostitcher:filter>%s</gostitcher:filter>"+
+			"<gostitcher:offsetX>%d</gostitcher:offsetX>"+
+			"<gostitcher:offsetY>%d</gostitcher:offsetY>"+
+			"</rdf:li>\n",
+			escapeXML(source.Filename), escapeXML(source.Filter), source.OffsetX, source.OffsetY)
+	}
+	b.WriteString("</rdf:Seq></gostitcher:sources>\n")
+
+	b.WriteString("</rdf:Description>\n</rdf:RDF>\n</x:xmpmeta>\n")
+	b.WriteString(`<?xpacket end="w"?>`)
+
+	return []byte(b.String())
+}
+
+var xmlEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&quot;",
+	"'", "&apos;",
+)
+
+func escapeXML(s string) string {
+	return xmlEscaper.Replace(s)
+}
@@ -1,30 +1,140 @@
 package common
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"image"
 	"image/jpeg"
+	"image/png"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
-// WriteImages writes out an image as a jpeg to a given path.
+// WriteImage writes out an image to a given path. The format is chosen from the file
+// extension: JPEG (the default), PNG or TIFF. If metadata is provided it is embedded
+// as EXIF and XMP for JPEG, tEXt chunks for PNG and tags for TIFF.
 // Returns any errors from the write.
-func WriteImage(path string, img image.Image) error {
+func WriteImage(path string, img image.Image, meta *Metadata) error {
 	fmt.Println("Writing image to:", path)
-	f, err := os.Create(path)
+
+	var buf bytes.Buffer
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		err = encodePNG(&buf, img, meta)
+	case ".tif", ".tiff":
+		err = encodeTIFF(&buf, img, meta)
+	default:
+		err = encodeJPEG(&buf, img, meta)
+	}
 	if err != nil {
+		return fmt.Errorf("encoding image %s: %s", path, err)
+	}
+
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// encodeJPEG encodes an image as a JPEG, inserting EXIF and XMP APP1 segments
+// directly after the start of image marker.
+func encodeJPEG(buf *bytes.Buffer, img image.Image, meta *Metadata) error {
+	if meta == nil {
+		return jpeg.Encode(buf, img, nil)
+	}
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, nil); err != nil {
 		return err
 	}
+	data := encoded.Bytes()
+
+	segments := [][]byte{
+		exifSegment(meta),
+		append([]byte("http://ns.adobe.com/xap/1.0/\x00"), meta.xmpPacket()...),
+	}
 
-	return jpeg.Encode(f, img, nil)
+	buf.Write(data[:2])
+	for _, segment := range segments {
+		// The segment length includes the two length bytes.
+		if len(segment)+2 > 0xFFFF {
+			return fmt.Errorf("metadata segment too large (%d bytes)", len(segment))
+		}
+		buf.Write([]byte{0xFF, 0xE1})
+		binary.Write(buf, binary.BigEndian, uint16(len(segment)+2))
+		buf.Write(segment)
+	}
+	buf.Write(data[2:])
+
+	return nil
+}
+
+// encodePNG encodes an image as a PNG, inserting tEXt chunks with the metadata
+// directly after the IHDR chunk.
+func encodePNG(buf *bytes.Buffer, img image.Image, meta *Metadata) error {
+	if meta == nil {
+		return png.Encode(buf, img)
+	}
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		return err
+	}
+	data := encoded.Bytes()
+
+	// The 8 byte signature is followed by the IHDR chunk: length, type, 13 bytes of data and crc.
+	ihdrEnd := 8 + 4 + 4 + 13 + 4
+	buf.Write(data[:ihdrEnd])
+
+	text := [][2]string{
+		{"Software", meta.Software()},
+		{"Description", meta.Description()},
+		{"Source", meta.SourceString()},
+	}
+	if meta.Credit != "" {
+		text = append(text, [2]string{"Copyright", meta.Credit})
+	}
+	for _, pair := range text {
+		chunk := append([]byte(pair[0]), 0)
+		chunk = append(chunk, toLatin1(pair[1])...)
+		writePNGChunk(buf, "tEXt", chunk)
+	}
+
+	buf.Write(data[ihdrEnd:])
+
+	return nil
+}
+
+func writePNGChunk(buf *bytes.Buffer, chunkType string, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(data)
+	buf.WriteString(chunkType)
+	buf.Write(data)
+	binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+// toLatin1 converts a string to Latin-1 as required by tEXt chunks, replacing any
+// characters that can't be represented.
+func toLatin1(s string) []byte {
+	latin := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xFF {
+			r = '?'
+		}
+		latin = append(latin, byte(r))
+	}
+	return latin
 }
 
 func WriteConfig(root string, config ConfigFile) error {
 	configJson, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
-		return fmt.Errorf("cannot serialize config json %s: %s", config, err)
+		return fmt.Errorf("cannot serialize config json %v: %s", config, err)
 	}
 
 	configPath := fmt.Sprintf("%s/config.json", root)
@@ -35,3 +145,16 @@ func WriteConfig(root string, config ConfigFile) error {
 
 	return nil
 }
+
+// UpdateConfig loads the config.json of root, applies update to it and writes it back.
+// Settings given for a single run, such as processing stages from the command line, are
+// left out of config.json as only the changes made by update are saved.
+// Returns any errors from loading or writing the config.
+func UpdateConfig(root string, update func(saved *ConfigFile)) error {
+	saved, err := LoadConfig(root)
+	if err != nil {
+		return err
+	}
+	update(&saved)
+	return WriteConfig(root, saved)
+}
@@ -0,0 +1,210 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+// testMetadata returns metadata with a credit line that spans two lines and has a
+// character outside ASCII, like the credits of config.json files.
+func testMetadata() *Metadata {
+	return &Metadata{
+		Algorithm:  "v3 aligning",
+		Parameters: map[string]string{"maxOffset": "10"},
+		Sources: []ImageConfig{
+			{Filename: "N1_bl1.jpg", Filter: BLUE},
+			{Filename: "N2_grn.jpg", Filter: GREEN, OffsetX: 2, OffsetY: -1},
+		},
+		Credit: "NASA / JPL / SSI / Émilie\nhttp://example.org",
+	}
+}
+
+// testImage returns a small RGBA image with a gradient.
+func testImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			img.Set(x, y, color.RGBA{uint8(16 * x), uint8(32 * y), 128, 255})
+		}
+	}
+	return img
+}
+
+// readASCIITags reads the ASCII tags of the little endian image file directory at
+// offset in a TIFF file or EXIF segment.
+func readASCIITags(t *testing.T, data []byte, offset uint32) map[uint16][]byte {
+	tags := make(map[uint16][]byte)
+	count := binary.LittleEndian.Uint16(data[offset:])
+	for i := uint32(0); i < uint32(count); i++ {
+		entry := data[offset+2+12*i:]
+		tag := binary.LittleEndian.Uint16(entry)
+		if binary.LittleEndian.Uint16(entry[2:]) != tiffASCII {
+			continue
+		}
+		n := binary.LittleEndian.Uint32(entry[4:])
+		value := entry[8:12]
+		if n > 4 {
+			start := binary.LittleEndian.Uint32(entry[8:])
+			value = data[start : start+n]
+		}
+		if value[n-1] != 0 {
+			t.Errorf("tag %d isn't NUL terminated", tag)
+		}
+		tags[tag] = value[:n-1]
+	}
+	return tags
+}
+
+// jpegSegments returns the payloads of the APP1 segments of a JPEG.
+func jpegSegments(data []byte) [][]byte {
+	var segments [][]byte
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF && data[i+1] == 0xE1; {
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		segments = append(segments, data[i+4:i+2+length])
+		i += 2 + length
+	}
+	return segments
+}
+
+// pngText returns the tEXt chunks of a PNG as a map of keywords to Latin-1 text.
+func pngText(data []byte) map[string]string {
+	text := make(map[string]string)
+	for i := 8; i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		if string(data[i+4:i+8]) == "tEXt" {
+			chunk := data[i+8 : i+8+length]
+			sep := bytes.IndexByte(chunk, 0)
+			text[string(chunk[:sep])] = string(chunk[sep+1:])
+		}
+		i += 12 + length
+	}
+	return text
+}
+
+func TestToASCII(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"two\nlines", "two lines"},
+		{"tab\tand\r\n", "tab and  "},
+		{"Émilie", "?milie"},
+		{"日本", "??"},
+	}
+	for _, tt := range tests {
+		if got := string(toASCII(tt.in)); got != tt.want {
+			t.Errorf("toASCII(%q) = %q, expected %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMetadataReadBack(t *testing.T) {
+	meta := testMetadata()
+	wantArtist := "NASA / JPL / SSI / ?milie http://example.org"
+
+	tests := []struct {
+		name   string
+		encode func(*bytes.Buffer, image.Image, *Metadata) error
+		check  func(*testing.T, []byte)
+	}{
+		{"jpeg", encodeJPEG, func(t *testing.T, data []byte) {
+			if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+				t.Fatalf("decoding jpeg: %s", err)
+			}
+			segments := jpegSegments(data)
+			if len(segments) != 2 {
+				t.Fatalf("found %d APP1 segments, expected 2", len(segments))
+			}
+
+			exif := segments[0]
+			if !bytes.HasPrefix(exif, []byte("Exif\x00\x00II")) {
+				t.Fatalf("first APP1 segment isn't little endian EXIF: %q", exif[:8])
+			}
+			tiffData := exif[6:]
+			tags := readASCIITags(t, tiffData, binary.LittleEndian.Uint32(tiffData[4:]))
+			checkASCIITags(t, tags, meta, wantArtist)
+
+			xmp := string(segments[1])
+			if !strings.HasPrefix(xmp, "http://ns.adobe.com/xap/1.0/\x00") {
+				t.Fatalf("second APP1 segment isn't XMP")
+			}
+			for _, want := range []string{
+				"<dc:rights><rdf:Alt><rdf:li xml:lang=\"x-default\">" + meta.Credit + "</rdf:li>",
+				"<xmp:CreatorTool>" + meta.Software() + "</xmp:CreatorTool>",
+				"<gostitcher:offsetX>2</gostitcher:offsetX>",
+			} {
+				if !strings.Contains(xmp, want) {
+					t.Errorf("XMP missing %q", want)
+				}
+			}
+		}},
+		{"png", encodePNG, func(t *testing.T, data []byte) {
+			if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+				t.Fatalf("decoding png: %s", err)
+			}
+			text := pngText(data)
+			want := map[string]string{
+				"Software":    meta.Software(),
+				"Description": meta.Description(),
+				"Source":      meta.SourceString(),
+				"Copyright":   string(toLatin1(meta.Credit)),
+			}
+			for key, value := range want {
+				if text[key] != value {
+					t.Errorf("tEXt %s = %q, expected %q", key, text[key], value)
+				}
+			}
+		}},
+		{"tiff", func(buf *bytes.Buffer, img image.Image, meta *Metadata) error {
+			return encodeTIFF(buf, img, meta)
+		}, func(t *testing.T, data []byte) {
+			if _, err := tiff.Decode(bytes.NewReader(data)); err != nil {
+				t.Fatalf("decoding tiff: %s", err)
+			}
+			tags := readASCIITags(t, data, binary.LittleEndian.Uint32(data[4:]))
+			checkASCIITags(t, tags, meta, wantArtist)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.encode(&buf, testImage(), meta); err != nil {
+				t.Fatalf("encoding: %s", err)
+			}
+			tt.check(t, buf.Bytes())
+		})
+	}
+}
+
+// checkASCIITags checks the text tags of a TIFF directory hold the metadata as 7 bit
+// ASCII.
+func checkASCIITags(t *testing.T, tags map[uint16][]byte, meta *Metadata, wantArtist string) {
+	for tag, value := range tags {
+		for _, c := range value {
+			if c >= 0x80 || c < ' ' {
+				t.Errorf("tag %d holds %q, which isn't printable ASCII", tag, value)
+				break
+			}
+		}
+	}
+	want := map[uint16]string{
+		tiffImageDesc: strings.Replace(meta.Description(), "\n", " ", -1),
+		tiffSoftware:  meta.Software(),
+		tiffArtist:    wantArtist,
+		tiffCopyright: wantArtist,
+	}
+	for tag, value := range want {
+		if string(tags[tag]) != value {
+			t.Errorf("tag %d = %q, expected %q", tag, tags[tag], value)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package common
+
+import (
+	"image"
+	"runtime"
+	"sync"
+)
+
+// Bands smaller than this many rows are not worth the cost of a goroutine.
+const minBandRows = 16
+
+// Bands returns the number of row bands ParallelRows splits bounds into, one per CPU.
+func Bands(bounds image.Rectangle) int {
+	bands := runtime.GOMAXPROCS(0)
+	if maxBands := bounds.Dy() / minBandRows; bands > maxBands {
+		bands = maxBands
+	}
+	if bands < 1 {
+		bands = 1
+	}
+	return bands
+}
+
+// ParallelRows splits the rows of bounds into bands and calls fn with the rows of each
+// band concurrently, returning once every call has finished. Each band gets its own
+// index below Bands(bounds) so callers can accumulate results per band without locking.
+func ParallelRows(bounds image.Rectangle, fn func(band int, rows image.Rectangle)) {
+	bands := Bands(bounds)
+
+	var wg sync.WaitGroup
+	for band := 0; band < bands; band++ {
+		rows := bounds
+		rows.Min.Y = bounds.Min.Y + band*bounds.Dy()/bands
+		rows.Max.Y = bounds.Min.Y + (band+1)*bounds.Dy()/bands
+		wg.Add(1)
+		go func(band int, rows image.Rectangle) {
+			defer wg.Done()
+			fn(band, rows)
+		}(band, rows)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,146 @@
+package common
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// Plane is a single channel image with floating point values where 0 is black and
+// 1 is white. Processing stages use planes to avoid losing precision between steps.
+type Plane struct {
+	Pix  []float64
+	Rect image.Rectangle
+}
+
+// NewPlane creates a black plane with the given bounds.
+func NewPlane(r image.Rectangle) *Plane {
+	return &Plane{make([]float64, r.Dx()*r.Dy()), r}
+}
+
+// PlaneFromGray converts a Gray image to a plane.
+func PlaneFromGray(img *image.Gray) *Plane {
+	bounds := img.Bounds()
+	plane := NewPlane(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			plane.Set(x, y, float64(img.GrayAt(x, y).Y)/255)
+		}
+	}
+	return plane
+}
+
+// PlanesFromRGBA splits an RGBA image into red, green and blue planes.
+func PlanesFromRGBA(img *image.RGBA) [3]*Plane {
+	bounds := img.Bounds()
+	planes := [3]*Plane{NewPlane(bounds), NewPlane(bounds), NewPlane(bounds)}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pixel := img.RGBAAt(x, y)
+			planes[0].Set(x, y, float64(pixel.R)/255)
+			planes[1].Set(x, y, float64(pixel.G)/255)
+			planes[2].Set(x, y, float64(pixel.B)/255)
+		}
+	}
+	return planes
+}
+
+// RGBAFromPlanes combines red, green and blue planes into an opaque RGBA image.
+func RGBAFromPlanes(planes [3]*Plane) *image.RGBA {
+	bounds := planes[0].Rect
+	img := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			img.SetRGBA(x, y, color.RGBA{
+				ToUint8(planes[0].At(x, y)),
+				ToUint8(planes[1].At(x, y)),
+				ToUint8(planes[2].At(x, y)),
+				255})
+		}
+	}
+	return img
+}
+
+// ToUint8 converts a plane value to an 8 bit intensity, clamping it to [0, 1].
+func ToUint8(v float64) uint8 {
+	return uint8(math.Round(Clamp(v, 0, 1) * 255))
+}
+
+// Clamp limits a value to the range [min, max].
+func Clamp(v, min, max float64) float64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func (p *Plane) offset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Rect.Dx() + (x - p.Rect.Min.X)
+}
+
+// At returns the value at a point, points outside the plane are 0.
+func (p *Plane) At(x, y int) float64 {
+	if !image.Pt(x, y).In(p.Rect) {
+		return 0
+	}
+	return p.Pix[p.offset(x, y)]
+}
+
+// ClampedAt returns the value at a point, repeating the edges of the plane beyond it.
+func (p *Plane) ClampedAt(x, y int) float64 {
+	r := p.Rect
+	if x < r.Min.X {
+		x = r.Min.X
+	} else if x >= r.Max.X {
+		x = r.Max.X - 1
+	}
+	if y < r.Min.Y {
+		y = r.Min.Y
+	} else if y >= r.Max.Y {
+		y = r.Max.Y - 1
+	}
+	return p.Pix[p.offset(x, y)]
+}
+
+// Set updates the value at a point, points outside the plane are ignored.
+func (p *Plane) Set(x, y int, v float64) {
+	if !image.Pt(x, y).In(p.Rect) {
+		return
+	}
+	p.Pix[p.offset(x, y)] = v
+}
+
+// Clone returns a copy of the plane.
+func (p *Plane) Clone() *Plane {
+	clone := NewPlane(p.Rect)
+	copy(clone.Pix, p.Pix)
+	return clone
+}
+
+// Gray converts the plane to a Gray image, clamping values to [0, 1].
+func (p *Plane) Gray() *image.Gray {
+	img := image.NewGray(p.Rect)
+	for y := p.Rect.Min.Y; y < p.Rect.Max.Y; y++ {
+		for x := p.Rect.Min.X; x < p.Rect.Max.X; x++ {
+			img.SetGray(x, y, color.Gray{ToUint8(p.At(x, y))})
+		}
+	}
+	return img
+}
+
+// Percentile returns the value below which the given percentage (0-100) of values fall.
+func Percentile(values []float64, percent float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	index := int(math.Round(Clamp(percent, 0, 100) / 100 * float64(len(sorted)-1)))
+	return sorted[index]
+}
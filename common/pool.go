@@ -0,0 +1,31 @@
+package common
+
+import (
+	"image"
+	"sync"
+)
+
+// grayPool holds pixel buffers of scratch images so diagnostic images made for every
+// observation don't each allocate a new frame sized buffer.
+var grayPool sync.Pool
+
+// GetGray returns a black scratch image with the given bounds, reusing a pooled pixel
+// buffer when one is large enough. Return it with PutGray once it is no longer used.
+func GetGray(r image.Rectangle) *image.Gray {
+	size := r.Dx() * r.Dy()
+	if buffer, ok := grayPool.Get().(*[]uint8); ok && cap(*buffer) >= size {
+		pix := (*buffer)[:size]
+		for i := range pix {
+			pix[i] = 0
+		}
+		return &image.Gray{Pix: pix, Stride: r.Dx(), Rect: r}
+	}
+	return image.NewGray(r)
+}
+
+// PutGray returns the pixel buffer of a scratch image to the pool. The image must not
+// be used afterwards.
+func PutGray(img *image.Gray) {
+	pix := img.Pix[:0]
+	grayPool.Put(&pix)
+}
@@ -0,0 +1,282 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"sort"
+)
+
+// TIFF tag ids and field types used when writing TIFF files and EXIF segments.
+const (
+	tiffImageWidth      = 256
+	tiffImageLength     = 257
+	tiffBitsPerSample   = 258
+	tiffCompression     = 259
+	tiffPhotometric     = 262
+	tiffImageDesc       = 270
+	tiffStripOffsets    = 273
+	tiffSamplesPerPixel = 277
+	tiffRowsPerStrip    = 278
+	tiffStripByteCounts = 279
+	tiffPlanarConfig    = 284
+	tiffSoftware        = 305
+	tiffArtist          = 315
+	tiffTileWidth       = 322
+	tiffTileLength      = 323
+	tiffTileOffsets     = 324
+	tiffTileByteCounts  = 325
+	tiffCopyright       = 33432
+
+	tiffShort = 3
+	tiffLong  = 4
+	tiffASCII = 2
+)
+
+// ifdEntry is a single tag of a TIFF image file directory with its encoded value.
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func shortEntry(tag uint16, values ...uint16) ifdEntry {
+	value := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint16(value[2*i:], v)
+	}
+	return ifdEntry{tag, tiffShort, uint32(len(values)), value}
+}
+
+func longEntry(tag uint16, values ...uint32) ifdEntry {
+	value := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(value[4*i:], v)
+	}
+	return ifdEntry{tag, tiffLong, uint32(len(values)), value}
+}
+
+// toASCII converts text to the 7 bit ASCII that TIFF and EXIF text tags must hold,
+// replacing line breaks and other control characters with spaces and characters outside
+// ASCII with '?'. JPEG outputs keep the full text in their XMP packet.
+func toASCII(s string) []byte {
+	ascii := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r < ' ' || r == 0x7F:
+			r = ' '
+		case r > 0x7F:
+			r = '?'
+		}
+		ascii = append(ascii, byte(r))
+	}
+	return ascii
+}
+
+func asciiEntry(tag uint16, s string) ifdEntry {
+	value := append(toASCII(s), 0)
+	return ifdEntry{tag, tiffASCII, uint32(len(value)), value}
+}
+
+// metadataEntries returns the TIFF tags describing the metadata, suitable for both
+// TIFF files and EXIF segments.
+func metadataEntries(meta *Metadata) []ifdEntry {
+	if meta == nil {
+		return nil
+	}
+
+	entries := []ifdEntry{
+		asciiEntry(tiffImageDesc, meta.Description()),
+		asciiEntry(tiffSoftware, meta.Software()),
+	}
+	if meta.Credit != "" {
+		entries = append(entries, asciiEntry(tiffArtist, meta.Credit), asciiEntry(tiffCopyright, meta.Credit))
+	}
+
+	return entries
+}
+
+// writeIFD serializes an image file directory located at offset in the file. Values
+// that don't fit in an entry are written directly after the directory.
+// It returns the bytes of the directory and its values.
+func writeIFD(entries []ifdEntry, offset uint32) []byte {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	dirSize := uint32(2 + 12*len(entries) + 4)
+	dir := new(bytes.Buffer)
+	values := new(bytes.Buffer)
+
+	binary.Write(dir, binary.LittleEndian, uint16(len(entries)))
+	for _, entry := range entries {
+		binary.Write(dir, binary.LittleEndian, entry.tag)
+		binary.Write(dir, binary.LittleEndian, entry.typ)
+		binary.Write(dir, binary.LittleEndian, entry.count)
+		if len(entry.value) <= 4 {
+			padded := make([]byte, 4)
+			copy(padded, entry.value)
+			dir.Write(padded)
+			continue
+		}
+		binary.Write(dir, binary.LittleEndian, offset+dirSize+uint32(values.Len()))
+		values.Write(entry.value)
+		// Values must start on a word boundary.
+		if values.Len()%2 == 1 {
+			values.WriteByte(0)
+		}
+	}
+	// No further directories.
+	binary.Write(dir, binary.LittleEndian, uint32(0))
+
+	dir.Write(values.Bytes())
+	return dir.Bytes()
+}
+
+// tiffHeader returns a little endian TIFF header pointing at the first directory.
+func tiffHeader(ifdOffset uint32) []byte {
+	header := []byte{'I', 'I', 42, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(header[4:], ifdOffset)
+	return header
+}
+
+// exifSegment returns the payload of a JPEG APP1 EXIF segment holding the metadata.
+func exifSegment(meta *Metadata) []byte {
+	segment := []byte("Exif\x00\x00")
+	segment = append(segment, tiffHeader(8)...)
+	return append(segment, writeIFD(metadataEntries(meta), 8)...)
+}
+
+// encodeTIFF writes an uncompressed TIFF with the metadata stored as tags. Gray images
+// are written with a single sample per pixel, everything else as 8 bit RGB.
+func encodeTIFF(w io.Writer, img image.Image, meta *Metadata) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	var pix []byte
+	var entries []ifdEntry
+	if gray, ok := img.(*image.Gray); ok {
+		pix = make([]byte, 0, width*height)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			start := gray.PixOffset(bounds.Min.X, y)
+			pix = append(pix, gray.Pix[start:start+width]...)
+		}
+		entries = []ifdEntry{
+			shortEntry(tiffBitsPerSample, 8),
+			shortEntry(tiffPhotometric, 1),
+			shortEntry(tiffSamplesPerPixel, 1),
+		}
+	} else {
+		pix = make([]byte, 0, 3*width*height)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r, g, b, _ := img.At(x, y).RGBA()
+				pix = append(pix, uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			}
+		}
+		entries = []ifdEntry{
+			shortEntry(tiffBitsPerSample, 8, 8, 8),
+			shortEntry(tiffPhotometric, 2),
+			shortEntry(tiffSamplesPerPixel, 3),
+		}
+	}
+
+	// Pixel data directly follows the header, the directory follows the pixel data.
+	stripOffset := uint32(8)
+	stripLength := uint32(len(pix))
+	ifdOffset := stripOffset + stripLength
+	if ifdOffset%2 == 1 {
+		pix = append(pix, 0)
+		ifdOffset++
+	}
+
+	entries = append(entries,
+		longEntry(tiffImageWidth, uint32(width)),
+		longEntry(tiffImageLength, uint32(height)),
+		shortEntry(tiffCompression, 1),
+		longEntry(tiffStripOffsets, stripOffset),
+		longEntry(tiffRowsPerStrip, uint32(height)),
+		longEntry(tiffStripByteCounts, stripLength),
+		shortEntry(tiffPlanarConfig, 1),
+	)
+	entries = append(entries, metadataEntries(meta)...)
+
+	for _, chunk := range [][]byte{tiffHeader(ifdOffset), pix, writeIFD(entries, ifdOffset)} {
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// encodeTiledTIFF streams an uncompressed RGB TIFF made of size by size tiles, rendering
+// and writing one tile at a time. Tiles at the right and bottom edges are padded with
+// black. The directory follows the tiles and the header is patched to point at it once
+// they are written.
+func encodeTiledTIFF(w io.WriteSeeker, bounds image.Rectangle, size int, render TileRenderer, meta *Metadata) error {
+	if size%16 != 0 {
+		return fmt.Errorf("tile size %d is not a multiple of 16", size)
+	}
+	if _, err := w.Write(tiffHeader(0)); err != nil {
+		return err
+	}
+
+	tileLength := uint32(3 * size * size)
+	offset := uint32(8)
+	var offsets, counts []uint32
+	pix := make([]byte, tileLength)
+	for _, row := range TileGrid(bounds, size) {
+		for _, tile := range row {
+			img, err := render(tile)
+			if err != nil {
+				return err
+			}
+			for i := range pix {
+				pix[i] = 0
+			}
+			for y := tile.Min.Y; y < tile.Max.Y; y++ {
+				i := 3 * (y - tile.Min.Y) * size
+				for x := tile.Min.X; x < tile.Max.X; x, i = x+1, i+3 {
+					r, g, b, _ := img.At(x, y).RGBA()
+					pix[i], pix[i+1], pix[i+2] = uint8(r>>8), uint8(g>>8), uint8(b>>8)
+				}
+			}
+			if _, err := w.Write(pix); err != nil {
+				return err
+			}
+			offsets = append(offsets, offset)
+			counts = append(counts, tileLength)
+			if uint64(offset)+uint64(tileLength) > 1<<32-1 {
+				return fmt.Errorf("tiled image is larger than 4GB")
+			}
+			offset += tileLength
+		}
+	}
+
+	// Tiles of 16 pixel multiples always end on a word boundary, ready for the directory.
+	entries := []ifdEntry{
+		longEntry(tiffImageWidth, uint32(bounds.Dx())),
+		longEntry(tiffImageLength, uint32(bounds.Dy())),
+		shortEntry(tiffBitsPerSample, 8, 8, 8),
+		shortEntry(tiffCompression, 1),
+		shortEntry(tiffPhotometric, 2),
+		shortEntry(tiffSamplesPerPixel, 3),
+		shortEntry(tiffPlanarConfig, 1),
+		longEntry(tiffTileWidth, uint32(size)),
+		longEntry(tiffTileLength, uint32(size)),
+		longEntry(tiffTileOffsets, offsets...),
+		longEntry(tiffTileByteCounts, counts...),
+	}
+	entries = append(entries, metadataEntries(meta)...)
+	if _, err := w.Write(writeIFD(entries, offset)); err != nil {
+		return err
+	}
+
+	if _, err := w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := w.Write(tiffHeader(offset))
+	return err
+}
@@ -0,0 +1,96 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The default size of output tiles in pixels. Tiled TIFFs need multiples of 16.
+const DefaultTileSize = 512
+
+// TileRenderer draws the part of a large image within a rectangle, so the whole image
+// never has to be held in memory at once. The rectangle is always within the bounds of
+// the image.
+type TileRenderer func(r image.Rectangle) (image.Image, error)
+
+// TileIndex describes a directory of tiles, stored alongside them as index.json.
+type TileIndex struct {
+	// Bounds is the rectangle covered by the whole image.
+	Bounds image.Rectangle `json:"bounds"`
+	// TileSize is the width and height of every tile but those at the right and bottom.
+	TileSize int `json:"tileSize"`
+	// Tiles are the files of each tile by row and column.
+	Tiles [][]string `json:"tiles"`
+	// Metadata describes how the image was made.
+	Metadata *Metadata `json:"metadata,omitempty"`
+}
+
+// TileGrid splits bounds into rows of tiles of at most size by size pixels.
+func TileGrid(bounds image.Rectangle, size int) [][]image.Rectangle {
+	var grid [][]image.Rectangle
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += size {
+		var row []image.Rectangle
+		for x := bounds.Min.X; x < bounds.Max.X; x += size {
+			row = append(row, image.Rect(x, y, x+size, y+size).Intersect(bounds))
+		}
+		grid = append(grid, row)
+	}
+	return grid
+}
+
+// WriteTiles writes a large image one tile at a time. Paths ending in .tif or .tiff are
+// written as a single tiled TIFF, any other path is created as a directory of PNG tiles
+// with an index.json describing them.
+// Returns any errors from rendering or writing the tiles.
+func WriteTiles(outputPath string, bounds image.Rectangle, size int, render TileRenderer, meta *Metadata) error {
+	if size <= 0 {
+		size = DefaultTileSize
+	}
+
+	switch strings.ToLower(filepath.Ext(outputPath)) {
+	case ".tif", ".tiff":
+		fmt.Println("Writing tiled image to:", outputPath)
+		file, err := os.Create(outputPath)
+		if err != nil {
+			return fmt.Errorf("cannot create %s: %s", outputPath, err)
+		}
+		if err := encodeTiledTIFF(file, bounds, size, render, meta); err != nil {
+			file.Close()
+			return fmt.Errorf("encoding tiled image %s: %s", outputPath, err)
+		}
+		return file.Close()
+	}
+
+	if err := os.MkdirAll(outputPath, os.ModePerm); err != nil {
+		return fmt.Errorf("cannot create tile folder %s: %s", outputPath, err)
+	}
+
+	index := TileIndex{Bounds: bounds, TileSize: size, Metadata: meta}
+	for row, tiles := range TileGrid(bounds, size) {
+		var names []string
+		for column, tile := range tiles {
+			img, err := render(tile)
+			if err != nil {
+				return err
+			}
+			name := fmt.Sprintf("tile_%d_%d.png", row, column)
+			if err := WriteImage(path.Join(outputPath, name), img, meta); err != nil {
+				return err
+			}
+			names = append(names, name)
+		}
+		index.Tiles = append(index.Tiles, names)
+	}
+
+	indexJSON, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot serialize tile index: %v", err)
+	}
+	return ioutil.WriteFile(path.Join(outputPath, "index.json"), indexJSON, 0644)
+}
@@ -0,0 +1,309 @@
+// A package containing the functions for making false color images from the images of
+// any filters and the ratios between them.
+package falsecolor
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/algv3aligning"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"image/color"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Ratios add this much to both filters so dark pixels don't divide by zero.
+const ratioFloor = 1.0 / 255
+
+// band is the image of a filter or, with a denominator, the ratio of the images of two
+// filters.
+type band struct {
+	numerator   string
+	denominator string
+}
+
+// parseBand parses a band expression, either a filter such as MT3 or two filters
+// separated by a slash such as MT3/CB3.
+// It returns the band and any error encountered.
+func parseBand(expression string) (band, error) {
+	parts := strings.Split(strings.TrimSpace(expression), "/")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+		if parts[i] == "" {
+			return band{}, fmt.Errorf("invalid band %q, expected a filter or a ratio of two filters such as MT3/CB3", expression)
+		}
+	}
+	switch len(parts) {
+	case 1:
+		return band{numerator: parts[0]}, nil
+	case 2:
+		return band{parts[0], parts[1]}, nil
+	}
+	return band{}, fmt.Errorf("invalid band %q, expected a filter or a ratio of two filters such as MT3/CB3", expression)
+}
+
+// filters returns the filters a band is made from.
+func (b band) filters() []string {
+	if b.denominator == "" {
+		return []string{b.numerator}
+	}
+	return []string{b.numerator, b.denominator}
+}
+
+// productBands parses the bands of a product, either the single band mapped through a
+// colormap or the red, green and blue bands.
+// It returns the bands and any error encountered.
+func productBands(product common.FalseColorConfig) ([]band, error) {
+	if product.Name == "" {
+		return nil, fmt.Errorf("false color products need a name for their output")
+	}
+	// The name becomes part of the output filename, which must stay in the folder.
+	if strings.ContainsAny(product.Name, `/\`) || strings.Contains(product.Name, "..") {
+		return nil, fmt.Errorf("false color %q: names can't contain path separators or ..", product.Name)
+	}
+	expressions := []string{product.Red, product.Green, product.Blue}
+	if product.Band != "" {
+		if product.Red != "" || product.Green != "" || product.Blue != "" {
+			return nil, fmt.Errorf("false color %q maps either a band through a colormap or red, green and blue bands, not both", product.Name)
+		}
+		expressions = []string{product.Band}
+	} else if product.Red == "" || product.Green == "" || product.Blue == "" {
+		return nil, fmt.Errorf("false color %q needs a band or red, green and blue bands", product.Name)
+	}
+
+	bands := make([]band, len(expressions))
+	for i, expression := range expressions {
+		b, err := parseBand(expression)
+		if err != nil {
+			return nil, fmt.Errorf("false color %q: %s", product.Name, err)
+		}
+		bands[i] = b
+	}
+	return bands, nil
+}
+
+// Filters returns the filters used by any of the products, in the order they first
+// appear, and any error encountered parsing the products.
+func Filters(products []common.FalseColorConfig) ([]string, error) {
+	var filters []string
+	seen := make(map[string]bool)
+	for _, product := range products {
+		bands, err := productBands(product)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range bands {
+			for _, filter := range b.filters() {
+				if !seen[filter] {
+					seen[filter] = true
+					filters = append(filters, filter)
+				}
+			}
+		}
+	}
+	return filters, nil
+}
+
+// ParseProduct builds a product from a command line specification: a band such as
+// MT3/CB3 mapped through the named colormap, or three bands separated by commas mapped
+// to red, green and blue. The product is named for its bands.
+// It returns the product and any error encountered.
+func ParseProduct(spec, colormap string) (common.FalseColorConfig, error) {
+	name := strings.NewReplacer("/", "-", ",", "_", " ", "").Replace(spec)
+	product := common.FalseColorConfig{Name: name}
+	expressions := strings.Split(spec, ",")
+	switch len(expressions) {
+	case 1:
+		product.Band, product.Colormap = spec, colormap
+	case 3:
+		product.Red, product.Green, product.Blue = expressions[0], expressions[1], expressions[2]
+	default:
+		return product, fmt.Errorf("invalid false color %q, expected a band or red, green and blue bands separated by commas", spec)
+	}
+	_, err := productBands(product)
+	return product, err
+}
+
+// productColormap returns the custom LUT of a product, or its named colormap, viridis by
+// default.
+// It returns the colormap and any error encountered.
+func productColormap(product common.FalseColorConfig) (common.Colormap, error) {
+	if len(product.LUT) > 0 {
+		if len(product.LUT) < 2 {
+			return nil, fmt.Errorf("false color %q lut needs at least two colors", product.Name)
+		}
+		colormap := make(common.Colormap, len(product.LUT))
+		for i, stop := range product.LUT {
+			colormap[i] = color.RGBA{stop[0], stop[1], stop[2], 255}
+		}
+		return colormap, nil
+	}
+	if product.Colormap == "" {
+		return common.GetColormap("viridis")
+	}
+	return common.GetColormap(product.Colormap)
+}
+
+// valueAt reads the value (0-1) of an image at a point in the coordinates of the
+// composite, taking the offset of the image into account.
+func valueAt(loaded common.LoadedConfig, x, y int) float64 {
+	return float64(loaded.Image.GrayAt(x-loaded.Config.OffsetX, y-loaded.Config.OffsetY).Y) / 255
+}
+
+// renderBand evaluates a band over the bounds of the composite and stretches it so the
+// low and high percentiles of its values become 0 and 1.
+// It returns the band as a plane and the values mapped to 0 and 1.
+func renderBand(imageMap common.ImageMap, b band, bounds image.Rectangle, low, high float64) (*common.Plane, float64, float64) {
+	plane := common.NewPlane(bounds)
+	numerator := imageMap[b.numerator]
+	common.ParallelRows(bounds, func(_ int, rows image.Rectangle) {
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := rows.Min.X; x < rows.Max.X; x++ {
+				v := valueAt(numerator, x, y)
+				if b.denominator != "" {
+					v = (v + ratioFloor) / (valueAt(imageMap[b.denominator], x, y) + ratioFloor)
+				}
+				plane.Set(x, y, v)
+			}
+		}
+	})
+
+	black, white := common.Percentile(plane.Pix, low), common.Percentile(plane.Pix, high)
+	scale := 1.0
+	if white > black {
+		scale = 1 / (white - black)
+	}
+	for i, v := range plane.Pix {
+		plane.Pix[i] = common.Clamp((v-black)*scale, 0, 1)
+	}
+	return plane, black, white
+}
+
+// Render makes the false color image of a product from the aligned images of an image
+// map, covering the region of the composite where the images of all its filters overlap.
+// It returns the image, a description of the stretch of each band and any error
+// encountered.
+func Render(imageMap common.ImageMap, product common.FalseColorConfig) (*image.RGBA, string, error) {
+	if product.Low == 0 && product.High == 0 {
+		product.Low, product.High = 0.5, 99.5
+	}
+	bands, err := productBands(product)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var bounds image.Rectangle
+	for i, b := range bands {
+		for j, filter := range b.filters() {
+			loaded, ok := imageMap[filter]
+			if !ok {
+				return nil, "", fmt.Errorf("false color %q needs an image of filter %s", product.Name, filter)
+			}
+			shifted := loaded.Image.Bounds().Add(loaded.Config.Offset())
+			if i == 0 && j == 0 {
+				bounds = shifted
+			}
+			bounds = bounds.Intersect(shifted)
+		}
+	}
+	if bounds.Empty() {
+		return nil, "", fmt.Errorf("false color %q: the images of its filters do not overlap", product.Name)
+	}
+
+	planes := make([]*common.Plane, len(bands))
+	var stretches []string
+	for i, b := range bands {
+		var black, white float64
+		planes[i], black, white = renderBand(imageMap, b, bounds, product.Low, product.High)
+		stretches = append(stretches, fmt.Sprintf("%s=[%.3g, %.3g]", strings.Join(b.filters(), "/"), black, white))
+	}
+	description := strings.Join(stretches, " ")
+
+	if len(planes) == 3 {
+		return common.RGBAFromPlanes([3]*common.Plane{planes[0], planes[1], planes[2]}), description, nil
+	}
+
+	colormap, err := productColormap(product)
+	if err != nil {
+		return nil, "", err
+	}
+	img := image.NewRGBA(bounds)
+	common.ParallelRows(bounds, func(_ int, rows image.Rectangle) {
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := rows.Min.X; x < rows.Max.X; x++ {
+				img.SetRGBA(x, y, colormap.At(planes[0].At(x, y)))
+			}
+		}
+	})
+	return img, description, nil
+}
+
+// CombineImages aligns the images of the filters used by the false color products of the
+// config that haven't been aligned to the reference within maxOffset pixels, see
+// algv3aligning.Unaligned, saving their new offsets to config.json, and writes each
+// product to output_false_<name>.jpg. Images are aligned to
+// the configured reference if it is one of the filters used and to the first filter used
+// otherwise, with normalized cross correlation unless another metric is configured as
+// the filters may differ widely in brightness.
+// Returns any errors from aligning, rendering or writing the images.
+func CombineImages(config common.ConfigFile, imageMap common.ImageMap, maxOffset int, root string) error {
+	filters, err := Filters(config.FalseColor)
+	if err != nil {
+		return err
+	}
+	reference := filters[0]
+	for _, filter := range filters {
+		if filter == config.Reference {
+			reference = filter
+		}
+	}
+
+	if unaligned := algv3aligning.Unaligned(imageMap, filters, reference, maxOffset); maxOffset > 0 && len(unaligned) > 0 {
+		metric := config.Metric
+		if metric == "" {
+			metric = "ncc"
+		}
+		fmt.Println("Aligning images to:", reference)
+		if _, err := algv3aligning.AlignFilters(&imageMap, unaligned, maxOffset, reference, nil, config.Downsample, metric, config.Search); err != nil {
+			return err
+		}
+		sort.Strings(unaligned)
+		for _, filter := range unaligned {
+			fmt.Println(algv3aligning.DescribeQuality(imageMap[filter]))
+		}
+
+		if err := algv3aligning.SaveOffsets(config, imageMap, unaligned, root); err != nil {
+			return err
+		}
+	}
+
+	for _, product := range config.FalseColor {
+		img, stretch, err := Render(imageMap, product)
+		if err != nil {
+			return err
+		}
+
+		meta := common.NewMetadata("false color", config, imageMap)
+		meta.SetParameter("reference", reference)
+		meta.SetParameter("bands", stretch)
+		if product.Band != "" {
+			meta.SetParameter("band", product.Band)
+			colormap := product.Colormap
+			if len(product.LUT) > 0 {
+				colormap = "lut"
+			} else if colormap == "" {
+				colormap = "viridis"
+			}
+			meta.SetParameter("colormap", colormap)
+		} else {
+			meta.SetParameter("channels", fmt.Sprintf("red=%s green=%s blue=%s", product.Red, product.Green, product.Blue))
+		}
+
+		if err := common.WriteImage(path.Join(root, fmt.Sprintf("output_false_%s.jpg", product.Name)), img, meta); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package falsecolor
+
+import (
+	"github.com/lewchuk/gostitcher/common"
+	"reflect"
+	"testing"
+)
+
+func TestFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		products []common.FalseColorConfig
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "ratio band",
+			products: []common.FalseColorConfig{{Name: "methane", Band: "MT3/CB3"}},
+			want:     []string{"MT3", "CB3"},
+		},
+		{
+			name: "shared filters listed once",
+			products: []common.FalseColorConfig{
+				{Name: "methane", Band: "MT3 / CB3"},
+				{Name: "haze", Red: "IR3", Green: "MT3", Blue: "UV3"},
+			},
+			want: []string{"MT3", "CB3", "IR3", "UV3"},
+		},
+		{name: "no name", products: []common.FalseColorConfig{{Band: "MT3"}}, wantErr: true},
+		{name: "name with a slash", products: []common.FalseColorConfig{{Name: "../methane", Band: "MT3"}}, wantErr: true},
+		{name: "name with a backslash", products: []common.FalseColorConfig{{Name: `sub\methane`, Band: "MT3"}}, wantErr: true},
+		{name: "name with dots", products: []common.FalseColorConfig{{Name: "..", Band: "MT3"}}, wantErr: true},
+		{name: "band and rgb", products: []common.FalseColorConfig{{Name: "both", Band: "MT3", Red: "IR3", Green: "MT3", Blue: "UV3"}}, wantErr: true},
+		{name: "missing blue", products: []common.FalseColorConfig{{Name: "haze", Red: "IR3", Green: "MT3"}}, wantErr: true},
+		{name: "empty ratio", products: []common.FalseColorConfig{{Name: "ratio", Band: "MT3/"}}, wantErr: true},
+		{name: "three way ratio", products: []common.FalseColorConfig{{Name: "ratio", Band: "MT3/CB3/IR3"}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filters, err := Filters(test.products)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Filters() error = %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(filters, test.want) {
+				t.Errorf("Filters() = %v, want %v", filters, test.want)
+			}
+		})
+	}
+}
+
+func TestParseProduct(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    common.FalseColorConfig
+		wantErr bool
+	}{
+		{spec: "MT3/CB3", want: common.FalseColorConfig{Name: "MT3-CB3", Band: "MT3/CB3", Colormap: "inferno"}},
+		{spec: "IR3,MT3,UV3", want: common.FalseColorConfig{Name: "IR3_MT3_UV3", Red: "IR3", Green: "MT3", Blue: "UV3"}},
+		{spec: "IR3/CB3, MT3, UV3", want: common.FalseColorConfig{Name: "IR3-CB3_MT3_UV3", Red: "IR3/CB3", Green: " MT3", Blue: " UV3"}},
+		{spec: "IR3,MT3", wantErr: true},
+		{spec: "../MT3", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			product, err := ParseProduct(test.spec, "inferno")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseProduct() error = %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(product, test.want) {
+				t.Errorf("ParseProduct() = %+v, want %+v", product, test.want)
+			}
+		})
+	}
+}
@@ -6,9 +6,18 @@ import (
 	"github.com/lewchuk/gostitcher/algv1masking"
 	"github.com/lewchuk/gostitcher/algv2blending"
 	"github.com/lewchuk/gostitcher/algv3aligning"
+	"github.com/lewchuk/gostitcher/cameras"
 	"github.com/lewchuk/gostitcher/common"
+	"github.com/lewchuk/gostitcher/falsecolor"
+	"github.com/lewchuk/gostitcher/lrgb"
+	"github.com/lewchuk/gostitcher/mosaic"
 	"github.com/lewchuk/gostitcher/opus"
+	"github.com/lewchuk/gostitcher/polarization"
+	"github.com/lewchuk/gostitcher/postprocess"
+	"github.com/lewchuk/gostitcher/preprocess"
+	"github.com/lewchuk/gostitcher/stack"
 	"os"
+	"strings"
 )
 
 // https://space.stackexchange.com/questions/12510/cassinis-camera-continuum-band-filters
@@ -19,51 +28,553 @@ var FilterMap = map[string]int{
 	common.RED:   647,
 }
 
-func processImages(inputPath string, maxOffset int) error {
+// options holds the settings given on the command line for a local folder. Every
+// setting that was given replaces the one in config.json for the run, settings that
+// weren't given keep the value in config.json. The mode switches enable a mode keeping
+// any settings config.json has for it.
+type options struct {
+	Reference     string
+	Metric        string
+	Search        string
+	Downsample    int
+	MinConfidence float64
+	OutputSurface *bool
+	Tiles         *common.TilesConfig
+	Mosaic        bool
+	FalseColor    []common.FalseColorConfig
+	Polarization  *common.PolarizationConfig
+	Cameras       *common.CamerasConfig
+	Processing    common.ProcessingConfig
+}
+
+// apply replaces the settings of a config with the options that were given.
+// It returns whether an alignment setting changed, in which case the saved offsets
+// were found another way.
+func (o options) apply(config *common.ConfigFile) bool {
+	realign := (o.Reference != "" && o.Reference != config.Reference) ||
+		(o.Metric != "" && o.Metric != config.Metric) ||
+		(o.Search != "" && o.Search != config.Search) ||
+		(o.Downsample != 0 && o.Downsample != config.Downsample)
+
+	config.Merge(o.Processing)
+	if o.Reference != "" {
+		config.Reference = o.Reference
+	}
+	if o.Metric != "" {
+		config.Metric = o.Metric
+	}
+	if o.Search != "" {
+		config.Search = o.Search
+	}
+	if o.Downsample != 0 {
+		config.Downsample = o.Downsample
+	}
+	if o.MinConfidence > 0 {
+		config.MinConfidence = o.MinConfidence
+	}
+	if o.OutputSurface != nil {
+		config.OutputSurface = *o.OutputSurface
+	}
+	if o.Tiles != nil {
+		config.Tiles = o.Tiles
+	}
+	if o.Mosaic && config.Mosaic == nil {
+		config.Mosaic = &common.MosaicConfig{}
+	}
+	if len(o.FalseColor) > 0 {
+		config.FalseColor = o.FalseColor
+	}
+	if o.Polarization != nil {
+		settings := common.PolarizationConfig{}
+		if config.Polarization != nil {
+			settings = *config.Polarization
+		}
+		if len(o.Polarization.Filters) > 0 {
+			settings.Filters = o.Polarization.Filters
+		}
+		if o.Polarization.MaxDegree > 0 {
+			settings.MaxDegree = o.Polarization.MaxDegree
+		}
+		config.Polarization = &settings
+	}
+	if o.Cameras != nil {
+		settings := common.CamerasConfig{}
+		if config.Cameras != nil {
+			settings = *config.Cameras
+		}
+		if o.Cameras.Scale > 0 {
+			settings.Scale = o.Cameras.Scale
+		}
+		config.Cameras = &settings
+	}
+
+	return realign
+}
+
+// modes returns the names of the modes enabled in a config, each of which replaces the
+// composite of the RGB filters.
+func modes(config common.ConfigFile) []string {
+	var enabled []string
+	if config.Mosaic != nil {
+		enabled = append(enabled, "mosaic")
+	}
+	if len(config.FalseColor) > 0 {
+		enabled = append(enabled, "falseColor")
+	}
+	if config.Polarization != nil {
+		enabled = append(enabled, "polarization")
+	}
+	if config.Cameras != nil {
+		enabled = append(enabled, "cameras")
+	}
+	return enabled
+}
+
+// pathOnly returns the names of the options given that only apply to a local folder,
+// which the OPUS API mode can't honour.
+func (o options) pathOnly() []string {
+	var given []string
+	if o.Mosaic {
+		given = append(given, "--mosaic")
+	}
+	if len(o.FalseColor) > 0 {
+		given = append(given, "--false-color")
+	}
+	if o.Processing.HDR != nil {
+		given = append(given, "--hdr")
+	}
+	if o.Processing.Drizzle != nil {
+		given = append(given, "--drizzle")
+	}
+	if o.Processing.Sharpen != nil {
+		given = append(given, "--sharpen")
+	}
+	if o.Processing.LRGB != nil {
+		given = append(given, "--lrgb")
+	}
+	return given
+}
+
+// processImages combines the images of a local folder with the settings of its
+// config.json, replaced by the options given.
+func processImages(inputPath string, maxOffset int, opts options) error {
 	fmt.Printf("Processing: %s\n", inputPath)
 
 	config, err := common.LoadConfig(inputPath)
-
-	imageMap, err := common.LoadImages(config, inputPath)
 	if err != nil {
 		return err
 	}
+	if opts.apply(&config) {
+		// The saved offsets were found another way so align again.
+		config.MaxOffset = 0
+		for i := range config.Files {
+			config.Files[i].Alignment = nil
+		}
+	}
 
-	if err = algv1masking.CombineImages(imageMap, inputPath); err != nil {
+	if err := postprocess.CheckTiles(config); err != nil {
 		return err
 	}
+	if config.Sharpen != nil {
+		if err := postprocess.CheckSharpen(*config.Sharpen); err != nil {
+			return err
+		}
+	}
 
-	if err = algv2blending.CombineImages(imageMap, inputPath); err != nil {
-		return err
+	enabled := modes(config)
+	if len(enabled) > 1 {
+		return fmt.Errorf("only one of mosaic, falseColor, polarization or cameras can be used at a time, found %v", enabled)
+	}
+	if len(enabled) == 1 {
+		switch enabled[0] {
+		case "mosaic":
+			return processMosaic(inputPath, maxOffset, config)
+		case "falseColor":
+			return processFalseColor(inputPath, maxOffset, config)
+		case "polarization":
+			return processPolarization(inputPath, maxOffset, config)
+		case "cameras":
+			return processCameras(inputPath, config)
+		}
+	}
+
+	combiners := 0
+	for _, enabled := range []bool{config.Stack != nil, config.HDR != nil, config.Drizzle != nil} {
+		if enabled {
+			combiners++
+		}
+	}
+	if combiners > 1 {
+		return fmt.Errorf("frames can only be combined one way: stack, hdr or drizzle")
+	}
+
+	var imageMap common.ImageMap
+	if combiners > 0 {
+		stacks, err := common.LoadStacks(config, inputPath)
+		if err != nil {
+			return err
+		}
+		if err := preprocess.ApplyStacks(config, stacks, inputPath); err != nil {
+			return err
+		}
+		switch {
+		case config.HDR != nil:
+			imageMap, err = stack.ApplyHDR(config, stacks)
+		case config.Drizzle != nil:
+			imageMap, err = stack.ApplyDrizzle(config, stacks)
+		default:
+			imageMap, err = stack.Apply(config, stacks)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		if imageMap, err = common.LoadImages(config, inputPath); err != nil {
+			return err
+		}
+		if err = preprocess.Apply(config, imageMap, inputPath); err != nil {
+			return err
+		}
+	}
+
+	// The unaligned composites are built in memory, so they are skipped when the output
+	// is too large and is streamed to tiles instead.
+	if config.Tiles == nil {
+		if err = algv1masking.CombineImages(config, imageMap, inputPath); err != nil {
+			return err
+		}
+
+		if err = algv2blending.CombineImages(config, imageMap, inputPath); err != nil {
+			return err
+		}
 	}
 
 	if err = algv3aligning.CombineAndAlignImages(config, imageMap, maxOffset, inputPath); err != nil {
 		return err
 	}
 
+	if config.LRGB != nil {
+		if err = lrgb.CombineImages(config, imageMap, inputPath); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// processMosaic stitches the frames of a local folder into a mosaic.
+func processMosaic(inputPath string, maxOffset int, config common.ConfigFile) error {
+	frames, err := common.LoadFrames(config, inputPath)
+	if err != nil {
+		return err
+	}
+
+	for _, frame := range frames {
+		if err := preprocess.Apply(config, frame, inputPath); err != nil {
+			return err
+		}
+	}
+
+	return mosaic.CombineImages(config, frames, maxOffset, inputPath)
+}
+
+// processFalseColor makes the false color products of a local folder from the images of
+// the filters they use.
+func processFalseColor(inputPath string, maxOffset int, config common.ConfigFile) error {
+	filters, err := falsecolor.Filters(config.FalseColor)
+	if err != nil {
+		return err
+	}
+	imageMap, err := common.LoadFilters(config, inputPath, filters)
+	if err != nil {
+		return err
+	}
+
+	if err := preprocess.Apply(config, imageMap, inputPath); err != nil {
+		return err
+	}
+
+	return falsecolor.CombineImages(config, imageMap, maxOffset, inputPath)
+}
+
+// processPolarization combines the polarizer images of a local folder into intensity and
+// polarization maps.
+func processPolarization(inputPath string, maxOffset int, config common.ConfigFile) error {
+	filters, err := polarization.Filters(*config.Polarization, config.Files)
+	if err != nil {
+		return err
+	}
+	imageMap, err := common.LoadFilters(config, inputPath, filters)
+	if err != nil {
+		return err
+	}
+
+	if err := preprocess.Apply(config, imageMap, inputPath); err != nil {
+		return err
+	}
+
+	return polarization.CombineImages(config, imageMap, filters, maxOffset, inputPath)
+}
+
+// processCameras colors the detail of the narrow angle frames of a local folder with the
+// wide angle frames around them.
+func processCameras(inputPath string, config common.ConfigFile) error {
+	wideConfig, narrowConfig, err := cameras.Split(config)
+	if err != nil {
+		return err
+	}
+	wide, err := common.LoadImages(wideConfig, inputPath)
+	if err != nil {
+		return err
+	}
+	narrow, err := common.LoadFilters(narrowConfig, inputPath, cameras.DetailFilters(narrowConfig.Files))
+	if err != nil {
+		return err
+	}
+
+	for _, imageMap := range []common.ImageMap{wide, narrow} {
+		if err := preprocess.Apply(config, imageMap, inputPath); err != nil {
+			return err
+		}
+	}
+
+	_, _, err = cameras.CombineImages(config, wide, narrow, inputPath, "output_cameras")
+	return err
+}
+
+// parseFilterFiles parses a list of files of filters given as FILTER=file separated by
+// commas.
+// It returns a map of filters to files and any error encountered.
+func parseFilterFiles(value string) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("parsing %q, expected FILTER=file separated by commas", value)
+		}
+		files[parts[0]] = parts[1]
+	}
+	return files, nil
+}
+
+// parseRect parses a rectangle given as x,y,width,height.
+func parseRect(value string) (common.Rect, error) {
+	var rect common.Rect
+	_, err := fmt.Sscanf(value, "%d,%d,%d,%d", &rect.X, &rect.Y, &rect.Width, &rect.Height)
+	if err != nil {
+		return rect, fmt.Errorf("parsing rectangle %q, expected x,y,width,height: %s", value, err)
+	}
+	return rect, nil
+}
+
 func main() {
 	pathPtr := flag.String("path", "", "path to a local folder with images and config.json. "+
 		"Not compatible with the --api flag and will override any other flags if present.")
 	alignPtr := flag.Int("align", 0, "max offsets to try and align images, only valid with --path")
+	referencePtr := flag.String("reference", "", "filter to align the others to: 'BL1' (default), 'GRN', 'RED' or 'auto' for the sharpest, only valid with --path and --align")
+	metricPtr := flag.String("metric", "", "alignment cost: 'sad' (default), 'ncc', 'mi' or 'gradient', only valid with --path and --align")
+	searchPtr := flag.String("search", "", "alignment search: 'exhaustive' (default) or 'descent', only valid with --path and --align")
+	downsamplePtr := flag.Int("downsample", 0, "find offsets on images shrunk by this factor before refining them at full resolution, only valid with --path and --align")
+	surfacePtr := flag.Bool("surface", false, "write the alignment cost surfaces as CSV files and heatmaps, only valid with --path and --align")
+	minConfidencePtr := flag.Float64("min-confidence", 0, "reject aligned composites when an alignment confidence (0-1) is below this value, only valid with --path")
+	tilesPtr := flag.String("tiles", "", "stream the aligned composite tile by tile to a .tif file or a directory of tiles, relative to --path (optional).")
+	tileSizePtr := flag.Int("tile-size", common.DefaultTileSize, "width and height of the tiles written by --tiles.")
+	falseColorPtr := flag.String("false-color", "", "make a false color image of --path instead of compositing the RGB filters from a band such as 'MT3' or a ratio such as 'MT3/CB3' mapped through --colormap, or red, green and blue bands separated by commas such as 'IR3,MT3,CB3' (optional).")
+	colormapPtr := flag.String("colormap", "viridis", "colormap a single --false-color band is mapped through: 'viridis', 'inferno', 'magma', 'jet' or 'gray'.")
+	polarizationPtr := flag.String("polarization", "", "combine polarizer images into intensity and polarization maps instead of compositing the RGB filters: 'visible' for P0, P60 and P120, 'infrared' for IRP0 and IRP90 or 'auto' for whichever config.json has (optional).")
+	maxDegreePtr := flag.Float64("max-degree", 0, "degree of polarization (0-1) shown fully saturated by --polarization, the 99th percentile by default.")
+	mosaicPtr := flag.Bool("mosaic", false, "stitch the frames of --path into a mosaic instead of compositing a single frame, searching --align pixels around their positions in config.json.")
 	apiPtr := flag.String("api", "", "use the OPUS API to pull down Cassini images to combine. Provide the output folder to place the images in.")
-	cameraPtr := flag.String("camera", "narrow", "either 'narrow' (default) or 'wide' to select which Cassini camera. The same observation often includes images from both cameras so they cannot be fetched at once.")
+	cameraPtr := flag.String("camera", "narrow", "either 'narrow' (default) or 'wide' to select which Cassini camera, or 'both' to color the detail of the narrow angle frames of each observation with the wide angle frames around them. Also combines the files of both cameras of --path with 'both'.")
+	cameraScalePtr := flag.Float64("camera-scale", 0, "size of a narrow angle pixel in wide angle pixels for --camera both, 0.1 for full frames of the same size by default.")
 	targetPtr := flag.String("target", "", "the target filter for the OPUS API (optional).")
 	observationPtr := flag.String("observation", "", "the observation name for the OPUS API (optional).")
 	extraPtr := flag.String("extra", "", "extra filters to add to the search URL, e.g. planet=Jupiter.")
+	stackPtr := flag.String("stack", "", "register and stack all the frames of each filter: 'mean', 'median' or 'sigma' for a sigma clipped mean (optional).")
+	stackSigmaPtr := flag.Float64("stack-sigma", 3, "clipping threshold for --stack sigma in standard deviations.")
+	stackAlignPtr := flag.Int("stack-align", 10, "max offset to search when registering the frames of a filter for --stack, --hdr or --drizzle.")
+	hdrPtr := flag.String("hdr", "", "merge the frames of each filter by their exposures in config.json and tone map them: 'reinhard', 'log' or 'linear' (optional).")
+	hdrKeyPtr := flag.Float64("hdr-key", 0.18, "brightness (0-1) the average of the scene is mapped to by --hdr reinhard.")
+	drizzlePtr := flag.Float64("drizzle", 0, "drizzle the frames of each filter onto a grid this many times finer than the frames (optional).")
+	pixfracPtr := flag.Float64("pixfrac", 0.7, "fraction of an input pixel each pixel is shrunk to before --drizzle drops it on the finer grid.")
+	cosmicPtr := flag.String("cosmic", "", "remove cosmic rays and hot pixels from each filter image: 'median' or 'laplacian' (optional).")
+	cosmicSigmaPtr := flag.Float64("cosmic-sigma", 5, "detection threshold for --cosmic in standard deviations of the noise.")
+	cosmicMaskPtr := flag.Bool("cosmic-mask", false, "write an image of the pixels replaced by --cosmic for each filter.")
+	backgroundPtr := flag.String("background", "", "background subtracted from each filter image: 'sky' or 'polynomial' (optional).")
+	backgroundOrderPtr := flag.Int("background-order", 2, "order of the polynomial used by --background polynomial.")
+	backgroundOutputPtr := flag.Bool("background-output", false, "write the background model of each filter for inspection.")
+	denoisePtr := flag.String("denoise", "", "reduce the noise of each filter image: 'bilateral', 'nlm' for non-local means or 'wavelet' (optional).")
+	denoiseStrengthPtr := flag.Float64("denoise-strength", 1, "how aggressively --denoise removes noise relative to the estimated noise level.")
+	lrgbPtr := flag.String("lrgb", "", "also combine a CL1 or CL2 clear image as the luminance with the color of the RGB images, replacing the lightness in 'lab' or 'hsl' (optional).")
+	luminancePtr := flag.String("luminance", "", "clear filter used as the luminance by --lrgb: 'CL1' or 'CL2', the first present by default.")
+	lrgbAlignPtr := flag.Int("lrgb-align", 10, "max offset to search when aligning the RGB images to the luminance for --lrgb.")
+	edgesPtr := flag.String("edges", "", "how aligned composites treat edges where images don't overlap: 'crop' to the overlap or 'pad' with --fill (optional).")
+	fillPtr := flag.String("fill", "0,0,0", "color used for missing pixels by --edges pad as r,g,b.")
+	sharpenPtr := flag.String("sharpen", "", "sharpen each channel of composites: 'richardson-lucy' deconvolution of a gaussian PSF or 'unsharp' masking (optional).")
+	sharpenSigmaPtr := flag.Float64("sharpen-sigma", 1, "standard deviation in pixels of the PSF deconvolved or the blur used by --sharpen unsharp.")
+	sharpenIterationsPtr := flag.Int("sharpen-iterations", 10, "number of iterations of --sharpen richardson-lucy.")
+	sharpenAmountPtr := flag.Float64("sharpen-amount", 1, "strength of --sharpen unsharp.")
+	stretchPtr := flag.String("stretch", "", "contrast stretch applied to composites: 'linear', 'gamma', 'asinh' or 'clahe' (optional).")
+	stretchLowPtr := flag.Float64("stretch-low", 0.5, "percentile mapped to black by --stretch.")
+	stretchHighPtr := flag.Float64("stretch-high", 99.5, "percentile mapped to white by --stretch.")
+	gammaPtr := flag.Float64("gamma", 2.2, "display gamma used by --stretch gamma.")
+	perChannelPtr := flag.Bool("per-channel", false, "stretch each channel independently instead of preserving color ratios.")
+	whiteBalancePtr := flag.String("white-balance", "", "white balance applied to composites: 'gray-world', 'region' or 'filter' (optional).")
+	regionPtr := flag.String("wb-region", "", "region that should be neutral for --white-balance region as x,y,width,height.")
+	curvesPtr := flag.String("wb-curves", "", "transmission curve files of the RGB filters for --white-balance filter as BL1=<file>,GRN=<file>,RED=<file>, relative to --path.")
+	spectrumPtr := flag.String("wb-spectrum", "", "spectrum file, such as the solar spectrum, the curves of --wb-curves are weighted by, relative to --path (optional).")
 
 	flag.Parse()
 
+	var processing common.ProcessingConfig
+	if *stackPtr != "" {
+		processing.Stack = &common.StackConfig{
+			Method:    *stackPtr,
+			Sigma:     *stackSigmaPtr,
+			MaxOffset: *stackAlignPtr,
+		}
+	}
+	if *hdrPtr != "" {
+		processing.HDR = &common.HDRConfig{
+			ToneMap:   *hdrPtr,
+			Key:       *hdrKeyPtr,
+			MaxOffset: *stackAlignPtr,
+		}
+	}
+	if *drizzlePtr != 0 {
+		processing.Drizzle = &common.DrizzleConfig{
+			Scale:     *drizzlePtr,
+			PixFrac:   *pixfracPtr,
+			MaxOffset: *stackAlignPtr,
+		}
+	}
+	if *cosmicPtr != "" {
+		processing.Cosmic = &common.CosmicConfig{
+			Method: *cosmicPtr,
+			Sigma:  *cosmicSigmaPtr,
+			Mask:   *cosmicMaskPtr,
+		}
+	}
+	if *backgroundPtr != "" {
+		processing.Background = &common.BackgroundConfig{
+			Mode:   *backgroundPtr,
+			Order:  *backgroundOrderPtr,
+			Output: *backgroundOutputPtr,
+		}
+	}
+	if *denoisePtr != "" {
+		processing.Denoise = &common.DenoiseConfig{
+			Method:   *denoisePtr,
+			Strength: *denoiseStrengthPtr,
+		}
+	}
+	if *lrgbPtr != "" {
+		processing.LRGB = &common.LRGBConfig{
+			Space:     *lrgbPtr,
+			Luminance: *luminancePtr,
+			MaxOffset: *lrgbAlignPtr,
+		}
+	}
+	if *edgesPtr != "" {
+		processing.Edges = &common.EdgesConfig{Mode: *edgesPtr}
+		var r, g, b int
+		if _, err := fmt.Sscanf(*fillPtr, "%d,%d,%d", &r, &g, &b); err != nil {
+			fmt.Printf("parsing fill color %q, expected r,g,b: %s\n", *fillPtr, err)
+			os.Exit(1)
+		}
+		processing.Edges.Fill = []int{r, g, b}
+	}
+	if *sharpenPtr != "" {
+		processing.Sharpen = &common.SharpenConfig{
+			Method:     *sharpenPtr,
+			Sigma:      *sharpenSigmaPtr,
+			Iterations: *sharpenIterationsPtr,
+			Amount:     *sharpenAmountPtr,
+		}
+	}
+	if *stretchPtr != "" {
+		processing.Stretch = &common.StretchConfig{
+			Method:     *stretchPtr,
+			Low:        *stretchLowPtr,
+			High:       *stretchHighPtr,
+			Gamma:      *gammaPtr,
+			PerChannel: *perChannelPtr,
+		}
+	}
+	if *whiteBalancePtr != "" {
+		processing.WhiteBalance = &common.WhiteBalanceConfig{Mode: *whiteBalancePtr}
+		if *regionPtr != "" {
+			region, err := parseRect(*regionPtr)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			processing.WhiteBalance.Region = &region
+		}
+		if *curvesPtr != "" {
+			curves, err := parseFilterFiles(*curvesPtr)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			processing.WhiteBalance.Curves = curves
+		}
+		processing.WhiteBalance.Spectrum = *spectrumPtr
+	}
+
+	opts := options{
+		Reference:     *referencePtr,
+		Metric:        *metricPtr,
+		Search:        *searchPtr,
+		Downsample:    *downsamplePtr,
+		MinConfidence: *minConfidencePtr,
+		Mosaic:        *mosaicPtr,
+		Processing:    processing,
+	}
+	// --surface is only given when set, so --surface=false can turn it off.
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "surface" {
+			opts.OutputSurface = surfacePtr
+		}
+	})
+	if *falseColorPtr != "" {
+		product, err := falsecolor.ParseProduct(*falseColorPtr, *colormapPtr)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		opts.FalseColor = []common.FalseColorConfig{product}
+	}
+	if *polarizationPtr != "" {
+		opts.Polarization = &common.PolarizationConfig{MaxDegree: *maxDegreePtr}
+		switch *polarizationPtr {
+		case "visible":
+			opts.Polarization.Filters = common.PolarizerFilters[:]
+		case "infrared":
+			opts.Polarization.Filters = common.IRPolarizerFilters[:]
+		case "auto":
+		default:
+			fmt.Printf("--polarization must be 'visible', 'infrared' or 'auto': %s\n", *polarizationPtr)
+			os.Exit(1)
+		}
+	}
+	if *cameraPtr == "both" {
+		opts.Cameras = &common.CamerasConfig{Scale: *cameraScalePtr}
+	}
+	if *tilesPtr != "" {
+		opts.Tiles = &common.TilesConfig{Size: *tileSizePtr, Output: *tilesPtr}
+	}
+
 	var err error
 	if *pathPtr != "" {
-		err = processImages(*pathPtr, *alignPtr)
+		err = processImages(*pathPtr, *alignPtr, opts)
 	} else if *apiPtr != "" {
-		if *cameraPtr != "narrow" && *cameraPtr != "wide" {
-			err = fmt.Errorf("--camera must be either 'narrow' or 'wide': %s", *cameraPtr)
+		if *cameraPtr != "narrow" && *cameraPtr != "wide" && *cameraPtr != "both" {
+			err = fmt.Errorf("--camera must be 'narrow', 'wide' or 'both': %s", *cameraPtr)
+		} else if given := opts.pathOnly(); len(given) > 0 {
+			err = fmt.Errorf("%s can only be used with --path", strings.Join(given, ", "))
 		} else {
-			err = opus.ProcessImages(*apiPtr, *cameraPtr, *targetPtr, *observationPtr, *extraPtr)
+			err = opus.ProcessImages(*apiPtr, *cameraPtr, *targetPtr, *observationPtr, *extraPtr, processing, opts.Polarization, opts.Cameras)
 		}
 	} else {
 		err = fmt.Errorf("Either --path parameter or --api flag must be provided.")
@@ -0,0 +1,207 @@
+// A package containing the functions for combining a clear filter image, used as the
+// luminance, with the color of the RGB images.
+package lrgb
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/algv3aligning"
+	"github.com/lewchuk/gostitcher/common"
+	"github.com/lewchuk/gostitcher/postprocess"
+	"image"
+	"path"
+)
+
+// The supported color spaces the luminance is replaced in.
+const (
+	LAB = "lab"
+	HSL = "hsl"
+)
+
+// lrgbDefaults fills in any unset LRGB parameters.
+func lrgbDefaults(config common.LRGBConfig) common.LRGBConfig {
+	if config.Space == "" {
+		config.Space = LAB
+	}
+	if config.MaxOffset == 0 {
+		config.MaxOffset = 10
+	}
+	return config
+}
+
+// luminanceFilter resolves the clear filter used as the luminance, the first clear filter
+// in the image map when none is named.
+// It returns the filter and any error encountered.
+func luminanceFilter(imageMap common.ImageMap, name string) (string, error) {
+	if name != "" {
+		for _, filter := range common.ClearFilters {
+			if filter != name {
+				continue
+			}
+			if _, ok := imageMap[filter]; !ok {
+				return "", fmt.Errorf("no %s image to use as the luminance", filter)
+			}
+			return filter, nil
+		}
+		return "", fmt.Errorf("unknown luminance filter %q, expected one of %v", name, common.ClearFilters)
+	}
+
+	for _, filter := range common.ClearFilters {
+		if _, ok := imageMap[filter]; ok {
+			return filter, nil
+		}
+	}
+	return "", fmt.Errorf("lrgb needs a clear image, one of %v", common.ClearFilters)
+}
+
+// colorOverlap returns the region of the composite covered by all the RGB images.
+func colorOverlap(imageMap common.ImageMap) image.Rectangle {
+	bounds := imageMap[common.BLUE].Image.Bounds().Add(imageMap[common.BLUE].Config.Offset())
+	for _, filter := range common.Filters {
+		bounds = bounds.Intersect(imageMap[filter].Image.Bounds().Add(imageMap[filter].Config.Offset()))
+	}
+	return bounds
+}
+
+// fitLuminance finds the gain and offset that best map the source lightness to the target
+// lightness within bounds in the least squares sense, so the clear image takes the
+// brightness of the color image.
+// It returns the gain, the offset and any error encountered.
+func fitLuminance(source, target *common.Plane, bounds image.Rectangle) (float64, float64, error) {
+	var sumS, sumT, sumSS, sumST, n float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			s, t := source.At(x, y), target.At(x, y)
+			sumS += s
+			sumT += t
+			sumSS += s * s
+			sumST += s * t
+			n++
+		}
+	}
+	variance := n*sumSS - sumS*sumS
+	if n == 0 || variance <= 0 {
+		return 0, 0, fmt.Errorf("the luminance image is flat where it overlaps the color images")
+	}
+	gain := (n*sumST - sumS*sumT) / variance
+	return gain, (sumT - gain*sumS) / n, nil
+}
+
+// Combine replaces the lightness of a color composite with the lightness of a clear image
+// in the Lab or HSL color space, keeping the hue and saturation of the composite. The
+// clear image is fitted to the brightness of the composite over overlap, the region
+// covered by all the color images, and padded pixels outside it are left as they are.
+// It returns the combined image, the gain and offset applied to the clear lightness and
+// any error encountered.
+func Combine(composite *image.RGBA, clear common.LoadedConfig, overlap image.Rectangle, space string) (*image.RGBA, float64, float64, error) {
+	var toSpace func(r, g, b float64) (float64, float64, float64)
+	var fromSpace func(l, c1, c2 float64) (float64, float64, float64)
+	var maxLightness float64
+	switch space {
+	case LAB:
+		toSpace, fromSpace, maxLightness = common.RGBToLab, common.LabToRGB, 100
+	case HSL:
+		toSpace = func(r, g, b float64) (float64, float64, float64) {
+			h, s, l := common.RGBToHSL(r, g, b)
+			return l, h, s
+		}
+		fromSpace = func(l, h, s float64) (float64, float64, float64) {
+			return common.HSLToRGB(h, s, l)
+		}
+		maxLightness = 1
+	default:
+		return nil, 0, 0, fmt.Errorf("unknown lrgb color space %q, expected %s or %s", space, LAB, HSL)
+	}
+
+	bounds := composite.Bounds()
+	planes := common.PlanesFromRGBA(composite)
+	colorPlanes := [3]*common.Plane{common.NewPlane(bounds), common.NewPlane(bounds), common.NewPlane(bounds)}
+	lightness := common.NewPlane(bounds)
+	clearPlane := common.PlaneFromGray(clear.Image)
+	offset := clear.Config.Offset()
+	common.ParallelRows(bounds, func(_ int, rows image.Rectangle) {
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := rows.Min.X; x < rows.Max.X; x++ {
+				l, c1, c2 := toSpace(planes[0].At(x, y), planes[1].At(x, y), planes[2].At(x, y))
+				colorPlanes[0].Set(x, y, l)
+				colorPlanes[1].Set(x, y, c1)
+				colorPlanes[2].Set(x, y, c2)
+				// The clear image is gray, so its lightness is that of a gray of its value.
+				v := clearPlane.ClampedAt(x-offset.X, y-offset.Y)
+				clearL, _, _ := toSpace(v, v, v)
+				lightness.Set(x, y, clearL)
+			}
+		}
+	})
+
+	gain, shift, err := fitLuminance(lightness, colorPlanes[0], overlap.Intersect(bounds))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	common.ParallelRows(bounds, func(_ int, rows image.Rectangle) {
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := rows.Min.X; x < rows.Max.X; x++ {
+				if !image.Pt(x, y).In(overlap) {
+					continue
+				}
+				l := common.Clamp(gain*lightness.At(x, y)+shift, 0, maxLightness)
+				r, g, b := fromSpace(l, colorPlanes[1].At(x, y), colorPlanes[2].At(x, y))
+				planes[0].Set(x, y, r)
+				planes[1].Set(x, y, g)
+				planes[2].Set(x, y, b)
+			}
+		}
+	})
+
+	return common.RGBAFromPlanes(planes), gain, shift, nil
+}
+
+// CombineImages aligns the RGB images to the clear luminance image, blends them into a
+// color composite and replaces its lightness with that of the clear image, writing the
+// result to output_lrgb.jpg. The alignment uses normalized cross correlation unless
+// another metric is configured, as the clear image is much brighter than the others,
+// and leaves the offsets in the image map and config.json untouched.
+// Returns any errors from aligning, combining or writing the image.
+func CombineImages(config common.ConfigFile, imageMap common.ImageMap, root string) error {
+	settings := lrgbDefaults(*config.LRGB)
+	luminance, err := luminanceFilter(imageMap, settings.Luminance)
+	if err != nil {
+		return fmt.Errorf("%s: %s", root, err)
+	}
+
+	aligned := make(common.ImageMap)
+	for filter, loaded := range imageMap {
+		aligned[filter] = loaded
+	}
+	metric := config.Metric
+	if metric == "" {
+		metric = "ncc"
+	}
+	if _, err := algv3aligning.AlignImages(&aligned, settings.MaxOffset, luminance, nil, config.Downsample, metric, config.Search); err != nil {
+		return err
+	}
+	for _, filter := range common.Filters {
+		fmt.Println(algv3aligning.DescribeQuality(aligned[filter]))
+	}
+
+	composite, err := algv3aligning.CombineImages(aligned, luminance, config.Edges)
+	if err != nil {
+		return err
+	}
+	combined, gain, shift, err := Combine(composite.(*image.RGBA), aligned[luminance], colorOverlap(aligned), settings.Space)
+	if err != nil {
+		return fmt.Errorf("%s: %s", root, err)
+	}
+	fmt.Printf("Luminance %s scaled by %.3f and shifted by %.3f\n", luminance, gain, shift)
+
+	meta := common.NewMetadata("lrgb", config, aligned)
+	meta.SetParameter("luminance", luminance)
+	meta.SetParameter("space", settings.Space)
+	meta.SetParameter("maxOffset", settings.MaxOffset)
+	output, err := postprocess.Apply(config, combined, meta, root)
+	if err != nil {
+		return err
+	}
+
+	return common.WriteImage(path.Join(root, "output_lrgb.jpg"), output, meta)
+}
@@ -0,0 +1,127 @@
+package lrgb
+
+import (
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestFitLuminance(t *testing.T) {
+	bounds := image.Rect(0, 0, 8, 4)
+	ramp := common.NewPlane(bounds)
+	for i := range ramp.Pix {
+		ramp.Pix[i] = float64(i) / 32
+	}
+
+	tests := []struct {
+		name       string
+		source     *common.Plane
+		gain       float64
+		offset     float64
+		bounds     image.Rectangle
+		wantErr    bool
+		wantGain   float64
+		wantOffset float64
+	}{
+		{name: "identity", source: ramp, gain: 1, bounds: bounds, wantGain: 1},
+		{name: "gain and offset", source: ramp, gain: 2, offset: 3, bounds: bounds, wantGain: 2, wantOffset: 3},
+		{name: "inverted", source: ramp, gain: -0.5, offset: 1, bounds: image.Rect(2, 1, 6, 3), wantGain: -0.5, wantOffset: 1},
+		{name: "flat source", source: common.NewPlane(bounds), gain: 1, bounds: bounds, wantErr: true},
+		{name: "no overlap", source: ramp, gain: 1, bounds: image.Rectangle{}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := common.NewPlane(bounds)
+			for i, v := range test.source.Pix {
+				target.Pix[i] = test.gain*v + test.offset
+			}
+			gain, offset, err := fitLuminance(test.source, target, test.bounds)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("fitLuminance() error = %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if math.Abs(gain-test.wantGain) > 1e-9 || math.Abs(offset-test.wantOffset) > 1e-9 {
+				t.Errorf("fitLuminance() = %g, %g, want %g, %g", gain, offset, test.wantGain, test.wantOffset)
+			}
+		})
+	}
+}
+
+// colorComposite returns a composite with a gradient of colors.
+func colorComposite() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 12))
+	for y := 0; y < 12; y++ {
+		for x := 0; x < 16; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(40 + 12*x), uint8(30 + 15*y), uint8(200 - 8*x), 255})
+		}
+	}
+	return img
+}
+
+// matchingClear returns the clear image whose lightness in a color space matches the
+// composite's, so combining them should give back the composite.
+func matchingClear(composite *image.RGBA, space string) common.LoadedConfig {
+	bounds := composite.Bounds()
+	clear := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := composite.RGBAAt(x, y)
+			r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+			var v float64
+			switch space {
+			case LAB:
+				l, _, _ := common.RGBToLab(r, g, b)
+				v, _, _ = common.LabToRGB(l, 0, 0)
+			case HSL:
+				_, _, v = common.RGBToHSL(r, g, b)
+			}
+			clear.SetGray(x, y, color.Gray{uint8(math.Round(255 * v))})
+		}
+	}
+	return common.LoadedConfig{Config: common.ImageConfig{Filter: common.CLEAR1}, Image: clear}
+}
+
+func TestCombine(t *testing.T) {
+	tests := []struct {
+		name    string
+		space   string
+		overlap image.Rectangle
+		wantErr bool
+	}{
+		{name: "lab", space: LAB, overlap: image.Rect(0, 0, 16, 12)},
+		{name: "hsl", space: HSL, overlap: image.Rect(0, 0, 16, 12)},
+		{name: "lab within an overlap", space: LAB, overlap: image.Rect(2, 3, 14, 10)},
+		{name: "unknown space", space: "hsv", overlap: image.Rect(0, 0, 16, 12), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			composite := colorComposite()
+			combined, gain, shift, err := Combine(composite, matchingClear(composite, test.space), test.overlap, test.space)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Combine() error = %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+
+			maxLightness := 1.0
+			if test.space == LAB {
+				maxLightness = 100
+			}
+			if math.Abs(gain-1) > 0.02 || math.Abs(shift) > 0.01*maxLightness {
+				t.Errorf("gain and shift = %g, %g, want 1 and 0", gain, shift)
+			}
+			for i, v := range composite.Pix {
+				if d := math.Abs(float64(combined.Pix[i]) - float64(v)); d > 2 {
+					t.Fatalf("combined byte %d = %d, want %d", i, combined.Pix[i], v)
+				}
+			}
+		})
+	}
+}
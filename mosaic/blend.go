@@ -0,0 +1,81 @@
+package mosaic
+
+import (
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"math"
+)
+
+// canvasBounds returns the region covered by any image of any frame.
+func canvasBounds(frames []common.ImageMap) image.Rectangle {
+	var bounds image.Rectangle
+	for _, frame := range frames {
+		for _, loaded := range frame {
+			bounds = bounds.Union(shiftedBounds(loaded))
+		}
+	}
+	return bounds
+}
+
+// featherWeight weights a pixel of an image by its distance from the nearest edge so
+// seams fade from one frame into the next. Distances beyond feather pixels all weigh
+// the same, a feather of 0 keeps rising to the center of the image.
+func featherWeight(bounds image.Rectangle, x, y, feather int) float64 {
+	distance := x - bounds.Min.X
+	for _, d := range []int{bounds.Max.X - 1 - x, y - bounds.Min.Y, bounds.Max.Y - 1 - y} {
+		if d < distance {
+			distance = d
+		}
+	}
+	if feather > 0 && distance >= feather {
+		distance = feather - 1
+	}
+	return float64(distance + 1)
+}
+
+// Blend composites the part of the mosaic within r, blending the frames of each filter
+// with feathered weights and combining the filters into a color image. Pixels no frame
+// covers are black.
+// It returns the generated image.
+func Blend(frames []common.ImageMap, r image.Rectangle, feather int) *image.RGBA {
+	composedImage := image.NewRGBA(r)
+	common.ParallelRows(r, func(_ int, rows image.Rectangle) {
+		sums := make([]float64, rows.Dx())
+		weights := make([]float64, rows.Dx())
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			// Red, green and blue are stored in that order in each RGBA pixel.
+			for channel, filter := range []string{common.RED, common.GREEN, common.BLUE} {
+				for i := range sums {
+					sums[i], weights[i] = 0, 0
+				}
+				for _, frame := range frames {
+					loaded := frame[filter]
+					bounds := shiftedBounds(loaded)
+					span := bounds.Intersect(image.Rect(rows.Min.X, y, rows.Max.X, y+1))
+					if span.Empty() {
+						continue
+					}
+					src := loaded.Image.PixOffset(span.Min.X-loaded.Config.OffsetX, y-loaded.Config.OffsetY)
+					for x := span.Min.X; x < span.Max.X; x, src = x+1, src+1 {
+						weight := featherWeight(bounds, x, y, feather)
+						sums[x-rows.Min.X] += weight * float64(loaded.Image.Pix[src])
+						weights[x-rows.Min.X] += weight
+					}
+				}
+
+				dst := composedImage.PixOffset(rows.Min.X, y) + channel
+				for i := range sums {
+					if weights[i] > 0 {
+						composedImage.Pix[dst] = uint8(math.Round(sums[i] / weights[i]))
+					}
+					dst += 4
+				}
+			}
+			dst := composedImage.PixOffset(rows.Min.X, y) + 3
+			for i := 0; i < rows.Dx(); i, dst = i+1, dst+4 {
+				composedImage.Pix[dst] = 255
+			}
+		}
+	})
+	return composedImage
+}
@@ -0,0 +1,267 @@
+// A package containing the functions to stitch the frames of overlapping pointings into a mosaic.
+package mosaic
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/algv3aligning"
+	"github.com/lewchuk/gostitcher/common"
+	"github.com/lewchuk/gostitcher/postprocess"
+	"image"
+	"math"
+	"path"
+)
+
+// Defaults for the mosaic settings that aren't given in the config.
+const (
+	defaultMinOverlap     = 0.1
+	defaultMinCorrelation = 0.5
+)
+
+// How strongly frames are held at their starting positions relative to the measured
+// offsets. The first frame is held firmly so the mosaic doesn't drift, the others only
+// enough to place frames that don't overlap any other.
+const (
+	anchorWeight = 1e3
+	priorWeight  = 1e-3
+)
+
+// pairOffset is a measured offset between the positions of two frames.
+type pairOffset struct {
+	from, to int
+	offset   image.Point
+	weight   float64
+}
+
+// shiftedBounds returns the bounds an image covers on the canvas.
+func shiftedBounds(loaded common.LoadedConfig) image.Rectangle {
+	return loaded.Image.Bounds().Add(loaded.Config.Offset())
+}
+
+// area returns the number of pixels in a rectangle.
+func area(r image.Rectangle) float64 {
+	return float64(r.Dx() * r.Dy())
+}
+
+// withinOverlap wraps a metric so offsets where the images share less than minOverlap
+// of the smaller image get an infinite cost, stopping small overlaps at the edge of the
+// search from matching by chance. The cost isn't NaN as searches take NaN to mean an
+// offset they haven't evaluated yet.
+func withinOverlap(metric algv3aligning.Metric, minOverlap float64) algv3aligning.Metric {
+	cost := metric.Cost
+	metric.Cost = func(baseImage, layerImage common.LoadedConfig, mask *image.Alpha) float64 {
+		baseBounds, layerBounds := shiftedBounds(baseImage), shiftedBounds(layerImage)
+		if area(baseBounds.Intersect(layerBounds)) < minOverlap*math.Min(area(baseBounds), area(layerBounds)) {
+			return math.Inf(1)
+		}
+		return cost(baseImage, layerImage, mask)
+	}
+	return metric
+}
+
+// measureOffsets aligns every pair of frames that may overlap within maxOffset pixels of
+// their current positions.
+// It returns the offsets that were measured reliably.
+func measureOffsets(frames []common.ImageMap, settings common.MosaicConfig, maxOffset, downsample int, metric algv3aligning.Metric, search algv3aligning.Search) []pairOffset {
+	var offsets []pairOffset
+	for i := range frames {
+		for j := i + 1; j < len(frames); j++ {
+			base := frames[i][settings.Filter]
+			layer := frames[j][settings.Filter]
+			if shiftedBounds(base).Inset(-maxOffset).Intersect(shiftedBounds(layer)).Empty() {
+				continue
+			}
+
+			surface := algv3aligning.AlignPair(base, layer, maxOffset, downsample, nil, withinOverlap(metric, settings.MinOverlap), search)
+			best, cost := surface.Best()
+			if math.IsInf(cost, 1) {
+				fmt.Printf("Frames %d and %d: no offset with enough overlap\n", i, j)
+				continue
+			}
+			layer.Config.OffsetX, layer.Config.OffsetY = best.X, best.Y
+			quality := algv3aligning.MeasureQuality(base.Config.Filename, surface, base, layer, nil)
+
+			offset := best.Sub(base.Config.Offset())
+			fmt.Printf("Frames %d and %d: offset (%d, %d), ncc %.3f, confidence %.3f\n",
+				i, j, offset.X, offset.Y, quality.NCC, quality.Confidence)
+			if quality.NCC < settings.MinCorrelation {
+				continue
+			}
+			offsets = append(offsets, pairOffset{i, j, offset, quality.NCC})
+		}
+	}
+	return offsets
+}
+
+// solvePositions finds the frame positions that best agree with the measured offsets in
+// the weighted least squares sense, starting from the current positions of the frames.
+// It returns the position of each frame and any error encountered.
+func solvePositions(start []image.Point, offsets []pairOffset) ([]image.Point, error) {
+	n := len(start)
+	positions := make([]image.Point, n)
+	for axis := 0; axis < 2; axis++ {
+		coordinate := func(p image.Point) float64 {
+			if axis == 0 {
+				return float64(p.X)
+			}
+			return float64(p.Y)
+		}
+
+		a := make([][]float64, n)
+		b := make([]float64, n)
+		for i := range a {
+			a[i] = make([]float64, n)
+			weight := priorWeight
+			if i == 0 {
+				weight = anchorWeight
+			}
+			a[i][i] += weight
+			b[i] += weight * coordinate(start[i])
+		}
+		for _, pair := range offsets {
+			d := coordinate(pair.offset)
+			a[pair.from][pair.from] += pair.weight
+			a[pair.to][pair.to] += pair.weight
+			a[pair.from][pair.to] -= pair.weight
+			a[pair.to][pair.from] -= pair.weight
+			b[pair.from] -= pair.weight * d
+			b[pair.to] += pair.weight * d
+		}
+
+		solution, err := common.Solve(a, b)
+		if err != nil {
+			return nil, fmt.Errorf("solving frame positions: %s", err)
+		}
+		for i, v := range solution {
+			if axis == 0 {
+				positions[i].X = int(math.Round(v))
+			} else {
+				positions[i].Y = int(math.Round(v))
+			}
+		}
+	}
+	return positions, nil
+}
+
+// Register measures the offsets between overlapping frames within maxOffset pixels of
+// their current positions and moves every image of each frame to the positions that
+// best agree with all of them. The metric and search strategy are selected by name, the
+// metric defaults to ncc as the overlaps of frames vary in size.
+// Returns any error encountered.
+func Register(frames []common.ImageMap, settings common.MosaicConfig, maxOffset, downsample int, metricName, searchName string) error {
+	if metricName == "" {
+		metricName = "ncc"
+	}
+	metric, err := algv3aligning.GetMetric(metricName)
+	if err != nil {
+		return err
+	}
+	search, err := algv3aligning.GetSearch(searchName)
+	if err != nil {
+		return err
+	}
+
+	start := make([]image.Point, len(frames))
+	for i, frame := range frames {
+		start[i] = frame[settings.Filter].Config.Offset()
+	}
+
+	offsets := measureOffsets(frames, settings, maxOffset, downsample, metric, search)
+	positions, err := solvePositions(start, offsets)
+	if err != nil {
+		return err
+	}
+
+	for _, pair := range offsets {
+		residual := positions[pair.to].Sub(positions[pair.from]).Sub(pair.offset)
+		fmt.Printf("Frames %d and %d: residual (%d, %d)\n", pair.from, pair.to, residual.X, residual.Y)
+	}
+
+	// Images of each filter keep their offsets relative to the registered image.
+	for i, frame := range frames {
+		shift := positions[i].Sub(start[i])
+		for filter, loaded := range frame {
+			loaded.Config.OffsetX += shift.X
+			loaded.Config.OffsetY += shift.Y
+			frame[filter] = loaded
+		}
+	}
+
+	return nil
+}
+
+// withDefaults fills in the settings that weren't given.
+func withDefaults(settings common.MosaicConfig) common.MosaicConfig {
+	if settings.Filter == "" {
+		settings.Filter = common.GREEN
+	}
+	if settings.MinOverlap == 0 {
+		settings.MinOverlap = defaultMinOverlap
+	}
+	if settings.MinCorrelation == 0 {
+		settings.MinCorrelation = defaultMinCorrelation
+	}
+	return settings
+}
+
+// CombineImages registers the frames of a mosaic when maxOffset is larger than the
+// offsets were last searched with, blends the frames of each filter into one canvas and
+// writes it as a color image, or as tiles when configured.
+// Returns any errors encountered.
+func CombineImages(config common.ConfigFile, frames []common.ImageMap, maxOffset int, root string) error {
+	settings := withDefaults(*config.Mosaic)
+	if err := postprocess.CheckTiles(config); err != nil {
+		return err
+	}
+
+	if maxOffset > config.MaxOffset {
+		if err := Register(frames, settings, maxOffset, config.Downsample, config.Metric, config.Search); err != nil {
+			return err
+		}
+
+		// Update the config file with the registered positions.
+		config.MaxOffset = maxOffset
+		registered := func(files []common.ImageConfig) {
+			for i, sourceConfig := range files {
+				for _, frame := range frames {
+					if loaded, ok := frame[sourceConfig.Filter]; ok && loaded.Config.Filename == sourceConfig.Filename {
+						files[i] = loaded.Config
+					}
+				}
+			}
+		}
+		registered(config.Files)
+		err := common.UpdateConfig(root, func(saved *common.ConfigFile) {
+			saved.MaxOffset = maxOffset
+			saved.Metric, saved.Search, saved.Downsample = config.Metric, config.Search, config.Downsample
+			registered(saved.Files)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	meta := common.NewMetadata("mosaic", config, frames[0])
+	meta.Sources = config.Files
+	meta.SetParameter("frames", len(frames))
+	meta.SetParameter("maxOffset", config.MaxOffset)
+	meta.SetParameter("feather", settings.Feather)
+
+	bounds := canvasBounds(frames)
+	fmt.Printf("Mosaic of %d frames covers %v\n", len(frames), bounds)
+
+	if config.Tiles != nil {
+		output := config.Tiles.Output
+		if output == "" {
+			output = "output_mosaic_tiles"
+		}
+		return common.WriteTiles(path.Join(root, output), bounds, config.Tiles.Size, func(r image.Rectangle) (image.Image, error) {
+			return Blend(frames, r, settings.Feather), nil
+		}, meta)
+	}
+
+	composedImage, err := postprocess.Apply(config, Blend(frames, bounds, settings.Feather), meta, root)
+	if err != nil {
+		return err
+	}
+	return common.WriteImage(path.Join(root, "output_mosaic.jpg"), composedImage, meta)
+}
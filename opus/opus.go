@@ -15,7 +15,12 @@ import (
 	cleanhttp "github.com/hashicorp/go-cleanhttp"
 
 	"github.com/lewchuk/gostitcher/algv2blending"
+	"github.com/lewchuk/gostitcher/cameras"
 	"github.com/lewchuk/gostitcher/common"
+	"github.com/lewchuk/gostitcher/polarization"
+	"github.com/lewchuk/gostitcher/postprocess"
+	"github.com/lewchuk/gostitcher/preprocess"
+	"github.com/lewchuk/gostitcher/stack"
 )
 
 type OpusDataAPIResponse struct {
@@ -28,6 +33,7 @@ type OpusImage struct {
 	RingObsId string
 	ObsKey    string
 	Filter    string
+	Camera    string
 	Time      time.Time
 }
 
@@ -51,6 +57,9 @@ type OpusFilesAPIImageResponse struct {
 
 var ApiRoot = "https://tools.pds-rings.seti.org/opus/api"
 
+// Credit is the credit line recorded for images fetched from OPUS.
+var Credit = "NASA / JPL-Caltech / Space Science Institute"
+
 // getAPIQuery requests a URL and returns a reader of the response
 func getAPIQuery(url string) (io.ReadCloser, error) {
 	request, err := http.NewRequest("GET", url, nil)
@@ -141,6 +150,18 @@ func getCountAPIResponse(queryURL string) (OpusCountAPIResponse, error) {
 	return data, nil
 }
 
+// imageCamera reads the camera an image was taken with from its ring observation id, which
+// ends in _N for the narrow angle camera and _W for the wide angle camera.
+func imageCamera(ringObsId string) string {
+	switch {
+	case strings.HasSuffix(ringObsId, "_N"):
+		return common.NARROW
+	case strings.HasSuffix(ringObsId, "_W"):
+		return common.WIDE
+	}
+	return ""
+}
+
 // translateDataAPIResonse translates a raw JSON response from the Opus data.json endpoint into an array of image metadata.
 func translateDataAPIResonse(data OpusDataAPIResponse) ([]OpusImage, error) {
 	idIndex := findIndex("Ring Observation ID", data.Columns)
@@ -176,6 +197,7 @@ func translateDataAPIResonse(data OpusDataAPIResponse) ([]OpusImage, error) {
 			RingObsId: imgArray[idIndex],
 			ObsKey:    imgArray[obsIndex],
 			Filter:    imgArray[filterIndex],
+			Camera:    imageCamera(imgArray[idIndex]),
 			Time:      dateTimeTaken,
 		}
 	}
@@ -183,11 +205,43 @@ func translateDataAPIResonse(data OpusDataAPIResponse) ([]OpusImage, error) {
 	return images, nil
 }
 
-// groupImage groups images by the observation name and discards any observation without a
-// full RGB image set.
-func groupImages(images []OpusImage) map[string]common.ImageFilenameMap {
+// validateGroup checks that a group of images holds an image of every filter.
+func validateGroup(images []OpusImage, filters []string) error {
+	filenameMap := make(common.ImageFilenameMap)
+	for _, image := range images {
+		filenameMap[image.Filter] = image.RingObsId
+	}
+	return common.ValidateFilters(filenameMap, filters)
+}
+
+// validateCameras checks that a group of images holds a wide angle image of every filter
+// and a narrow angle image of any filter.
+func validateCameras(images []OpusImage, filters []string) error {
+	var wide []OpusImage
+	narrow := false
+	for _, image := range images {
+		switch image.Camera {
+		case common.WIDE:
+			wide = append(wide, image)
+		case common.NARROW:
+			narrow = true
+		}
+	}
+	if err := validateGroup(wide, filters); err != nil {
+		return fmt.Errorf("wide angle camera: %s", err)
+	}
+	if !narrow {
+		return fmt.Errorf("no narrow angle camera images")
+	}
+	return nil
+}
+
+// groupImage groups images by the observation name and discards any observation that
+// isn't valid, such as one without a full RGB image set. Every image of a group is kept
+// so several frames of a filter can be stacked.
+func groupImages(images []OpusImage, validate func(images []OpusImage) error) map[string][]OpusImage {
 	lastObs := ""
-	imageGroups := make(map[string]common.ImageFilenameMap)
+	imageGroups := make(map[string][]OpusImage)
 	imageGroupIndex := 0
 
 	for _, image := range images {
@@ -195,7 +249,7 @@ func groupImages(images []OpusImage) map[string]common.ImageFilenameMap {
 		if lastObs != image.ObsKey {
 			// There is a previous group we just finished.
 			if lastObs != "" {
-				if err := common.ValidateImageMap(imageGroups[lastObs]); err != nil {
+				if err := validate(imageGroups[lastObs]); err != nil {
 					fmt.Println("Group is not valid:", err)
 					// Delete group so we don't try to process it more.
 					delete(imageGroups, lastObs)
@@ -206,16 +260,12 @@ func groupImages(images []OpusImage) map[string]common.ImageFilenameMap {
 			lastObs = image.ObsKey
 			imageGroupIndex++
 			fmt.Println("Starting new group:", imageGroupIndex)
-			imageGroups[lastObs] = make(common.ImageFilenameMap)
 		}
 		fmt.Println(imageGroupIndex, image)
-		// TODO: Take the set of Filter/Time tuples and pick the three images
-		// with the least time deltas, probably using blue as a start point
-		// since those images seem to be more rare in clusters of images.
-		imageGroups[lastObs][image.Filter] = image.RingObsId
+		imageGroups[lastObs] = append(imageGroups[lastObs], image)
 	}
 
-	if err := common.ValidateImageMap(imageGroups[lastObs]); err != nil {
+	if err := validate(imageGroups[lastObs]); err != nil {
 		fmt.Println("Group is not valid:", err)
 		// Delete group so we don't try to process it more.
 		delete(imageGroups, lastObs)
@@ -224,6 +274,28 @@ func groupImages(images []OpusImage) map[string]common.ImageFilenameMap {
 	return imageGroups
 }
 
+// selectImages picks the images of a group to combine: all of them when stacking and
+// otherwise the last image of each filter.
+func selectImages(images []OpusImage, filters []string, stacking bool) []OpusImage {
+	if stacking {
+		return images
+	}
+
+	// TODO: Take the set of Filter/Time tuples and pick the three images
+	// with the least time deltas, probably using blue as a start point
+	// since those images seem to be more rare in clusters of images.
+	last := make(map[string]OpusImage)
+	for _, image := range images {
+		last[image.Filter] = image
+	}
+
+	selected := make([]OpusImage, 0, len(filters))
+	for _, filter := range filters {
+		selected = append(selected, last[filter])
+	}
+	return selected
+}
+
 // loadImage loads and caches the full sized JPEG preview image from OPUS for an observation id.
 func loadImage(obsName, imageId, outputFolder string) (*image.Gray, error) {
 	cacheFolder := fmt.Sprintf("%s/%s/", outputFolder, obsName)
@@ -273,17 +345,17 @@ func loadImage(obsName, imageId, outputFolder string) (*image.Gray, error) {
 	fmt.Println("Loading", fullImage)
 
 	reader, err := getAPIQuery(fullImage)
-	defer reader.Close()
 	if err != nil {
 		return nil, fmt.Errorf("error loading image from %s: %s", fullImage, err)
 	}
+	defer reader.Close()
 
 	image, err := common.LoadImage(reader)
 	if err != nil {
 		return nil, fmt.Errorf("error loading image from %s: %s", fullImage, err)
 	}
 
-	err = common.WriteImage(cachePath, image)
+	err = common.WriteImage(cachePath, image, nil)
 
 	if err != nil {
 		return nil, fmt.Errorf("error caching image at %s: %s", cachePath, err)
@@ -292,53 +364,219 @@ func loadImage(obsName, imageId, outputFolder string) (*image.Gray, error) {
 	return image, nil
 }
 
-// combineImages combines a set of images representing a single observation.
-func combineImages(obsName string, idMap common.ImageFilenameMap, outputFolder string) error {
-	imageMap := make(common.ImageMap)
-	imageArray := make([]common.ImageConfig, 3)
+// loadImages loads the selected images of an observation, keeping every frame of a filter.
+// It returns the configs of the images, the frames of each filter and any error
+// encountered.
+func loadImages(obsName string, selected []OpusImage, outputFolder string) ([]common.ImageConfig, map[string][]common.LoadedConfig, error) {
+	stacks := make(map[string][]common.LoadedConfig)
+	imageArray := make([]common.ImageConfig, len(selected))
 
-	for i, filter := range common.Filters {
-		image, err := loadImage(obsName, idMap[filter], outputFolder)
+	for i, opusImage := range selected {
+		image, err := loadImage(obsName, opusImage.RingObsId, outputFolder)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 		imageArray[i] = common.ImageConfig{
-			Filter:   filter,
-			Filename: fmt.Sprintf("%s.jpg", idMap[filter]),
+			Filter:   opusImage.Filter,
+			Filename: fmt.Sprintf("%s.jpg", opusImage.RingObsId),
 			OffsetX:  0,
 			OffsetY:  0,
 		}
-		imageMap[filter] = common.LoadedConfig{imageArray[i], *image}
+		stacks[opusImage.Filter] = append(stacks[opusImage.Filter], common.LoadedConfig{Config: imageArray[i], Image: image})
+	}
+
+	return imageArray, stacks, nil
+}
+
+// prepareImages applies the pre-processing stages to every frame and stacks the frames
+// of each filter when stacking is configured, or takes the only frame otherwise.
+// It returns the image map and any error encountered.
+func prepareImages(configFile common.ConfigFile, stacks map[string][]common.LoadedConfig, observationPath string) (common.ImageMap, error) {
+	if err := preprocess.ApplyStacks(configFile, stacks, observationPath); err != nil {
+		return nil, err
+	}
+
+	if configFile.Stack != nil {
+		return stack.Apply(configFile, stacks)
+	}
+	imageMap := make(common.ImageMap)
+	for filter, frames := range stacks {
+		imageMap[filter] = frames[0]
+	}
+	return imageMap, nil
+}
+
+// writeResult writes the image of an observation to the results folder.
+// Returns any errors from writing the image.
+func writeResult(obsName, outputFolder string, outputImage image.Image, meta *common.Metadata) error {
+	outputPath := fmt.Sprintf("%s/results/%s.jpg", outputFolder, obsName)
+
+	if err := common.WriteImage(outputPath, outputImage, meta); err != nil {
+		return fmt.Errorf("error writing image to %s: %s", outputPath, err)
+	}
+
+	return nil
+}
+
+// combineImages combines a set of images of the filters representing a single observation
+// and applies the configured processing stages. Several images of a filter are stacked
+// when stacking is configured. Polarizer images are combined into polarization maps
+// rather than a color image.
+func combineImages(obsName string, images []OpusImage, filters []string, outputFolder string, processing common.ProcessingConfig, polarizers *common.PolarizationConfig) error {
+	selected := selectImages(images, filters, processing.Stack != nil)
+	imageArray, stacks, err := loadImages(obsName, selected, outputFolder)
+	if err != nil {
+		return err
 	}
 
 	observationPath := fmt.Sprintf("%s/%s", outputFolder, obsName)
 
 	configFile := common.ConfigFile{
-		MaxOffset: 0,
-		Files:     imageArray,
+		MaxOffset:    0,
+		Files:        imageArray,
+		Credit:       Credit,
+		Polarization: polarizers,
 	}
+	configFile.ProcessingConfig = processing
 	if err := common.WriteConfig(observationPath, configFile); err != nil {
 		return err
 	}
 
-	outputImage := algv2blending.BlendImage(imageMap)
+	imageMap, err := prepareImages(configFile, stacks, observationPath)
+	if err != nil {
+		return err
+	}
 
-	outputPath := fmt.Sprintf("%s/%s.jpg", observationPath, obsName)
+	var outputImage image.Image
+	var meta *common.Metadata
+	if polarizers != nil {
+		maps, err := polarization.Compute(imageMap, filters)
+		if err != nil {
+			return fmt.Errorf("%s: %s", obsName, err)
+		}
+		outputImage, meta, err = polarization.WriteMaps(configFile, imageMap, filters, maps, observationPath, obsName)
+		if err != nil {
+			return err
+		}
+	} else {
+		meta = common.NewMetadata("v2 blending", configFile, imageMap)
+		processed, err := postprocess.Apply(configFile, algv2blending.BlendImage(imageMap), meta, observationPath)
+		if err != nil {
+			return err
+		}
+		outputImage = processed
 
-	if err := common.WriteImage(outputPath, outputImage); err != nil {
-		return fmt.Errorf("error writing image to %s: %s", outputPath, err)
+		outputPath := fmt.Sprintf("%s/%s.jpg", observationPath, obsName)
+
+		if err := common.WriteImage(outputPath, outputImage, meta); err != nil {
+			return fmt.Errorf("error writing image to %s: %s", outputPath, err)
+		}
 	}
 
-	outputPath = fmt.Sprintf("%s/results/%s.jpg", outputFolder, obsName)
+	return writeResult(obsName, outputFolder, outputImage, meta)
+}
 
-	if err := common.WriteImage(outputPath, outputImage); err != nil {
-		return fmt.Errorf("error writing image to %s: %s", outputPath, err)
+// combineCameras colors the detail of the narrow angle images of an observation with the
+// color of the wide angle images of the filters and applies the configured processing
+// stages, see cameras.CombineImages.
+func combineCameras(obsName string, images []OpusImage, filters []string, outputFolder string, processing common.ProcessingConfig, settings *common.CamerasConfig) error {
+	var wideImages, narrowImages []OpusImage
+	var narrowFiles []common.ImageConfig
+	for _, image := range images {
+		switch image.Camera {
+		case common.WIDE:
+			wideImages = append(wideImages, image)
+		case common.NARROW:
+			narrowImages = append(narrowImages, image)
+			narrowFiles = append(narrowFiles, common.ImageConfig{Filter: image.Filter})
+		}
 	}
+	detailFilters := cameras.DetailFilters(narrowFiles)
 
-	return nil
+	wideArray, wideStacks, err := loadImages(obsName, selectImages(wideImages, filters, processing.Stack != nil), outputFolder)
+	if err != nil {
+		return err
+	}
+	var detailImages []OpusImage
+	for _, image := range narrowImages {
+		for _, filter := range detailFilters {
+			if image.Filter == filter {
+				detailImages = append(detailImages, image)
+			}
+		}
+	}
+	narrowArray, narrowStacks, err := loadImages(obsName, selectImages(detailImages, detailFilters, processing.Stack != nil), outputFolder)
+	if err != nil {
+		return err
+	}
+
+	observationPath := fmt.Sprintf("%s/%s", outputFolder, obsName)
+
+	configFile := common.ConfigFile{
+		MaxOffset: 0,
+		Credit:    Credit,
+		Cameras:   settings,
+	}
+	for _, file := range wideArray {
+		file.Camera = common.WIDE
+		configFile.Files = append(configFile.Files, file)
+	}
+	for _, file := range narrowArray {
+		file.Camera = common.NARROW
+		configFile.Files = append(configFile.Files, file)
+	}
+	configFile.ProcessingConfig = processing
+	if err := common.WriteConfig(observationPath, configFile); err != nil {
+		return err
+	}
+
+	wide, err := prepareImages(configFile, wideStacks, observationPath)
+	if err != nil {
+		return err
+	}
+	narrow, err := prepareImages(configFile, narrowStacks, observationPath)
+	if err != nil {
+		return err
+	}
+
+	outputImage, meta, err := cameras.CombineImages(configFile, wide, narrow, observationPath, obsName)
+	if err != nil {
+		return err
+	}
+
+	return writeResult(obsName, outputFolder, outputImage, meta)
 }
 
-func ProcessImages(outputFolder, camera, optTarget, optObsrvation, extra string) error {
+// ProcessImages searches OPUS for Cassini ISS images, groups them by observation and
+// combines the groups with an image of each RGB filter into color images, or with polarizers
+// configured the groups with an image of each polarizer into polarization maps. With
+// cameras configured both cameras are searched and the groups with a wide angle image of
+// each RGB filter and a narrow angle image color the narrow angle detail with the wide
+// angle color.
+// Returns any errors from searching, loading or combining the images.
+func ProcessImages(outputFolder, camera, optTarget, optObsrvation, extra string, processing common.ProcessingConfig, polarizers *common.PolarizationConfig, cameraSettings *common.CamerasConfig) error {
+	filters := common.Filters[:]
+	searchFilters := filters
+	validate := func(images []OpusImage) error {
+		return validateGroup(images, filters)
+	}
+	if polarizers != nil && cameraSettings != nil {
+		return fmt.Errorf("polarization can't be combined from both cameras")
+	}
+	if polarizers != nil {
+		filters = common.PolarizerFilters[:]
+		if len(polarizers.Filters) > 0 {
+			filters = polarizers.Filters
+		}
+		searchFilters = filters
+	}
+	if cameraSettings != nil {
+		// The narrow angle detail may also come from the clear filters.
+		searchFilters = append(append([]string(nil), filters...), common.ClearFilters[:]...)
+		validate = func(images []OpusImage) error {
+			return validateCameras(images, filters)
+		}
+	}
 
 	if err := os.MkdirAll(fmt.Sprintf("%s/results", outputFolder), os.ModePerm); err != nil {
 		return fmt.Errorf("cannot create resulsts folder: %s", err)
@@ -346,26 +584,28 @@ func ProcessImages(outputFolder, camera, optTarget, optObsrvation, extra string)
 
 	// Limit to Cassini Images since they have the filter parameter.
 	cassiniISSOpts := "instrumentid=Cassini+ISS&typeid=Image"
-	// Limit to the RGB images.
-	filterOpts := "FILTER=BL1,GRN,RED"
+	// Limit to the images of the filters combined.
+	filterOpts := "FILTER=" + strings.Join(searchFilters, ",")
 	// Order by time to group the observations.
 	orderOpt := "order=time1"
 	// The pieces of information we want for each image.
 	colOpt := "cols=ringobsid,obsname,filter,time1"
 	// Limit the search to 100 images at a time.
 	pageSizeOpt := "limit=100"
-	// Select only one camera at a time.
-	cameraOpt := fmt.Sprintf("camera=%s+Angle", camera)
 
 	searchParams := fmt.Sprintf(
-		"%s&%s&%s&%s&%s&%s",
+		"%s&%s&%s&%s&%s",
 		cassiniISSOpts,
 		filterOpts,
 		orderOpt,
 		colOpt,
-		cameraOpt,
 		pageSizeOpt)
 
+	// Select only one camera at a time unless combining them.
+	if cameraSettings == nil {
+		searchParams = fmt.Sprintf("%s&camera=%s+Angle", searchParams, camera)
+	}
+
 	if optTarget != "" {
 		searchParams = fmt.Sprintf("%s&target=%s", searchParams, optTarget)
 	}
@@ -420,10 +660,15 @@ func ProcessImages(outputFolder, camera, optTarget, optObsrvation, extra string)
 		images = append(images, imagePage...)
 	}
 
-	groups := groupImages(images)
+	groups := groupImages(images, validate)
 
-	for obsName, imageMap := range groups {
-		err := combineImages(obsName, imageMap, outputFolder)
+	for obsName, images := range groups {
+		var err error
+		if cameraSettings != nil {
+			err = combineCameras(obsName, images, filters, outputFolder, processing, cameraSettings)
+		} else {
+			err = combineImages(obsName, images, filters, outputFolder, processing, polarizers)
+		}
 		if err != nil {
 			return err
 		}
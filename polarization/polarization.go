@@ -0,0 +1,279 @@
+// A package containing the functions for combining images taken through polarizers into
+// maps of the intensity and linear polarization of the light.
+package polarization
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/algv3aligning"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"math"
+	"path"
+	"strings"
+)
+
+// The percentiles of the intensity shown as white and of the degree of polarization
+// shown fully saturated by default.
+const (
+	whitePercentile  = 99.9
+	degreePercentile = 99
+)
+
+// Maps holds the Stokes parameters derived from a set of polarizer images: the total
+// intensity, the degree of linear polarization (0-1) and the angle of polarization in
+// degrees (0-180) counterclockwise from the transmission axis of the 0 degree polarizer.
+type Maps struct {
+	Intensity *common.Plane
+	Degree    *common.Plane
+	Angle     *common.Plane
+}
+
+// Filters resolves the polarizers combined: the configured filters, or P0, P60 and P120
+// when the files include all of them and IRP0 and IRP90 otherwise.
+// It returns the filters and any error encountered.
+func Filters(config common.PolarizationConfig, files []common.ImageConfig) ([]string, error) {
+	filters := config.Filters
+	if len(filters) == 0 {
+		present := make(map[string]bool)
+		for _, file := range files {
+			present[file.Filter] = true
+		}
+		filters = common.IRPolarizerFilters[:]
+		if present[common.P0] && present[common.P60] && present[common.P120] {
+			filters = common.PolarizerFilters[:]
+		}
+	}
+
+	if len(filters) < 2 {
+		return nil, fmt.Errorf("polarization needs at least two polarizers, got %v", filters)
+	}
+	for _, filter := range filters {
+		if _, ok := common.PolarizerAngles[filter]; !ok {
+			return nil, fmt.Errorf("%s is not a polarizer, expected %v or %v", filter, common.PolarizerFilters, common.IRPolarizerFilters)
+		}
+	}
+	return filters, nil
+}
+
+// stokesInverse finds the matrix that turns the values measured through polarizers at
+// the given angles into the Stokes parameters I, Q and U by least squares. A polarizer
+// at angle theta measures (I + Q cos 2theta + U sin 2theta) / 2. Polarizers 90 degrees
+// apart can't tell U apart, so it is left out and only I and Q are found.
+// It returns a row of weights for each parameter and any error encountered.
+func stokesInverse(angles []float64) ([][]float64, error) {
+	measureU := false
+	rows := make([][]float64, len(angles))
+	for i, angle := range angles {
+		theta := 2 * angle * math.Pi / 180
+		rows[i] = []float64{0.5, 0.5 * math.Cos(theta), 0.5 * math.Sin(theta)}
+		if math.Abs(rows[i][2]) > 1e-9 {
+			measureU = true
+		}
+	}
+	unknowns := 3
+	if !measureU {
+		unknowns = 2
+	}
+
+	// Solve the normal equations for each unit vector to invert them.
+	inverse := make([][]float64, unknowns)
+	for j := range inverse {
+		normal := make([][]float64, unknowns)
+		for a := range normal {
+			normal[a] = make([]float64, unknowns)
+			for b := range normal[a] {
+				for _, row := range rows {
+					normal[a][b] += row[a] * row[b]
+				}
+			}
+		}
+		unit := make([]float64, unknowns)
+		unit[j] = 1
+		column, err := common.Solve(normal, unit)
+		if err != nil {
+			return nil, fmt.Errorf("polarizers at %v degrees can't measure linear polarization: %s", angles, err)
+		}
+		inverse[j] = column
+	}
+
+	weights := make([][]float64, unknowns)
+	for j := range weights {
+		weights[j] = make([]float64, len(angles))
+		for i, row := range rows {
+			for k := 0; k < unknowns; k++ {
+				weights[j][i] += inverse[j][k] * row[k]
+			}
+		}
+	}
+	return weights, nil
+}
+
+// Compute derives the intensity and polarization maps from the aligned images of the
+// polarizers, covering the region of the composite where all of them overlap. With only
+// polarizers 90 degrees apart the degree is a lower bound and the angle is either 0 or
+// 90 degrees.
+// It returns the maps and any error encountered.
+func Compute(imageMap common.ImageMap, filters []string) (Maps, error) {
+	images := make([]common.LoadedConfig, len(filters))
+	angles := make([]float64, len(filters))
+	var bounds image.Rectangle
+	for i, filter := range filters {
+		loaded, ok := imageMap[filter]
+		if !ok {
+			return Maps{}, fmt.Errorf("no %s image to combine", filter)
+		}
+		images[i], angles[i] = loaded, common.PolarizerAngles[filter]
+		shifted := loaded.Image.Bounds().Add(loaded.Config.Offset())
+		if i == 0 {
+			bounds = shifted
+		}
+		bounds = bounds.Intersect(shifted)
+	}
+	if bounds.Empty() {
+		return Maps{}, fmt.Errorf("the polarizer images do not overlap")
+	}
+
+	weights, err := stokesInverse(angles)
+	if err != nil {
+		return Maps{}, err
+	}
+
+	maps := Maps{common.NewPlane(bounds), common.NewPlane(bounds), common.NewPlane(bounds)}
+	common.ParallelRows(bounds, func(_ int, rows image.Rectangle) {
+		stokes := make([]float64, 3)
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := rows.Min.X; x < rows.Max.X; x++ {
+				for j := range stokes {
+					stokes[j] = 0
+				}
+				for i, loaded := range images {
+					v := float64(loaded.Image.GrayAt(x-loaded.Config.OffsetX, y-loaded.Config.OffsetY).Y) / 255
+					for j, w := range weights {
+						stokes[j] += w[i] * v
+					}
+				}
+
+				intensity, q, u := stokes[0], stokes[1], stokes[2]
+				maps.Intensity.Set(x, y, math.Max(intensity, 0))
+				if intensity > 0 {
+					maps.Degree.Set(x, y, common.Clamp(math.Hypot(q, u)/intensity, 0, 1))
+				}
+				angle := 0.5 * math.Atan2(u, q) * 180 / math.Pi
+				if angle < 0 {
+					angle += 180
+				}
+				maps.Angle.Set(x, y, angle)
+			}
+		}
+	})
+
+	return maps, nil
+}
+
+// Visualize shows the maps as one color image: the hue is the angle of polarization, the
+// saturation is the degree of polarization relative to maxDegree and the value is the
+// intensity relative to white.
+// It returns the image.
+func (m Maps) Visualize(maxDegree, white float64) *image.RGBA {
+	bounds := m.Intensity.Rect
+	planes := [3]*common.Plane{common.NewPlane(bounds), common.NewPlane(bounds), common.NewPlane(bounds)}
+	for i := range m.Intensity.Pix {
+		// Angles repeat every 180 degrees so they go around the hues twice as fast.
+		r, g, b := common.HSVToRGB(2*m.Angle.Pix[i],
+			common.Clamp(m.Degree.Pix[i]/maxDegree, 0, 1),
+			common.Clamp(m.Intensity.Pix[i]/white, 0, 1))
+		planes[0].Pix[i], planes[1].Pix[i], planes[2].Pix[i] = r, g, b
+	}
+	return common.RGBAFromPlanes(planes)
+}
+
+// scaled returns a copy of a plane divided by scale.
+func scaled(plane *common.Plane, scale float64) *common.Plane {
+	result := common.NewPlane(plane.Rect)
+	for i, v := range plane.Pix {
+		result.Pix[i] = v / scale
+	}
+	return result
+}
+
+// WriteMaps writes the intensity, degree and angle maps of a set of polarizer images as
+// <name>_intensity.jpg, <name>_degree.jpg and <name>_angle.jpg and their combined
+// visualization as <name>.jpg, see Maps.Visualize.
+// It returns the visualization, its metadata and any error encountered.
+func WriteMaps(config common.ConfigFile, imageMap common.ImageMap, filters []string, maps Maps, root, name string) (image.Image, *common.Metadata, error) {
+	maxDegree := config.Polarization.MaxDegree
+	if maxDegree == 0 {
+		maxDegree = common.Percentile(maps.Degree.Pix, degreePercentile)
+	}
+	if maxDegree <= 0 {
+		// The light is unpolarized.
+		maxDegree = 1
+	}
+	white := common.Percentile(maps.Intensity.Pix, whitePercentile)
+	if white <= 0 {
+		return nil, nil, fmt.Errorf("the polarizer images are black")
+	}
+	fmt.Printf("Polarization of %s: degree up to %.3f shown saturated\n", strings.Join(filters, ", "), maxDegree)
+
+	meta := common.NewMetadata("polarization", config, imageMap)
+	meta.SetParameter("filters", strings.Join(filters, ","))
+	meta.SetParameter("maxDegree", maxDegree)
+
+	// The angle map shows every angle fully saturated at full brightness.
+	full := common.NewPlane(maps.Angle.Rect)
+	for i := range full.Pix {
+		full.Pix[i] = 1
+	}
+	outputs := []struct {
+		suffix string
+		img    image.Image
+	}{
+		{"_intensity", scaled(maps.Intensity, white).Gray()},
+		{"_degree", scaled(maps.Degree, maxDegree).Gray()},
+		{"_angle", Maps{full, full, maps.Angle}.Visualize(1, 1)},
+	}
+	for _, output := range outputs {
+		if err := common.WriteImage(path.Join(root, name+output.suffix+".jpg"), output.img, meta); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	visualization := maps.Visualize(maxDegree, white)
+	if err := common.WriteImage(path.Join(root, name+".jpg"), visualization, meta); err != nil {
+		return nil, nil, err
+	}
+	return visualization, meta, nil
+}
+
+// CombineImages aligns the polarizer images that haven't been aligned to the first
+// polarizer within maxOffset pixels, see algv3aligning.Unaligned, saving their new
+// offsets to config.json, and writes the intensity and polarization maps named
+// output_polarization. The alignment uses normalized cross correlation unless another
+// metric is configured.
+// Returns any errors from aligning, combining or writing the images.
+func CombineImages(config common.ConfigFile, imageMap common.ImageMap, filters []string, maxOffset int, root string) error {
+	if unaligned := algv3aligning.Unaligned(imageMap, filters, filters[0], maxOffset); maxOffset > 0 && len(unaligned) > 0 {
+		metric := config.Metric
+		if metric == "" {
+			metric = "ncc"
+		}
+		fmt.Println("Aligning images to:", filters[0])
+		if _, err := algv3aligning.AlignFilters(&imageMap, unaligned, maxOffset, filters[0], nil, config.Downsample, metric, config.Search); err != nil {
+			return err
+		}
+		for _, filter := range unaligned {
+			fmt.Println(algv3aligning.DescribeQuality(imageMap[filter]))
+		}
+
+		if err := algv3aligning.SaveOffsets(config, imageMap, unaligned, root); err != nil {
+			return err
+		}
+	}
+
+	maps, err := Compute(imageMap, filters)
+	if err != nil {
+		return fmt.Errorf("%s: %s", root, err)
+	}
+	_, _, err = WriteMaps(config, imageMap, filters, maps, root, "output_polarization")
+	return err
+}
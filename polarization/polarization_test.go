@@ -0,0 +1,146 @@
+package polarization
+
+import (
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// measure returns the value a polarizer at angle measures of light with the Stokes
+// parameters i, q and u.
+func measure(angle, i, q, u float64) float64 {
+	theta := 2 * angle * math.Pi / 180
+	return (i + q*math.Cos(theta) + u*math.Sin(theta)) / 2
+}
+
+func TestStokesInverse(t *testing.T) {
+	const i, q, u = 0.8, 0.2, -0.1
+
+	tests := []struct {
+		name    string
+		angles  []float64
+		want    []float64
+		wantErr bool
+	}{
+		{name: "visible polarizers", angles: []float64{0, 60, 120}, want: []float64{i, q, u}},
+		{name: "visible polarizers in another order", angles: []float64{120, 0, 60}, want: []float64{i, q, u}},
+		{name: "infrared polarizers", angles: []float64{0, 90}, want: []float64{i, q}},
+		{name: "repeated polarizer", angles: []float64{0, 0}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			weights, err := stokesInverse(test.angles)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("stokesInverse() error = %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if len(weights) != len(test.want) {
+				t.Fatalf("got %d Stokes parameters, want %d", len(weights), len(test.want))
+			}
+			for j, row := range weights {
+				got := 0.0
+				for k, angle := range test.angles {
+					got += row[k] * measure(angle, i, q, u)
+				}
+				if math.Abs(got-test.want[j]) > 1e-9 {
+					t.Errorf("Stokes parameter %d = %g, want %g", j, got, test.want[j])
+				}
+			}
+		})
+	}
+}
+
+// polarizerImages returns an image through each polarizer of light with the given
+// intensity, degree and angle of polarization.
+func polarizerImages(filters []string, intensity, degree, angle float64) common.ImageMap {
+	q := intensity * degree * math.Cos(2*angle*math.Pi/180)
+	u := intensity * degree * math.Sin(2*angle*math.Pi/180)
+	imageMap := common.ImageMap{}
+	for _, filter := range filters {
+		img := image.NewGray(image.Rect(0, 0, 8, 8))
+		v := measure(common.PolarizerAngles[filter], intensity, q, u)
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				img.SetGray(x, y, color.Gray{uint8(math.Round(255 * v))})
+			}
+		}
+		imageMap[filter] = common.LoadedConfig{Config: common.ImageConfig{Filter: filter}, Image: img}
+	}
+	return imageMap
+}
+
+func TestCompute(t *testing.T) {
+	visible := common.PolarizerFilters[:]
+	infrared := common.IRPolarizerFilters[:]
+
+	tests := []struct {
+		name       string
+		filters    []string
+		degree     float64
+		angle      float64
+		wantDegree float64
+		wantAngle  float64
+	}{
+		{name: "visible unpolarized", filters: visible, degree: 0, angle: 0, wantDegree: 0, wantAngle: 0},
+		{name: "visible at 30 degrees", filters: visible, degree: 0.5, angle: 30, wantDegree: 0.5, wantAngle: 30},
+		{name: "visible at 135 degrees", filters: visible, degree: 0.3, angle: 135, wantDegree: 0.3, wantAngle: 135},
+		// The infrared pair only measures Q, so the degree is a lower bound and the angle
+		// snaps to 0 or 90 degrees.
+		{name: "infrared along the axis", filters: infrared, degree: 0.4, angle: 0, wantDegree: 0.4, wantAngle: 0},
+		{name: "infrared at 30 degrees", filters: infrared, degree: 0.5, angle: 30, wantDegree: 0.25, wantAngle: 0},
+		{name: "infrared at 120 degrees", filters: infrared, degree: 0.5, angle: 120, wantDegree: 0.25, wantAngle: 90},
+	}
+
+	const intensity = 0.6
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			maps, err := Compute(polarizerImages(test.filters, intensity, test.degree, test.angle), test.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := maps.Intensity.At(4, 4); math.Abs(got-intensity) > 0.01 {
+				t.Errorf("intensity = %g, want %g", got, intensity)
+			}
+			if got := maps.Degree.At(4, 4); math.Abs(got-test.wantDegree) > 0.02 {
+				t.Errorf("degree = %g, want %g", got, test.wantDegree)
+			}
+			if test.wantDegree > 0 {
+				if got := maps.Angle.At(4, 4); math.Abs(got-test.wantAngle) > 2 {
+					t.Errorf("angle = %g, want %g", got, test.wantAngle)
+				}
+			}
+		})
+	}
+}
+
+func TestComputeBounds(t *testing.T) {
+	filters := common.PolarizerFilters[:]
+
+	imageMap := polarizerImages(filters, 0.5, 0.2, 45)
+	shifted := imageMap[common.P60]
+	shifted.Config.OffsetX, shifted.Config.OffsetY = 2, -1
+	imageMap[common.P60] = shifted
+	maps, err := Compute(imageMap, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := image.Rect(2, 0, 8, 7); maps.Intensity.Rect != want {
+		t.Errorf("maps cover %v, want the overlap %v", maps.Intensity.Rect, want)
+	}
+
+	shifted.Config.OffsetX = 20
+	imageMap[common.P60] = shifted
+	if _, err := Compute(imageMap, filters); err == nil {
+		t.Error("computing images that don't overlap succeeded, want an error")
+	}
+
+	delete(imageMap, common.P120)
+	if _, err := Compute(imageMap, filters); err == nil {
+		t.Error("computing without a P120 image succeeded, want an error")
+	}
+}
@@ -0,0 +1,79 @@
+// A package containing the stages applied to composite color images before they are written.
+package postprocess
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"image/draw"
+)
+
+// toRGBA returns the image as an RGBA image, converting it if needed.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+// CheckTiles returns an error when a config streams its composite as tiles while
+// enabling post-processing stages, which need the whole composite and so would be
+// silently skipped.
+func CheckTiles(config common.ConfigFile) error {
+	if config.Tiles == nil {
+		return nil
+	}
+	var stages []string
+	if config.Sharpen != nil {
+		stages = append(stages, "sharpen")
+	}
+	if config.WhiteBalance != nil {
+		stages = append(stages, "whiteBalance")
+	}
+	if config.Stretch != nil {
+		stages = append(stages, "stretch")
+	}
+	if len(stages) > 0 {
+		return fmt.Errorf("tiled output can't be post-processed, remove %v or the tiles", stages)
+	}
+	return nil
+}
+
+// Apply runs the post-processing stages enabled in the config on a composite image and
+// records the settings of each stage in the metadata. Any files the stages need are
+// loaded relative to root.
+// It returns the processed image and any error encountered.
+func Apply(config common.ConfigFile, img image.Image, meta *common.Metadata, root string) (image.Image, error) {
+	rgba := toRGBA(img)
+
+	if config.Sharpen != nil {
+		sharpened, err := Sharpen(rgba, *config.Sharpen, root)
+		if err != nil {
+			return nil, err
+		}
+		rgba = sharpened
+		meta.SetParameter("sharpen", DescribeSharpen(*config.Sharpen))
+	}
+
+	if config.WhiteBalance != nil {
+		balanced, gains, err := WhiteBalance(rgba, *config.WhiteBalance, root)
+		if err != nil {
+			return nil, err
+		}
+		rgba = balanced
+		meta.SetParameter("whiteBalance", DescribeWhiteBalance(*config.WhiteBalance, gains))
+	}
+
+	if config.Stretch != nil {
+		stretched, err := Stretch(rgba, *config.Stretch)
+		if err != nil {
+			return nil, err
+		}
+		rgba = stretched
+		meta.SetParameter("stretch", DescribeStretch(*config.Stretch))
+	}
+
+	return rgba, nil
+}
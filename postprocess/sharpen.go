@@ -0,0 +1,241 @@
+package postprocess
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"math"
+	"path"
+)
+
+// The supported sharpening methods.
+const (
+	RICHARDSON_LUCY = "richardson-lucy"
+	UNSHARP         = "unsharp"
+)
+
+// sharpenDefaults fills in any unset sharpening parameters.
+func sharpenDefaults(config common.SharpenConfig) common.SharpenConfig {
+	if config.Sigma == 0 {
+		config.Sigma = 1
+	}
+	if config.Iterations == 0 {
+		config.Iterations = 10
+	}
+	if config.Amount == 0 {
+		config.Amount = 1
+	}
+	return config
+}
+
+// CheckSharpen checks the sharpening parameters, once defaults are filled in, so runs
+// with unusable parameters fail before the composites are made.
+// Returns an error for a sigma that isn't positive or fewer than one iteration.
+func CheckSharpen(config common.SharpenConfig) error {
+	config = sharpenDefaults(config)
+	if config.Sigma <= 0 || config.Iterations < 1 {
+		return fmt.Errorf("sharpening needs a positive sigma and number of iterations, got %g and %d", config.Sigma, config.Iterations)
+	}
+	return nil
+}
+
+// DescribeSharpen returns a summary of the sharpening settings suitable for image
+// metadata.
+func DescribeSharpen(config common.SharpenConfig) string {
+	config = sharpenDefaults(config)
+	if config.Method == UNSHARP {
+		return fmt.Sprintf("%s sigma=%g amount=%g", config.Method, config.Sigma, config.Amount)
+	}
+	description := fmt.Sprintf("%s iterations=%d", config.Method, config.Iterations)
+	for _, filter := range channelFilters {
+		if psfPath, ok := config.PSF[filter]; ok {
+			description += fmt.Sprintf(" psf[%s]=%s", filter, psfPath)
+		} else {
+			description += fmt.Sprintf(" sigma[%s]=%g", filter, config.Sigma)
+		}
+	}
+	return description
+}
+
+// psf is a point spread function centred on (0, 0). Gaussians also keep their one
+// dimensional taps so they can be applied as two cheaper passes.
+type psf struct {
+	kernel *common.Plane
+	taps   []float64
+}
+
+// gaussianPSF returns a normalized gaussian PSF reaching out to three sigma.
+func gaussianPSF(sigma float64) psf {
+	radius := int(math.Ceil(3 * sigma))
+	taps := make([]float64, 2*radius+1)
+	total := 0.0
+	for i := range taps {
+		d := float64(i - radius)
+		taps[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		total += taps[i]
+	}
+	for i := range taps {
+		taps[i] /= total
+	}
+
+	kernel := common.NewPlane(image.Rect(-radius, -radius, radius+1, radius+1))
+	for y := -radius; y <= radius; y++ {
+		for x := -radius; x <= radius; x++ {
+			kernel.Set(x, y, taps[y+radius]*taps[x+radius])
+		}
+	}
+	return psf{kernel, taps}
+}
+
+// loadPSF loads an image of a PSF with odd width and height, centring it on its middle
+// pixel and normalizing it to sum to 1.
+// It returns the PSF and any error encountered.
+func loadPSF(psfPath string) (psf, error) {
+	img, err := common.LoadImageFromPath(psfPath)
+	if err != nil {
+		return psf{}, err
+	}
+	bounds := img.Bounds()
+	if bounds.Dx()%2 == 0 || bounds.Dy()%2 == 0 {
+		return psf{}, fmt.Errorf("psf %s is %dx%d, it needs an odd width and height", psfPath, bounds.Dx(), bounds.Dy())
+	}
+
+	plane := common.PlaneFromGray(img)
+	total := 0.0
+	for _, v := range plane.Pix {
+		total += v
+	}
+	if total == 0 {
+		return psf{}, fmt.Errorf("psf %s is black", psfPath)
+	}
+	for i := range plane.Pix {
+		plane.Pix[i] /= total
+	}
+	plane.Rect = bounds.Sub(image.Pt(bounds.Min.X+bounds.Dx()/2, bounds.Min.Y+bounds.Dy()/2))
+	return psf{kernel: plane}, nil
+}
+
+// convolve blurs a plane with a PSF, or with the PSF mirrored when flip is set, as
+// Richardson-Lucy needs for its correction step.
+func convolve(plane *common.Plane, p psf, flip bool) *common.Plane {
+	bounds := plane.Rect
+
+	if p.taps != nil {
+		// Gaussians are symmetric so flipping them changes nothing.
+		radius := len(p.taps) / 2
+		horizontal := common.NewPlane(bounds)
+		common.ParallelRows(bounds, func(_ int, rows image.Rectangle) {
+			for y := rows.Min.Y; y < rows.Max.Y; y++ {
+				for x := rows.Min.X; x < rows.Max.X; x++ {
+					sum := 0.0
+					for i, t := range p.taps {
+						sum += t * plane.ClampedAt(x+i-radius, y)
+					}
+					horizontal.Set(x, y, sum)
+				}
+			}
+		})
+		blurred := common.NewPlane(bounds)
+		common.ParallelRows(bounds, func(_ int, rows image.Rectangle) {
+			for y := rows.Min.Y; y < rows.Max.Y; y++ {
+				for x := rows.Min.X; x < rows.Max.X; x++ {
+					sum := 0.0
+					for i, t := range p.taps {
+						sum += t * horizontal.ClampedAt(x, y+i-radius)
+					}
+					blurred.Set(x, y, sum)
+				}
+			}
+		})
+		return blurred
+	}
+
+	sign := -1
+	if flip {
+		sign = 1
+	}
+	k := p.kernel.Rect
+	blurred := common.NewPlane(bounds)
+	common.ParallelRows(bounds, func(_ int, rows image.Rectangle) {
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := rows.Min.X; x < rows.Max.X; x++ {
+				sum := 0.0
+				for dy := k.Min.Y; dy < k.Max.Y; dy++ {
+					for dx := k.Min.X; dx < k.Max.X; dx++ {
+						sum += p.kernel.At(dx, dy) * plane.ClampedAt(x+sign*dx, y+sign*dy)
+					}
+				}
+				blurred.Set(x, y, sum)
+			}
+		}
+	})
+	return blurred
+}
+
+// richardsonLucy deconvolves a plane blurred by a PSF, repeatedly scaling the estimate
+// by the ratio of the observed plane to the estimate blurred by the PSF.
+func richardsonLucy(observed *common.Plane, p psf, iterations int) *common.Plane {
+	// Values are kept just above zero so the ratios stay finite.
+	const floor = 1e-4
+	estimate := observed.Clone()
+	for i, v := range estimate.Pix {
+		estimate.Pix[i] = math.Max(v, floor)
+	}
+
+	ratio := common.NewPlane(observed.Rect)
+	for iteration := 0; iteration < iterations; iteration++ {
+		blurred := convolve(estimate, p, false)
+		for i, v := range observed.Pix {
+			ratio.Pix[i] = v / math.Max(blurred.Pix[i], floor)
+		}
+		correction := convolve(ratio, p, true)
+		for i := range estimate.Pix {
+			estimate.Pix[i] = math.Max(estimate.Pix[i]*correction.Pix[i], floor)
+		}
+	}
+	return estimate
+}
+
+// unsharpMask adds back amount times the difference between a plane and its gaussian
+// blur, boosting detail finer than sigma.
+func unsharpMask(plane *common.Plane, sigma, amount float64) *common.Plane {
+	blurred := convolve(plane, gaussianPSF(sigma), false)
+	sharpened := common.NewPlane(plane.Rect)
+	for i, v := range plane.Pix {
+		sharpened.Pix[i] = v + amount*(v-blurred.Pix[i])
+	}
+	return sharpened
+}
+
+// Sharpen sharpens each channel of a composite, either deconvolving the PSF of its
+// filter with Richardson-Lucy or with an unsharp mask. PSF images are loaded relative
+// to root.
+// It returns the sharpened image and any error encountered.
+func Sharpen(img *image.RGBA, config common.SharpenConfig, root string) (*image.RGBA, error) {
+	if err := CheckSharpen(config); err != nil {
+		return nil, err
+	}
+	config = sharpenDefaults(config)
+	planes := common.PlanesFromRGBA(img)
+
+	for c, filter := range channelFilters {
+		switch config.Method {
+		case RICHARDSON_LUCY:
+			p := gaussianPSF(config.Sigma)
+			if psfPath, ok := config.PSF[filter]; ok {
+				loaded, err := loadPSF(path.Join(root, psfPath))
+				if err != nil {
+					return nil, fmt.Errorf("loading psf of %s: %s", filter, err)
+				}
+				p = loaded
+			}
+			planes[c] = richardsonLucy(planes[c], p, config.Iterations)
+		case UNSHARP:
+			planes[c] = unsharpMask(planes[c], config.Sigma, config.Amount)
+		default:
+			return nil, fmt.Errorf("unknown sharpening method %q, expected %s or %s", config.Method, RICHARDSON_LUCY, UNSHARP)
+		}
+	}
+
+	return common.RGBAFromPlanes(planes), nil
+}
@@ -0,0 +1,95 @@
+package postprocess
+
+import (
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePSF writes a gray PSF image of the given size with a single bright middle pixel.
+func writePSF(t *testing.T, dir, name string, width, height int) {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	img.SetGray(width/2, height/2, color.Gray{255})
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatalf("creating psf %s: %s", name, err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatalf("writing psf %s: %s", name, err)
+	}
+}
+
+// blurredDot returns a composite of a gray dot blurred by a gaussian on a dark sky.
+func blurredDot() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 21, 21))
+	for y := 0; y < 21; y++ {
+		for x := 0; x < 21; x++ {
+			dx, dy := float64(x-10), float64(y-10)
+			v := uint8(math.Round(30 + 150*math.Exp(-(dx*dx+dy*dy)/(2*1.5*1.5))))
+			img.SetRGBA(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	return img
+}
+
+func TestSharpen(t *testing.T) {
+	dir := t.TempDir()
+	writePSF(t, dir, "delta.png", 3, 3)
+	writePSF(t, dir, "even.png", 4, 3)
+	delta := map[string]string{common.RED: "delta.png", common.GREEN: "delta.png", common.BLUE: "delta.png"}
+
+	tests := []struct {
+		name    string
+		config  common.SharpenConfig
+		want    string
+		wantErr bool
+	}{
+		{name: "richardson-lucy defaults", config: common.SharpenConfig{Method: RICHARDSON_LUCY}, want: "sharper"},
+		{name: "richardson-lucy one iteration", config: common.SharpenConfig{Method: RICHARDSON_LUCY, Sigma: 1.5, Iterations: 1}, want: "sharper"},
+		{name: "richardson-lucy point psf", config: common.SharpenConfig{Method: RICHARDSON_LUCY, PSF: delta}, want: "same"},
+		{name: "unsharp defaults", config: common.SharpenConfig{Method: UNSHARP}, want: "sharper"},
+		{name: "unsharp amount", config: common.SharpenConfig{Method: UNSHARP, Sigma: 2, Amount: 0.5}, want: "sharper"},
+		{name: "negative sigma", config: common.SharpenConfig{Method: UNSHARP, Sigma: -1}, wantErr: true},
+		{name: "negative richardson-lucy sigma", config: common.SharpenConfig{Method: RICHARDSON_LUCY, Sigma: -0.5}, wantErr: true},
+		{name: "negative iterations", config: common.SharpenConfig{Method: RICHARDSON_LUCY, Iterations: -3}, wantErr: true},
+		{name: "psf with an even width", config: common.SharpenConfig{Method: RICHARDSON_LUCY, PSF: map[string]string{common.RED: "even.png"}}, wantErr: true},
+		{name: "missing psf", config: common.SharpenConfig{Method: RICHARDSON_LUCY, PSF: map[string]string{common.BLUE: "missing.png"}}, wantErr: true},
+		{name: "unknown method", config: common.SharpenConfig{Method: "wiener"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img := blurredDot()
+			sharpened, err := Sharpen(img, test.config, dir)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Sharpen() error = %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if sharpened.Bounds() != img.Bounds() {
+				t.Fatalf("sharpened bounds = %v, want %v", sharpened.Bounds(), img.Bounds())
+			}
+
+			for c, channel := range []string{"red", "green", "blue"} {
+				before, after := float64(img.Pix[img.PixOffset(10, 10)+c]), float64(sharpened.Pix[sharpened.PixOffset(10, 10)+c])
+				switch test.want {
+				case "sharper":
+					if after <= before {
+						t.Errorf("%s peak = %g, want it raised above %g", channel, after, before)
+					}
+				case "same":
+					if math.Abs(after-before) > 1 {
+						t.Errorf("%s peak = %g, want %g", channel, after, before)
+					}
+				}
+			}
+		})
+	}
+}
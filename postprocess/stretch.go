@@ -0,0 +1,226 @@
+package postprocess
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"math"
+)
+
+// The supported contrast stretch methods.
+const (
+	LINEAR = "linear"
+	GAMMA  = "gamma"
+	ASINH  = "asinh"
+	CLAHE  = "clahe"
+)
+
+// A value below which a pixel is treated as black when linking channels.
+const epsilon = 1e-6
+
+// stretchDefaults fills in any unset stretch parameters.
+func stretchDefaults(config common.StretchConfig) common.StretchConfig {
+	if config.Low == 0 && config.High == 0 {
+		config.Low, config.High = 0.5, 99.5
+	}
+	if config.Gamma == 0 {
+		config.Gamma = 2.2
+	}
+	if config.Softening == 0 {
+		config.Softening = 10
+	}
+	if config.ClipLimit == 0 {
+		config.ClipLimit = 2
+	}
+	if config.Tiles == 0 {
+		config.Tiles = 8
+	}
+	return config
+}
+
+// DescribeStretch returns a summary of the stretch settings suitable for image metadata.
+func DescribeStretch(config common.StretchConfig) string {
+	config = stretchDefaults(config)
+
+	description := fmt.Sprintf("%s low=%g high=%g", config.Method, config.Low, config.High)
+	switch config.Method {
+	case GAMMA:
+		description += fmt.Sprintf(" gamma=%g", config.Gamma)
+	case ASINH:
+		description += fmt.Sprintf(" softening=%g", config.Softening)
+	case CLAHE:
+		description += fmt.Sprintf(" clipLimit=%g tiles=%d", config.ClipLimit, config.Tiles)
+	}
+
+	if config.PerChannel {
+		return description + " per-channel"
+	}
+	return description + " linked"
+}
+
+// curve applies the tone curve of a stretch method to a normalized plane in place.
+func curve(plane *common.Plane, config common.StretchConfig) {
+	switch config.Method {
+	case GAMMA:
+		for i, v := range plane.Pix {
+			plane.Pix[i] = math.Pow(common.Clamp(v, 0, 1), 1/config.Gamma)
+		}
+	case ASINH:
+		scale := math.Asinh(config.Softening)
+		for i, v := range plane.Pix {
+			plane.Pix[i] = math.Asinh(config.Softening*common.Clamp(v, 0, 1)) / scale
+		}
+	case CLAHE:
+		equalized := clahe(plane, config.ClipLimit, config.Tiles)
+		copy(plane.Pix, equalized.Pix)
+	default:
+		for i, v := range plane.Pix {
+			plane.Pix[i] = common.Clamp(v, 0, 1)
+		}
+	}
+}
+
+// normalize maps the values between the black and white points to [0, 1] in place.
+func normalize(plane *common.Plane, black, white float64) {
+	scale := white - black
+	if scale < epsilon {
+		scale = 1
+	}
+	for i, v := range plane.Pix {
+		plane.Pix[i] = (v - black) / scale
+	}
+}
+
+// Stretch applies a contrast stretch to a color image. The percentiles of the image are
+// mapped to black and white and then a tone curve is applied. Linked stretches compute
+// the curve on the luminance and scale each channel by the same factor so color ratios
+// are preserved, per channel stretches treat each channel as a separate image.
+// It returns the stretched image and any error encountered.
+func Stretch(img *image.RGBA, config common.StretchConfig) (*image.RGBA, error) {
+	switch config.Method {
+	case LINEAR, GAMMA, ASINH, CLAHE:
+	default:
+		return nil, fmt.Errorf("unknown stretch method %q, expected one of %s, %s, %s or %s",
+			config.Method, LINEAR, GAMMA, ASINH, CLAHE)
+	}
+	config = stretchDefaults(config)
+
+	planes := common.PlanesFromRGBA(img)
+
+	if config.PerChannel {
+		for _, plane := range planes {
+			normalize(plane, common.Percentile(plane.Pix, config.Low), common.Percentile(plane.Pix, config.High))
+			curve(plane, config)
+		}
+		return common.RGBAFromPlanes(planes), nil
+	}
+
+	luminance := common.NewPlane(img.Bounds())
+	for i := range luminance.Pix {
+		luminance.Pix[i] = (planes[0].Pix[i] + planes[1].Pix[i] + planes[2].Pix[i]) / 3
+	}
+	black := common.Percentile(luminance.Pix, config.Low)
+	white := common.Percentile(luminance.Pix, config.High)
+
+	normalize(luminance, black, white)
+	stretched := luminance.Clone()
+	curve(stretched, config)
+
+	for _, plane := range planes {
+		normalize(plane, black, white)
+		for i, v := range plane.Pix {
+			if luminance.Pix[i] < epsilon {
+				plane.Pix[i] = stretched.Pix[i]
+				continue
+			}
+			plane.Pix[i] = v * stretched.Pix[i] / luminance.Pix[i]
+		}
+	}
+
+	return common.RGBAFromPlanes(planes), nil
+}
+
+// clahe performs contrast limited adaptive histogram equalization on a normalized plane.
+// The plane is split into tiles per side, each tile's histogram is clipped to
+// clipLimit times the mean bin count and equalized, and the resulting mappings are
+// bilinearly interpolated between tile centers.
+// It returns the equalized plane.
+func clahe(plane *common.Plane, clipLimit float64, tiles int) *common.Plane {
+	const bins = 256
+	bounds := plane.Rect
+	width, height := bounds.Dx(), bounds.Dy()
+	if tiles > width || tiles > height {
+		tiles = int(math.Max(1, math.Min(float64(width), float64(height))))
+	}
+	tileW := float64(width) / float64(tiles)
+	tileH := float64(height) / float64(tiles)
+
+	bin := func(v float64) int {
+		return int(common.Clamp(v, 0, 1) * (bins - 1))
+	}
+
+	mappings := make([][bins]float64, tiles*tiles)
+	for ty := 0; ty < tiles; ty++ {
+		for tx := 0; tx < tiles; tx++ {
+			tile := image.Rect(tx*width/tiles, ty*height/tiles, (tx+1)*width/tiles, (ty+1)*height/tiles).
+				Add(bounds.Min)
+
+			var histogram [bins]float64
+			for y := tile.Min.Y; y < tile.Max.Y; y++ {
+				for x := tile.Min.X; x < tile.Max.X; x++ {
+					histogram[bin(plane.At(x, y))]++
+				}
+			}
+
+			total := float64(tile.Dx() * tile.Dy())
+			limit := math.Max(1, clipLimit*total/bins)
+			excess := 0.0
+			for i, count := range histogram {
+				if count > limit {
+					excess += count - limit
+					histogram[i] = limit
+				}
+			}
+
+			cumulative := 0.0
+			mapping := &mappings[ty*tiles+tx]
+			for i, count := range histogram {
+				cumulative += count + excess/bins
+				mapping[i] = cumulative / total
+			}
+		}
+	}
+
+	// tilePosition finds the two tiles whose centers surround a coordinate and the
+	// weight of the second tile.
+	tilePosition := func(v int, size float64) (int, int, float64) {
+		f := (float64(v)+0.5)/size - 0.5
+		t0 := int(math.Floor(f))
+		weight := f - float64(t0)
+		if t0 < 0 {
+			t0, weight = 0, 0
+		}
+		t1 := t0 + 1
+		if t1 >= tiles {
+			t1 = tiles - 1
+		}
+		if t0 >= tiles-1 {
+			t0, weight = tiles-1, 0
+		}
+		return t0, t1, weight
+	}
+
+	equalized := common.NewPlane(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		ty0, ty1, wy := tilePosition(y-bounds.Min.Y, tileH)
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			tx0, tx1, wx := tilePosition(x-bounds.Min.X, tileW)
+			b := bin(plane.At(x, y))
+			top := (1-wx)*mappings[ty0*tiles+tx0][b] + wx*mappings[ty0*tiles+tx1][b]
+			bottom := (1-wx)*mappings[ty1*tiles+tx0][b] + wx*mappings[ty1*tiles+tx1][b]
+			equalized.Set(x, y, (1-wy)*top+wy*bottom)
+		}
+	}
+
+	return equalized
+}
@@ -0,0 +1,283 @@
+package postprocess
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The supported white balance modes.
+const (
+	GRAY_WORLD = "gray-world"
+	REGION     = "region"
+	FILTER     = "filter"
+)
+
+// Channel values outside of this range are ignored when estimating gains since they
+// are most likely background or saturated.
+const (
+	minBalanceValue = 0.02
+	maxBalanceValue = 0.98
+)
+
+// channelFilters maps the red, green and blue channels of a composite to filters.
+var channelFilters = [3]string{common.RED, common.GREEN, common.BLUE}
+
+// channelMeans computes the mean of each channel over the pixels in a region where
+// all channels are within the usable range.
+func channelMeans(planes [3]*common.Plane, region image.Rectangle) ([3]float64, error) {
+	var sums [3]float64
+	count := 0
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			values := [3]float64{planes[0].At(x, y), planes[1].At(x, y), planes[2].At(x, y)}
+			usable := true
+			for _, v := range values {
+				if v < minBalanceValue || v > maxBalanceValue {
+					usable = false
+				}
+			}
+			if !usable {
+				continue
+			}
+			for c, v := range values {
+				sums[c] += v
+			}
+			count++
+		}
+	}
+
+	if count == 0 {
+		return sums, fmt.Errorf("no usable pixels in %s to balance", region)
+	}
+
+	for c := range sums {
+		sums[c] /= float64(count)
+	}
+	return sums, nil
+}
+
+// sampledCurve is a function of wavelength, such as a filter transmission curve or a spectrum,
+// sampled at increasing wavelengths.
+type sampledCurve struct {
+	wavelengths []float64
+	values      []float64
+}
+
+// loadCurve reads a curve from a text file with a wavelength and a value on each line,
+// separated by spaces, tabs or a comma. Blank lines and lines starting with # are
+// skipped, as are any columns after the second.
+// It returns the curve sorted by wavelength and any error encountered.
+func loadCurve(curvePath string) (sampledCurve, error) {
+	f, err := os.Open(curvePath)
+	if err != nil {
+		return sampledCurve{}, fmt.Errorf("error opening curve %s: %s", curvePath, err)
+	}
+	defer f.Close()
+
+	type sample struct{ wavelength, value float64 }
+	var samples []sample
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		if len(fields) < 2 {
+			return sampledCurve{}, fmt.Errorf("curve %s line %d: expected a wavelength and a value", curvePath, line)
+		}
+		var values [2]float64
+		for i := range values {
+			if values[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+				return sampledCurve{}, fmt.Errorf("curve %s line %d: %s", curvePath, line, err)
+			}
+		}
+		samples = append(samples, sample{values[0], values[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return sampledCurve{}, fmt.Errorf("error reading curve %s: %s", curvePath, err)
+	}
+	if len(samples) < 2 {
+		return sampledCurve{}, fmt.Errorf("curve %s needs at least two samples", curvePath)
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i].wavelength < samples[j].wavelength })
+	c := sampledCurve{make([]float64, len(samples)), make([]float64, len(samples))}
+	for i, s := range samples {
+		c.wavelengths[i], c.values[i] = s.wavelength, s.value
+	}
+	return c, nil
+}
+
+// at returns the value of the curve at a wavelength, interpolated linearly between the
+// samples around it and 0 outside the curve.
+func (c sampledCurve) at(wavelength float64) float64 {
+	n := len(c.wavelengths)
+	if n == 0 || wavelength < c.wavelengths[0] || wavelength > c.wavelengths[n-1] {
+		return 0
+	}
+	i := sort.SearchFloat64s(c.wavelengths, wavelength)
+	if c.wavelengths[i] == wavelength || i == 0 {
+		return c.values[i]
+	}
+	t := (wavelength - c.wavelengths[i-1]) / (c.wavelengths[i] - c.wavelengths[i-1])
+	return c.values[i-1] + t*(c.values[i]-c.values[i-1])
+}
+
+// throughput integrates a transmission curve weighted by a spectrum, or by a flat
+// spectrum when nil, with the trapezoid rule over the samples of both curves within the
+// transmission curve.
+// It returns the relative amount of light the filter lets through.
+func throughput(transmission sampledCurve, spectrum *sampledCurve) float64 {
+	wavelengths := append([]float64(nil), transmission.wavelengths...)
+	if spectrum != nil {
+		low, high := wavelengths[0], wavelengths[len(wavelengths)-1]
+		for _, w := range spectrum.wavelengths {
+			if w > low && w < high {
+				wavelengths = append(wavelengths, w)
+			}
+		}
+		sort.Float64s(wavelengths)
+	}
+
+	weighted := func(w float64) float64 {
+		v := transmission.at(w)
+		if spectrum != nil {
+			v *= spectrum.at(w)
+		}
+		return v
+	}
+	total := 0.0
+	for i := 1; i < len(wavelengths); i++ {
+		total += (weighted(wavelengths[i-1]) + weighted(wavelengths[i])) / 2 * (wavelengths[i] - wavelengths[i-1])
+	}
+	return total
+}
+
+// filterGains computes the gain of each channel relative to green as the throughput of
+// the green filter over the throughput of its filter, integrated from the transmission
+// curves of the config, unless the config gives the gain of the filter. Curves are
+// loaded relative to root.
+// It returns the red, green and blue gains and any error encountered.
+func filterGains(config common.WhiteBalanceConfig, root string) ([3]float64, error) {
+	var gains [3]float64
+
+	var spectrum *sampledCurve
+	if config.Spectrum != "" {
+		loaded, err := loadCurve(path.Join(root, config.Spectrum))
+		if err != nil {
+			return gains, err
+		}
+		spectrum = &loaded
+	}
+
+	throughputs := make(map[string]float64)
+	for _, filter := range channelFilters {
+		curvePath, ok := config.Curves[filter]
+		if !ok {
+			continue
+		}
+		transmission, err := loadCurve(path.Join(root, curvePath))
+		if err != nil {
+			return gains, err
+		}
+		t := throughput(transmission, spectrum)
+		if t <= 0 {
+			return gains, fmt.Errorf("transmission curve %s of filter %s lets no light through", curvePath, filter)
+		}
+		throughputs[filter] = t
+	}
+
+	for c, filter := range channelFilters {
+		if gain, ok := config.Gains[filter]; ok {
+			gains[c] = gain
+			continue
+		}
+		t, ok := throughputs[filter]
+		if !ok {
+			return gains, fmt.Errorf("white balance mode %s needs a transmission curve or a gain for filter %s", FILTER, filter)
+		}
+		green, ok := throughputs[common.GREEN]
+		if !ok {
+			return gains, fmt.Errorf("white balance mode %s needs the transmission curve of %s to scale the curve of %s", FILTER, common.GREEN, filter)
+		}
+		gains[c] = green / t
+	}
+	return gains, nil
+}
+
+// balanceGains computes the gain for the red, green and blue channels. Gains are
+// normalized so green is unchanged. Any files the filter mode needs are loaded
+// relative to root.
+func balanceGains(planes [3]*common.Plane, config common.WhiteBalanceConfig, root string) ([3]float64, error) {
+	var gains [3]float64
+
+	switch config.Mode {
+	case GRAY_WORLD, REGION:
+		region := planes[0].Rect
+		if config.Mode == REGION {
+			if config.Region == nil {
+				return gains, fmt.Errorf("white balance mode %s requires a region", REGION)
+			}
+			region = config.Region.Rectangle().Intersect(region)
+		}
+		means, err := channelMeans(planes, region)
+		if err != nil {
+			return gains, err
+		}
+		for c := range gains {
+			gains[c] = means[1] / means[c]
+		}
+	case FILTER:
+		var err error
+		if gains, err = filterGains(config, root); err != nil {
+			return gains, err
+		}
+		for c := range gains {
+			gains[c] /= gains[1]
+		}
+	default:
+		return gains, fmt.Errorf("unknown white balance mode %q, expected one of %s, %s or %s",
+			config.Mode, GRAY_WORLD, REGION, FILTER)
+	}
+
+	return gains, nil
+}
+
+// DescribeWhiteBalance returns a summary of the white balance suitable for image metadata.
+func DescribeWhiteBalance(config common.WhiteBalanceConfig, gains [3]float64) string {
+	description := config.Mode
+	if config.Mode == REGION && config.Region != nil {
+		description += fmt.Sprintf(" region=%s", config.Region.Rectangle())
+	}
+	return fmt.Sprintf("%s gains=%.3f,%.3f,%.3f", description, gains[0], gains[1], gains[2])
+}
+
+// WhiteBalance scales the channels of a composite so the gray world average, a
+// reference region or the filter throughputs produce a neutral color. Any files the
+// filter mode needs are loaded relative to root.
+// It returns the balanced image, the red, green and blue gains applied and any error
+// encountered.
+func WhiteBalance(img *image.RGBA, config common.WhiteBalanceConfig, root string) (*image.RGBA, [3]float64, error) {
+	planes := common.PlanesFromRGBA(img)
+
+	gains, err := balanceGains(planes, config, root)
+	if err != nil {
+		return nil, gains, err
+	}
+
+	for c, plane := range planes {
+		for i, v := range plane.Pix {
+			plane.Pix[i] = v * gains[c]
+		}
+	}
+
+	return common.RGBAFromPlanes(planes), gains, nil
+}
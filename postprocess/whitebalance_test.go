@@ -0,0 +1,63 @@
+package postprocess
+
+import (
+	"github.com/lewchuk/gostitcher/common"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// writeCurve writes a curve file of wavelength and value pairs to a directory.
+func writeCurve(t *testing.T, dir, name, content string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("writing curve %s: %s", name, err)
+	}
+}
+
+func TestFilterGains(t *testing.T) {
+	dir := t.TempDir()
+	// Box curves with throughputs of 50, 100 and 80 over a flat spectrum.
+	writeCurve(t, dir, "bl1.txt", "# wavelength transmission\n400 0.5\n500 0.5\n")
+	writeCurve(t, dir, "grn.txt", "500, 1\n600, 1\n")
+	writeCurve(t, dir, "red.txt", "600\t0.8\n700\t0.8\n")
+	// A spectrum twice as bright in the blue as elsewhere.
+	writeCurve(t, dir, "sun.txt", "300 2\n500 2\n500.001 1\n800 1\n")
+	curves := map[string]string{common.BLUE: "bl1.txt", common.GREEN: "grn.txt", common.RED: "red.txt"}
+
+	tests := []struct {
+		name    string
+		config  common.WhiteBalanceConfig
+		want    [3]float64
+		wantErr bool
+	}{
+		{"flat spectrum", common.WhiteBalanceConfig{Curves: curves}, [3]float64{1.25, 1, 2}, false},
+		{"weighted by spectrum", common.WhiteBalanceConfig{Curves: curves, Spectrum: "sun.txt"}, [3]float64{1.25, 1, 1}, false},
+		{"gain overrides curve", common.WhiteBalanceConfig{Curves: curves, Gains: map[string]float64{common.BLUE: 1.3}}, [3]float64{1.25, 1, 1.3}, false},
+		{"missing curve", common.WhiteBalanceConfig{Curves: map[string]string{common.GREEN: "grn.txt"}}, [3]float64{}, true},
+		{"missing green curve", common.WhiteBalanceConfig{Curves: map[string]string{common.BLUE: "bl1.txt", common.RED: "red.txt"}}, [3]float64{}, true},
+		{"gains only", common.WhiteBalanceConfig{Gains: map[string]float64{common.BLUE: 2, common.GREEN: 1, common.RED: 1.5}}, [3]float64{1.5, 1, 2}, false},
+		{"unreadable curve", common.WhiteBalanceConfig{Curves: map[string]string{common.BLUE: "missing.txt", common.GREEN: "grn.txt", common.RED: "red.txt"}}, [3]float64{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gains, err := filterGains(tt.config, dir)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got gains %v", gains)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			for c := range gains {
+				if math.Abs(gains[c]-tt.want[c]) > 1e-3 {
+					t.Errorf("gains %v, expected %v", gains, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
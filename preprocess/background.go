@@ -0,0 +1,219 @@
+package preprocess
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"math"
+)
+
+// The supported background modes.
+const (
+	SKY        = "sky"
+	POLYNOMIAL = "polynomial"
+)
+
+// The size in pixels of the blocks sampled when fitting a polynomial background.
+const backgroundBlock = 32
+
+// backgroundDefaults fills in any unset background parameters.
+func backgroundDefaults(config common.BackgroundConfig) common.BackgroundConfig {
+	if config.Order == 0 {
+		config.Order = 2
+	}
+	if config.Sigma == 0 {
+		config.Sigma = 3
+	}
+	return config
+}
+
+// meanStd returns the mean and standard deviation of a set of values.
+func meanStd(values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+	sum, sumSq := 0.0, 0.0
+	for _, v := range values {
+		sum += v
+		sumSq += v * v
+	}
+	mean := sum / float64(len(values))
+	return mean, math.Sqrt(math.Max(0, sumSq/float64(len(values))-mean*mean))
+}
+
+// sigmaClip repeatedly discards values more than sigma standard deviations from the
+// median until no more values are discarded.
+// It returns the median of the remaining values.
+func sigmaClip(values []float64, sigma float64) float64 {
+	for iteration := 0; iteration < 10; iteration++ {
+		median := common.Percentile(values, 50)
+		_, std := meanStd(values)
+		kept := values[:0:0]
+		for _, v := range values {
+			if math.Abs(v-median) <= sigma*std {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) == len(values) || len(kept) == 0 {
+			return median
+		}
+		values = kept
+	}
+	return common.Percentile(values, 50)
+}
+
+// polynomialTerms returns the values of the terms x^i * y^j with i + j <= order.
+func polynomialTerms(x, y float64, order int) []float64 {
+	var terms []float64
+	for i := 0; i <= order; i++ {
+		for j := 0; i+j <= order; j++ {
+			terms = append(terms, math.Pow(x, float64(i))*math.Pow(y, float64(j)))
+		}
+	}
+	return terms
+}
+
+type backgroundSample struct {
+	x, y, value float64
+}
+
+// fitPolynomial fits a polynomial to samples by least squares.
+// It returns the coefficients of the terms and any error encountered.
+func fitPolynomial(samples []backgroundSample, order int) ([]float64, error) {
+	n := len(polynomialTerms(0, 0, order))
+	if len(samples) < n {
+		return nil, fmt.Errorf("%d background samples are not enough to fit an order %d polynomial", len(samples), order)
+	}
+
+	a := make([][]float64, n)
+	for i := range a {
+		a[i] = make([]float64, n)
+	}
+	b := make([]float64, n)
+	for _, sample := range samples {
+		terms := polynomialTerms(sample.x, sample.y, order)
+		for i := range terms {
+			for j := range terms {
+				a[i][j] += terms[i] * terms[j]
+			}
+			b[i] += terms[i] * sample.value
+		}
+	}
+
+	return common.Solve(a, b)
+}
+
+// normalizedCoordinate maps a coordinate to [-1, 1] across the size of the image to
+// keep the polynomial fit well conditioned.
+func normalizedCoordinate(v float64, min, size int) float64 {
+	return 2*(v-float64(min))/float64(size) - 1
+}
+
+// polynomialBackground models the background by fitting a polynomial to the sigma
+// clipped median of blocks of the image, rejecting blocks that contain objects.
+func polynomialBackground(plane *common.Plane, config common.BackgroundConfig) (*common.Plane, error) {
+	bounds := plane.Rect
+
+	var samples []backgroundSample
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += backgroundBlock {
+		for x := bounds.Min.X; x < bounds.Max.X; x += backgroundBlock {
+			block := image.Rect(x, y, x+backgroundBlock, y+backgroundBlock).Intersect(bounds)
+			values := make([]float64, 0, block.Dx()*block.Dy())
+			for by := block.Min.Y; by < block.Max.Y; by++ {
+				for bx := block.Min.X; bx < block.Max.X; bx++ {
+					values = append(values, plane.At(bx, by))
+				}
+			}
+			center := image.Pt((block.Min.X+block.Max.X)/2, (block.Min.Y+block.Max.Y)/2)
+			samples = append(samples, backgroundSample{
+				normalizedCoordinate(float64(center.X), bounds.Min.X, bounds.Dx()),
+				normalizedCoordinate(float64(center.Y), bounds.Min.Y, bounds.Dy()),
+				sigmaClip(values, config.Sigma),
+			})
+		}
+	}
+
+	var coefficients []float64
+	for iteration := 0; iteration < 5; iteration++ {
+		var err error
+		coefficients, err = fitPolynomial(samples, config.Order)
+		if err != nil {
+			return nil, err
+		}
+
+		residuals := make([]float64, len(samples))
+		for i, sample := range samples {
+			residuals[i] = sample.value - evaluate(coefficients, sample.x, sample.y, config.Order)
+		}
+		_, std := meanStd(residuals)
+
+		// Blocks much brighter or darker than the model contain objects rather than sky.
+		kept := samples[:0:0]
+		for i, sample := range samples {
+			if math.Abs(residuals[i]) <= config.Sigma*std {
+				kept = append(kept, sample)
+			}
+		}
+		if len(kept) == len(samples) {
+			break
+		}
+		samples = kept
+	}
+
+	model := common.NewPlane(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		ny := normalizedCoordinate(float64(y), bounds.Min.Y, bounds.Dy())
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			nx := normalizedCoordinate(float64(x), bounds.Min.X, bounds.Dx())
+			model.Set(x, y, evaluate(coefficients, nx, ny, config.Order))
+		}
+	}
+
+	return model, nil
+}
+
+func evaluate(coefficients []float64, x, y float64, order int) float64 {
+	value := 0.0
+	for i, term := range polynomialTerms(x, y, order) {
+		value += coefficients[i] * term
+	}
+	return value
+}
+
+// EstimateBackground models the background of a filter image, either as a single
+// sigma clipped sky level or as a low order polynomial for gradients.
+// It returns the background model and any error encountered.
+func EstimateBackground(plane *common.Plane, config common.BackgroundConfig) (*common.Plane, error) {
+	config = backgroundDefaults(config)
+
+	switch config.Mode {
+	case SKY:
+		level := sigmaClip(plane.Pix, config.Sigma)
+		model := common.NewPlane(plane.Rect)
+		for i := range model.Pix {
+			model.Pix[i] = level
+		}
+		return model, nil
+	case POLYNOMIAL:
+		return polynomialBackground(plane, config)
+	}
+
+	return nil, fmt.Errorf("unknown background mode %q, expected %s or %s", config.Mode, SKY, POLYNOMIAL)
+}
+
+// SubtractBackground estimates the background of a filter image and subtracts it.
+// It returns the corrected image, the background model and any error encountered.
+func SubtractBackground(img *image.Gray, config common.BackgroundConfig) (*image.Gray, *common.Plane, error) {
+	plane := common.PlaneFromGray(img)
+
+	model, err := EstimateBackground(plane, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, v := range plane.Pix {
+		plane.Pix[i] = v - model.Pix[i]
+	}
+
+	return plane.Gray(), model, nil
+}
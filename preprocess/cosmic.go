@@ -0,0 +1,217 @@
+package preprocess
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// The supported cosmic ray detection methods.
+const (
+	MEDIAN    = "median"
+	LAPLACIAN = "laplacian"
+)
+
+// Scales a median absolute deviation to a standard deviation for gaussian noise.
+const madScale = 1.4826
+
+// Laplacian detections must also be this many times sharper than the fine structure
+// of the image around them, which keeps real features like limbs and craters.
+const laplacianContrast = 5
+
+// cosmicDefaults fills in any unset cosmic ray parameters.
+func cosmicDefaults(config common.CosmicConfig) common.CosmicConfig {
+	if config.Method == "" {
+		config.Method = MEDIAN
+	}
+	if config.Sigma == 0 {
+		config.Sigma = 5
+	}
+	return config
+}
+
+// median returns the median of values, reordering them.
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	return values[len(values)/2]
+}
+
+// neighbours returns the values in the square of the given radius around a point,
+// excluding the point itself and anything outside the plane.
+func neighbours(plane *common.Plane, x, y, radius int, values []float64) []float64 {
+	values = values[:0]
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			if dx == 0 && dy == 0 || !image.Pt(x+dx, y+dy).In(plane.Rect) {
+				continue
+			}
+			values = append(values, plane.At(x+dx, y+dy))
+		}
+	}
+	return values
+}
+
+// medianFilter returns a plane where each value is the median of the square of the
+// given radius around it.
+func medianFilter(plane *common.Plane, radius int) *common.Plane {
+	bounds := plane.Rect
+	filtered := common.NewPlane(bounds)
+	values := make([]float64, 0, (2*radius+1)*(2*radius+1))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			values = append(neighbours(plane, x, y, radius, values), plane.At(x, y))
+			filtered.Set(x, y, median(values))
+		}
+	}
+	return filtered
+}
+
+// noiseLevel estimates the standard deviation of the noise from the median absolute
+// deviation of the residuals between a plane and its median filtered version.
+func noiseLevel(plane, smoothed *common.Plane) float64 {
+	residuals := make([]float64, len(plane.Pix))
+	for i, v := range plane.Pix {
+		residuals[i] = math.Abs(v - smoothed.Pix[i])
+	}
+	// Noise is never below the quantization of an 8 bit image.
+	return math.Max(madScale*median(residuals), 1.0/255)
+}
+
+// medianOutliers flags pixels brighter than the median of their neighbours by more
+// than sigma times the larger of the image noise and the spread of the neighbours.
+func medianOutliers(plane *common.Plane, sigma float64) []bool {
+	bounds := plane.Rect
+	noise := noiseLevel(plane, medianFilter(plane, 1))
+	mask := make([]bool, len(plane.Pix))
+	values := make([]float64, 0, 8)
+	deviations := make([]float64, 0, 8)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			values = neighbours(plane, x, y, 1, values)
+			m := median(values)
+
+			deviations = deviations[:0]
+			for _, v := range values {
+				deviations = append(deviations, math.Abs(v-m))
+			}
+			spread := math.Max(noise, madScale*median(deviations))
+
+			if plane.At(x, y)-m > sigma*spread {
+				mask[(y-bounds.Min.Y)*bounds.Dx()+(x-bounds.Min.X)] = true
+			}
+		}
+	}
+
+	return mask
+}
+
+// laplacianOutliers flags pixels with a sharp positive Laplacian edge, following the
+// approach of L.A.Cosmic: the Laplacian must exceed sigma times the local noise and be
+// sharper than the fine structure of the surrounding image.
+func laplacianOutliers(plane *common.Plane, sigma float64) []bool {
+	bounds := plane.Rect
+	median3 := medianFilter(plane, 1)
+	median7 := medianFilter(median3, 3)
+	globalNoise := noiseLevel(plane, median3)
+
+	// The noise varies with brightness so estimate it locally from the spread of the
+	// residuals around each pixel.
+	residuals := common.NewPlane(bounds)
+	for i, v := range plane.Pix {
+		residuals.Pix[i] = math.Abs(v - median3.Pix[i])
+	}
+	localNoise := medianFilter(residuals, 3)
+	mask := make([]bool, len(plane.Pix))
+	values := make([]float64, 0, 8)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			v := plane.At(x, y)
+			noise := math.Max(globalNoise, madScale*localNoise.At(x, y))
+			laplacian := v - (plane.At(x-1, y)+plane.At(x+1, y)+plane.At(x, y-1)+plane.At(x, y+1))/4
+			if laplacian <= sigma*noise {
+				continue
+			}
+			// Hits are peaks covering a pixel or two, unlike the edges of limbs which
+			// have bright neighbours along the edge.
+			brighter := 0
+			for _, neighbour := range neighbours(plane, x, y, 1, values) {
+				if neighbour >= v {
+					brighter++
+				}
+			}
+			if brighter > 1 {
+				continue
+			}
+			fine := math.Max(median3.At(x, y)-median7.At(x, y), noise)
+			if laplacian/fine > laplacianContrast {
+				mask[(y-bounds.Min.Y)*bounds.Dx()+(x-bounds.Min.X)] = true
+			}
+		}
+	}
+
+	return mask
+}
+
+// CleanCosmicRays detects cosmic ray hits and hot pixels in a filter image and replaces
+// them with the median of the surrounding pixels that were not flagged.
+// It returns the cleaned image, a mask of the replaced pixels, the number of pixels
+// replaced and any error encountered.
+func CleanCosmicRays(img *image.Gray, config common.CosmicConfig) (*image.Gray, *image.Gray, int, error) {
+	config = cosmicDefaults(config)
+	plane := common.PlaneFromGray(img)
+	bounds := plane.Rect
+
+	var flagged []bool
+	switch config.Method {
+	case MEDIAN:
+		flagged = medianOutliers(plane, config.Sigma)
+	case LAPLACIAN:
+		flagged = laplacianOutliers(plane, config.Sigma)
+	default:
+		return nil, nil, 0, fmt.Errorf("unknown cosmic ray method %q, expected %s or %s",
+			config.Method, MEDIAN, LAPLACIAN)
+	}
+
+	cleaned := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := img.PixOffset(bounds.Min.X, y)
+		copy(cleaned.Pix[cleaned.PixOffset(bounds.Min.X, y):], img.Pix[row:row+bounds.Dx()])
+	}
+	mask := image.NewGray(bounds)
+	count := 0
+	values := make([]float64, 0, 24)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if !flagged[(y-bounds.Min.Y)*bounds.Dx()+(x-bounds.Min.X)] {
+				continue
+			}
+			values = values[:0]
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					p := image.Pt(x+dx, y+dy)
+					if !p.In(bounds) || flagged[(p.Y-bounds.Min.Y)*bounds.Dx()+(p.X-bounds.Min.X)] {
+						continue
+					}
+					values = append(values, plane.At(p.X, p.Y))
+				}
+			}
+			if len(values) == 0 {
+				continue
+			}
+			cleaned.SetGray(x, y, color.Gray{common.ToUint8(median(values))})
+			mask.SetGray(x, y, color.Gray{255})
+			count++
+		}
+	}
+
+	return cleaned, mask, count, nil
+}
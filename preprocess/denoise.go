@@ -0,0 +1,185 @@
+package preprocess
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"math"
+)
+
+// The supported denoising methods.
+const (
+	BILATERAL = "bilateral"
+	NLM       = "nlm"
+	WAVELET   = "wavelet"
+)
+
+// The standard deviation of each scale of the a trous wavelet transform of unit
+// gaussian noise, used to threshold each scale relative to the image noise.
+var waveletNoise = []float64{0.890, 0.201, 0.086, 0.042, 0.021, 0.010}
+
+// denoiseDefaults fills in any unset denoising parameters.
+func denoiseDefaults(config common.DenoiseConfig) common.DenoiseConfig {
+	if config.Strength == 0 {
+		config.Strength = 1
+	}
+	if config.Radius == 0 {
+		config.Radius = 3
+		if config.Method == NLM {
+			config.Radius = 5
+		}
+	}
+	if config.Levels == 0 {
+		config.Levels = 4
+	}
+	if config.Levels > len(waveletNoise) {
+		config.Levels = len(waveletNoise)
+	}
+	return config
+}
+
+// bilateral averages the neighbourhood of each pixel weighted both by distance and by
+// how close the neighbours are in value, which smooths noise but keeps edges.
+func bilateral(plane *common.Plane, radius int, rangeSigma float64) *common.Plane {
+	spatialSigma := float64(radius) / 2
+	bounds := plane.Rect
+	filtered := common.NewPlane(bounds)
+	common.ParallelRows(bounds, func(_ int, rows image.Rectangle) {
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := rows.Min.X; x < rows.Max.X; x++ {
+				centre := plane.At(x, y)
+				sum, total := 0.0, 0.0
+				for dy := -radius; dy <= radius; dy++ {
+					for dx := -radius; dx <= radius; dx++ {
+						v := plane.ClampedAt(x+dx, y+dy)
+						d := v - centre
+						w := math.Exp(-float64(dx*dx+dy*dy)/(2*spatialSigma*spatialSigma) - d*d/(2*rangeSigma*rangeSigma))
+						sum += w * v
+						total += w
+					}
+				}
+				filtered.Set(x, y, sum/total)
+			}
+		}
+	})
+	return filtered
+}
+
+// nonLocalMeans averages the pixels within radius of each pixel weighted by how similar
+// the 3x3 patches around them are, following Buades, Coll and Morel. Differences
+// expected from noise of the given level are not penalized.
+func nonLocalMeans(plane *common.Plane, radius int, noise, h float64) *common.Plane {
+	bounds := plane.Rect
+	filtered := common.NewPlane(bounds)
+	common.ParallelRows(bounds, func(_ int, rows image.Rectangle) {
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := rows.Min.X; x < rows.Max.X; x++ {
+				sum, total := 0.0, 0.0
+				for sy := y - radius; sy <= y+radius; sy++ {
+					for sx := x - radius; sx <= x+radius; sx++ {
+						if !image.Pt(sx, sy).In(bounds) {
+							continue
+						}
+						distance := 0.0
+						for py := -1; py <= 1; py++ {
+							for px := -1; px <= 1; px++ {
+								d := plane.ClampedAt(x+px, y+py) - plane.ClampedAt(sx+px, sy+py)
+								distance += d * d
+							}
+						}
+						distance /= 9
+						w := math.Exp(-math.Max(distance-2*noise*noise, 0) / (h * h))
+						sum += w * plane.At(sx, sy)
+						total += w
+					}
+				}
+				filtered.Set(x, y, sum/total)
+			}
+		}
+	})
+	return filtered
+}
+
+// atrousSmooth convolves a plane with the B3 spline kernel spread out with holes of
+// step pixels, one scale of the a trous wavelet transform.
+func atrousSmooth(plane *common.Plane, step int) *common.Plane {
+	kernel := [5]float64{1.0 / 16, 4.0 / 16, 6.0 / 16, 4.0 / 16, 1.0 / 16}
+	bounds := plane.Rect
+	horizontal := common.NewPlane(bounds)
+	smoothed := common.NewPlane(bounds)
+	common.ParallelRows(bounds, func(_ int, rows image.Rectangle) {
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := rows.Min.X; x < rows.Max.X; x++ {
+				sum := 0.0
+				for i, k := range kernel {
+					sum += k * plane.ClampedAt(x+(i-2)*step, y)
+				}
+				horizontal.Set(x, y, sum)
+			}
+		}
+	})
+	common.ParallelRows(bounds, func(_ int, rows image.Rectangle) {
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := rows.Min.X; x < rows.Max.X; x++ {
+				sum := 0.0
+				for i, k := range kernel {
+					sum += k * horizontal.ClampedAt(x, y+(i-2)*step)
+				}
+				smoothed.Set(x, y, sum)
+			}
+		}
+	})
+	return smoothed
+}
+
+// waveletDenoise splits a plane into detail scales with the a trous wavelet transform,
+// shrinks the coefficients of each scale towards zero by threshold times the noise
+// expected at that scale and adds the scales back together.
+func waveletDenoise(plane *common.Plane, levels int, noise, threshold float64) *common.Plane {
+	denoised := common.NewPlane(plane.Rect)
+	current := plane
+	for level := 0; level < levels; level++ {
+		smoothed := atrousSmooth(current, 1<<uint(level))
+		limit := threshold * noise * waveletNoise[level]
+		for i, v := range current.Pix {
+			detail := v - smoothed.Pix[i]
+			// Soft thresholding.
+			shrunk := math.Max(math.Abs(detail)-limit, 0)
+			denoised.Pix[i] += math.Copysign(shrunk, detail)
+		}
+		current = smoothed
+	}
+	for i, v := range current.Pix {
+		denoised.Pix[i] += v
+	}
+	return denoised
+}
+
+// Denoise reduces the noise of a filter image with bilateral filtering, non-local means
+// or wavelet thresholding, scaled to the noise level estimated from the image.
+// It returns the denoised image, the estimated noise level (0-1) and any error
+// encountered.
+func Denoise(img *image.Gray, config common.DenoiseConfig) (*image.Gray, float64, error) {
+	config = denoiseDefaults(config)
+	if config.Strength <= 0 || config.Radius < 1 || config.Levels < 1 {
+		return nil, 0, fmt.Errorf("denoising needs a positive strength, radius and number of levels, got %g, %d and %d",
+			config.Strength, config.Radius, config.Levels)
+	}
+	plane := common.PlaneFromGray(img)
+	noise := noiseLevel(plane, medianFilter(plane, 1))
+
+	var denoised *common.Plane
+	switch config.Method {
+	case BILATERAL:
+		denoised = bilateral(plane, config.Radius, 2*config.Strength*noise)
+	case NLM:
+		denoised = nonLocalMeans(plane, config.Radius, noise, 0.4*config.Strength*noise)
+	case WAVELET:
+		denoised = waveletDenoise(plane, config.Levels, noise, 2*config.Strength)
+	default:
+		return nil, noise, fmt.Errorf("unknown denoise method %q, expected %s, %s or %s",
+			config.Method, BILATERAL, NLM, WAVELET)
+	}
+
+	return denoised.Gray(), noise, nil
+}
@@ -0,0 +1,78 @@
+package preprocess
+
+import (
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// noisyImage returns a mid gray image with gaussian noise of the given standard
+// deviation in gray levels.
+func noisyImage(sigma float64) *image.Gray {
+	random := rand.New(rand.NewSource(1))
+	img := image.NewGray(image.Rect(0, 0, 48, 48))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(common.Clamp(math.Round(128+sigma*random.NormFloat64()), 0, 255))
+	}
+	return img
+}
+
+// deviation returns the standard deviation of the pixels of an image in gray levels.
+func deviation(img *image.Gray) float64 {
+	var sum, sumSq float64
+	for _, v := range img.Pix {
+		sum += float64(v)
+		sumSq += float64(v) * float64(v)
+	}
+	n := float64(len(img.Pix))
+	mean := sum / n
+	return math.Sqrt(sumSq/n - mean*mean)
+}
+
+func TestDenoise(t *testing.T) {
+	const sigma = 8.0
+
+	tests := []struct {
+		name    string
+		config  common.DenoiseConfig
+		wantErr bool
+	}{
+		{name: "bilateral defaults", config: common.DenoiseConfig{Method: BILATERAL}},
+		{name: "bilateral small radius", config: common.DenoiseConfig{Method: BILATERAL, Radius: 1, Strength: 2}},
+		{name: "nlm defaults", config: common.DenoiseConfig{Method: NLM}},
+		{name: "nlm radius", config: common.DenoiseConfig{Method: NLM, Radius: 2, Strength: 1.5}},
+		{name: "wavelet defaults", config: common.DenoiseConfig{Method: WAVELET}},
+		{name: "wavelet levels clamped", config: common.DenoiseConfig{Method: WAVELET, Levels: 10}},
+		{name: "wavelet one level", config: common.DenoiseConfig{Method: WAVELET, Levels: 1, Strength: 3}},
+		{name: "negative strength", config: common.DenoiseConfig{Method: WAVELET, Strength: -1}, wantErr: true},
+		{name: "negative radius", config: common.DenoiseConfig{Method: BILATERAL, Radius: -2}, wantErr: true},
+		{name: "negative levels", config: common.DenoiseConfig{Method: WAVELET, Levels: -1}, wantErr: true},
+		{name: "unknown method", config: common.DenoiseConfig{Method: "median"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img := noisyImage(sigma)
+			denoised, noise, err := Denoise(img, test.config)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Denoise() error = %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+
+			if noise < 0.5*sigma/255 || noise > 1.5*sigma/255 {
+				t.Errorf("noise = %g, want about %g", noise, sigma/255)
+			}
+			if denoised.Bounds() != img.Bounds() {
+				t.Fatalf("denoised bounds = %v, want %v", denoised.Bounds(), img.Bounds())
+			}
+			before, after := deviation(img), deviation(denoised)
+			if after >= 0.8*before {
+				t.Errorf("deviation = %g after denoising, want well below %g", after, before)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+// A package containing the stages applied to each filter image before the images are aligned and combined.
+package preprocess
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+	"path"
+)
+
+// Apply runs the pre-processing stages enabled in the config on each image of the
+// image map, replacing the images with the processed versions. Any diagnostic images
+// requested by the stages are written to root.
+// It returns any error encountered.
+func Apply(config common.ConfigFile, imageMap common.ImageMap, root string) error {
+	for filter, loaded := range imageMap {
+		processed, err := applyImage(config, loaded, filter, root)
+		if err != nil {
+			return err
+		}
+		imageMap[filter] = processed
+	}
+
+	return nil
+}
+
+// ApplyStacks runs the pre-processing stages enabled in the config on every frame of
+// each filter, so frames are cleaned before they are stacked. The diagnostic images of
+// a filter with several frames are named for the filter and the index of the frame.
+// It returns any error encountered.
+func ApplyStacks(config common.ConfigFile, stacks map[string][]common.LoadedConfig, root string) error {
+	for filter, frames := range stacks {
+		for i, loaded := range frames {
+			name := filter
+			if len(frames) > 1 {
+				name = fmt.Sprintf("%s_%d", filter, i)
+			}
+			processed, err := applyImage(config, loaded, name, root)
+			if err != nil {
+				return err
+			}
+			frames[i] = processed
+		}
+	}
+
+	return nil
+}
+
+// applyImage runs the pre-processing stages enabled in the config on an image, naming
+// any diagnostic images it writes to root after name.
+// It returns the processed image and any error encountered.
+func applyImage(config common.ConfigFile, loaded common.LoadedConfig, name string, root string) (common.LoadedConfig, error) {
+	img := loaded.Image
+
+	if config.Cosmic != nil {
+		cleaned, mask, count, err := CleanCosmicRays(img, *config.Cosmic)
+		if err != nil {
+			return loaded, fmt.Errorf("cleaning cosmic rays from %s: %s", loaded.Config.Filename, err)
+		}
+		fmt.Printf("Replaced %d pixels in %s\n", count, loaded.Config.Filename)
+		img = cleaned
+
+		if config.Cosmic.Mask {
+			maskPath := path.Join(root, fmt.Sprintf("cosmic_mask_%s.png", name))
+			if err := common.WriteImage(maskPath, mask, nil); err != nil {
+				return loaded, err
+			}
+		}
+	}
+
+	if config.Background != nil {
+		corrected, model, err := SubtractBackground(img, *config.Background)
+		if err != nil {
+			return loaded, fmt.Errorf("subtracting background from %s: %s", loaded.Config.Filename, err)
+		}
+		img = corrected
+
+		if config.Background.Output {
+			modelPath := path.Join(root, fmt.Sprintf("background_%s.jpg", name))
+			if err := common.WriteImage(modelPath, model.Gray(), nil); err != nil {
+				return loaded, err
+			}
+		}
+	}
+
+	if config.Denoise != nil {
+		denoised, noise, err := Denoise(img, *config.Denoise)
+		if err != nil {
+			return loaded, fmt.Errorf("denoising %s: %s", loaded.Config.Filename, err)
+		}
+		fmt.Printf("Denoised %s, estimated noise %.4f\n", loaded.Config.Filename, noise)
+		img = denoised
+	}
+
+	loaded.Image = img
+	return loaded, nil
+}
@@ -0,0 +1,170 @@
+package stack
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"math"
+	"sort"
+)
+
+// SubPixel is a shift between frames in fractions of a pixel.
+type SubPixel struct {
+	X, Y float64
+}
+
+// drizzleDefaults fills in any unset drizzle parameters.
+func drizzleDefaults(config common.DrizzleConfig) common.DrizzleConfig {
+	if config.Scale == 0 {
+		config.Scale = 2
+	}
+	if config.PixFrac == 0 {
+		config.PixFrac = 0.7
+	}
+	if config.MaxOffset == 0 {
+		config.MaxOffset = 10
+	}
+	return config
+}
+
+// overlap returns the length of the overlap of the intervals [a0, a1] and [b0, b1].
+func overlap(a0, a1, b0, b1 float64) float64 {
+	return math.Max(0, math.Min(a1, b1)-math.Max(a0, b0))
+}
+
+// registerSubPixel aligns each frame to the first, see alignFrames, refining the offsets
+// to a fraction of a pixel.
+// It returns the shift of each frame relative to the first and any error encountered.
+func registerSubPixel(frames []common.LoadedConfig, maxOffset, downsample int, metricName, searchName string) ([]SubPixel, error) {
+	surfaces, err := alignFrames(frames, maxOffset, downsample, metricName, searchName)
+	if err != nil {
+		return nil, err
+	}
+
+	shifts := make([]SubPixel, len(frames))
+	for i, surface := range surfaces[1:] {
+		x, y := surface.SubPixelBest()
+		shifts[i+1] = SubPixel{x, y}
+	}
+	return shifts, nil
+}
+
+// Drizzle registers the frames of a filter to the first frame with sub-pixel accuracy
+// and drops every input pixel, shrunk to pixfrac of its size, onto an output grid scale
+// times finer than the frames. Each output pixel is the mean of the drops overlapping
+// it, weighted by the area of the overlap and the inverse variance of the noise of their
+// frames. Output pixels no drop overlaps are black.
+// It returns the drizzled image, the shift and weight of each frame, the number of
+// output pixels without any drop, and any error encountered.
+func Drizzle(frames []common.LoadedConfig, config common.DrizzleConfig, downsample int, metricName, searchName string) (*image.Gray, []SubPixel, []float64, int, error) {
+	config = drizzleDefaults(config)
+	if config.Scale < 1 || config.PixFrac <= 0 || config.PixFrac > 1 {
+		return nil, nil, nil, 0, fmt.Errorf("drizzle needs a scale of at least 1 and a pixfrac in (0, 1], got %g and %g", config.Scale, config.PixFrac)
+	}
+
+	shifts, err := registerSubPixel(frames, config.MaxOffset, downsample, metricName, searchName)
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+
+	planes := make([]*common.Plane, len(frames))
+	noise := make([]float64, len(frames))
+	for i, frame := range frames {
+		planes[i] = common.PlaneFromGray(frame.Image)
+		noise[i] = noiseLevel(planes[i])
+	}
+	w := weights(noise)
+
+	inputBounds := planes[0].Rect
+	scale, half := config.Scale, config.PixFrac/2
+	bounds := image.Rect(
+		int(math.Floor(float64(inputBounds.Min.X)*scale)), int(math.Floor(float64(inputBounds.Min.Y)*scale)),
+		int(math.Ceil(float64(inputBounds.Max.X)*scale)), int(math.Ceil(float64(inputBounds.Max.Y)*scale)))
+	drizzled := common.NewPlane(bounds)
+	bandEmpty := make([]int, common.Bands(bounds))
+	common.ParallelRows(bounds, func(band int, rows image.Rectangle) {
+		for oy := rows.Min.Y; oy < rows.Max.Y; oy++ {
+			// The output pixel in the coordinates of the first frame.
+			y0, y1 := float64(oy)/scale, float64(oy+1)/scale
+			for ox := rows.Min.X; ox < rows.Max.X; ox++ {
+				x0, x1 := float64(ox)/scale, float64(ox+1)/scale
+				sum, total := 0.0, 0.0
+				for i, plane := range planes {
+					// Input pixel p's drop is centred on p + 0.5 + shift, only the input
+					// pixels around the output pixel can overlap it.
+					shift := shifts[i]
+					minX, maxX := int(math.Floor(x0-shift.X-0.5-half)), int(math.Ceil(x1-shift.X-0.5+half))
+					minY, maxY := int(math.Floor(y0-shift.Y-0.5-half)), int(math.Ceil(y1-shift.Y-0.5+half))
+					for py := minY; py <= maxY; py++ {
+						centreY := float64(py) + 0.5 + shift.Y
+						dy := overlap(centreY-half, centreY+half, y0, y1)
+						if dy == 0 {
+							continue
+						}
+						for px := minX; px <= maxX; px++ {
+							if !image.Pt(px, py).In(plane.Rect) {
+								continue
+							}
+							centreX := float64(px) + 0.5 + shift.X
+							dx := overlap(centreX-half, centreX+half, x0, x1)
+							if dx == 0 {
+								continue
+							}
+							weight := dx * dy * w[i]
+							sum += weight * plane.At(px, py)
+							total += weight
+						}
+					}
+				}
+				if total == 0 {
+					bandEmpty[band]++
+					continue
+				}
+				drizzled.Set(ox, oy, sum/total)
+			}
+		}
+	})
+
+	empty := 0
+	for _, count := range bandEmpty {
+		empty += count
+	}
+
+	return drizzled.Gray(), shifts, w, empty, nil
+}
+
+// ApplyDrizzle drizzles the frames of each filter onto a finer grid, reporting the shift
+// and weight of each frame and the output pixels no drop covered. Each drizzled image
+// keeps the config of the first frame of its filter with its offsets scaled to drizzled
+// pixels.
+// It returns a map of filters to the drizzled images and any error encountered.
+func ApplyDrizzle(config common.ConfigFile, stacks map[string][]common.LoadedConfig) (common.ImageMap, error) {
+	var filters []string
+	for filter := range stacks {
+		filters = append(filters, filter)
+	}
+	sort.Strings(filters)
+
+	settings := drizzleDefaults(*config.Drizzle)
+	imageMap := make(common.ImageMap)
+	for _, filter := range filters {
+		frames := stacks[filter]
+		drizzled, shifts, w, empty, err := Drizzle(frames, settings, config.Downsample, config.Metric, config.Search)
+		if err != nil {
+			return nil, fmt.Errorf("drizzling %s: %s", filter, err)
+		}
+
+		fmt.Printf("Drizzled %d %s frames at scale %g, pixfrac %g, %d pixels empty\n",
+			len(frames), filter, settings.Scale, settings.PixFrac, empty)
+		for i, frame := range frames {
+			fmt.Printf("  %s: shift (%.2f, %.2f), weight %.3f\n",
+				frame.Config.Filename, shifts[i].X, shifts[i].Y, w[i])
+		}
+
+		drizzledConfig := frames[0].Config
+		drizzledConfig.OffsetX = int(math.Round(float64(drizzledConfig.OffsetX) * settings.Scale))
+		drizzledConfig.OffsetY = int(math.Round(float64(drizzledConfig.OffsetY) * settings.Scale))
+		imageMap[filter] = common.LoadedConfig{Config: drizzledConfig, Image: drizzled}
+	}
+	return imageMap, nil
+}
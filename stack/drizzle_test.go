@@ -0,0 +1,84 @@
+package stack
+
+import (
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"testing"
+)
+
+func TestDrizzle(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       image.Point
+		config     common.DrizzleConfig
+		wantBounds image.Rectangle
+		wantEmpty  int
+		wantErr    bool
+	}{
+		{
+			name:       "defaults",
+			size:       image.Pt(32, 32),
+			wantBounds: image.Rect(0, 0, 64, 64),
+		},
+		{
+			name:       "same scale",
+			size:       image.Pt(32, 32),
+			config:     common.DrizzleConfig{Scale: 1, PixFrac: 1},
+			wantBounds: image.Rect(0, 0, 32, 32),
+		},
+		{
+			name:       "fractional scale rounds up",
+			size:       image.Pt(31, 17),
+			config:     common.DrizzleConfig{Scale: 1.5, PixFrac: 1},
+			wantBounds: image.Rect(0, 0, 47, 26),
+		},
+		{
+			// Each drop covers the middle two of the four output pixels across each input
+			// pixel, so three in four rows and columns are left empty.
+			name:       "small pixfrac leaves gaps",
+			size:       image.Pt(32, 32),
+			config:     common.DrizzleConfig{Scale: 4, PixFrac: 0.3},
+			wantBounds: image.Rect(0, 0, 128, 128),
+			wantEmpty:  128*128 - 64*64,
+		},
+		{
+			name:    "scale below 1",
+			size:    image.Pt(32, 32),
+			config:  common.DrizzleConfig{Scale: 0.5},
+			wantErr: true,
+		},
+		{
+			name:    "pixfrac above 1",
+			size:    image.Pt(32, 32),
+			config:  common.DrizzleConfig{PixFrac: 1.5},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frames := make([]common.LoadedConfig, 3)
+			for i := range frames {
+				frames[i] = blobFrame("frame", image.Pt(0, 0), 1)
+				frames[i].Image = frames[i].Image.SubImage(image.Rectangle{Max: test.size}).(*image.Gray)
+			}
+
+			drizzled, shifts, w, empty, err := Drizzle(frames, test.config, 0, "", "")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Drizzle() error = %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if bounds := drizzled.Bounds(); bounds != test.wantBounds {
+				t.Errorf("drizzled bounds = %v, want %v", bounds, test.wantBounds)
+			}
+			if empty != test.wantEmpty {
+				t.Errorf("empty pixels = %d, want %d", empty, test.wantEmpty)
+			}
+			if len(shifts) != len(frames) || len(w) != len(frames) {
+				t.Errorf("got %d shifts and %d weights, want %d of each", len(shifts), len(w), len(frames))
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package stack
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"math"
+	"sort"
+)
+
+// The supported tone mapping operators.
+const (
+	REINHARD = "reinhard"
+	LOG      = "log"
+	LINEAR   = "linear"
+)
+
+// The percentile of the merged images mapped to white, which ignores hot pixels.
+const whitePercentile = 99.9
+
+// hdrDefaults fills in any unset HDR parameters.
+func hdrDefaults(config common.HDRConfig) common.HDRConfig {
+	if config.ToneMap == "" {
+		config.ToneMap = REINHARD
+	}
+	if config.Key == 0 {
+		config.Key = 0.18
+	}
+	if config.Saturation == 0 {
+		config.Saturation = 0.98
+	}
+	if config.MaxOffset == 0 {
+		config.MaxOffset = 10
+	}
+	return config
+}
+
+// hatWeight returns how much a pixel value is trusted: not at all when saturated and
+// less the closer it is to black or saturation.
+func hatWeight(v, saturation float64) float64 {
+	if v >= saturation {
+		return 0
+	}
+	return math.Min(v, saturation-v)
+}
+
+// MergeHDR registers the frames of a filter to the first frame and merges them into a
+// plane of radiance, the value of each pixel divided by its exposure. Each value is
+// weighted by the hat weight times the exposure, as longer exposures are less noisy.
+// Pixels saturated in every frame take the value of the shortest exposure.
+// It returns the radiance, the shift and number of saturated pixels of each frame, and
+// any error encountered.
+func MergeHDR(frames []common.LoadedConfig, config common.HDRConfig, downsample int, metricName, searchName string) (*common.Plane, []image.Point, []int, error) {
+	config = hdrDefaults(config)
+	shortest := 0
+	for i, frame := range frames {
+		if frame.Config.Exposure <= 0 {
+			return nil, nil, nil, fmt.Errorf("%s has no exposure", frame.Config.Filename)
+		}
+		if frame.Config.Exposure < frames[shortest].Config.Exposure {
+			shortest = i
+		}
+	}
+
+	shifts, err := register(frames, config.MaxOffset, downsample, metricName, searchName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	planes := make([]*common.Plane, len(frames))
+	for i, frame := range frames {
+		planes[i] = common.PlaneFromGray(frame.Image)
+	}
+
+	bounds := planes[0].Rect
+	radiance := common.NewPlane(bounds)
+	bandSaturated := make([][]int, common.Bands(bounds))
+	common.ParallelRows(bounds, func(band int, rows image.Rectangle) {
+		saturated := make([]int, len(frames))
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := rows.Min.X; x < rows.Max.X; x++ {
+				sum, total := 0.0, 0.0
+				for i, plane := range planes {
+					p := image.Pt(x, y).Sub(shifts[i])
+					if !p.In(plane.Rect) {
+						continue
+					}
+					v := plane.At(p.X, p.Y)
+					if v >= config.Saturation {
+						saturated[i]++
+					}
+					exposure := frames[i].Config.Exposure
+					w := hatWeight(v, config.Saturation) * exposure
+					sum += w * v / exposure
+					total += w
+				}
+				if total > 0 {
+					radiance.Set(x, y, sum/total)
+					continue
+				}
+				p := image.Pt(x, y).Sub(shifts[shortest])
+				radiance.Set(x, y, planes[shortest].At(p.X, p.Y)/frames[shortest].Config.Exposure)
+			}
+		}
+		bandSaturated[band] = saturated
+	})
+
+	saturated := make([]int, len(frames))
+	for _, band := range bandSaturated {
+		for i, count := range band {
+			saturated[i] += count
+		}
+	}
+
+	return radiance, shifts, saturated, nil
+}
+
+// ToneMap maps the radiance of each filter to 8 bit images with the configured operator.
+// The same mapping is applied to every filter so the colour ratios are kept.
+// It returns the tone mapped image of each filter and any error encountered.
+func ToneMap(radiance map[string]*common.Plane, config common.HDRConfig) (map[string]*image.Gray, error) {
+	config = hdrDefaults(config)
+
+	var values []float64
+	for _, plane := range radiance {
+		values = append(values, plane.Pix...)
+	}
+	white := common.Percentile(values, whitePercentile)
+	logSum := 0.0
+	for _, v := range values {
+		logSum += math.Log(1e-6 + v)
+	}
+	average := math.Exp(logSum / float64(len(values)))
+	if white <= 0 || average <= 0 {
+		return nil, fmt.Errorf("merged images are black")
+	}
+
+	var mapping func(v float64) float64
+	switch config.ToneMap {
+	case REINHARD:
+		scale := config.Key / average
+		lw := scale * white
+		mapping = func(v float64) float64 {
+			l := scale * v
+			return l * (1 + l/(lw*lw)) / (1 + l)
+		}
+	case LOG:
+		mapping = func(v float64) float64 {
+			return math.Log1p(v/average) / math.Log1p(white/average)
+		}
+	case LINEAR:
+		mapping = func(v float64) float64 {
+			return v / white
+		}
+	default:
+		return nil, fmt.Errorf("unknown tone map %q, expected %s, %s or %s", config.ToneMap, REINHARD, LOG, LINEAR)
+	}
+
+	images := make(map[string]*image.Gray)
+	for filter, plane := range radiance {
+		mapped := common.NewPlane(plane.Rect)
+		for i, v := range plane.Pix {
+			mapped.Pix[i] = mapping(v)
+		}
+		images[filter] = mapped.Gray()
+	}
+	return images, nil
+}
+
+// ApplyHDR merges the frames of each filter into a high dynamic range image and tone
+// maps them, reporting the shift, exposure and saturated pixels of each frame. Each
+// merged image keeps the config of the first frame of its filter.
+// It returns a map of filters to the tone mapped images and any error encountered.
+func ApplyHDR(config common.ConfigFile, stacks map[string][]common.LoadedConfig) (common.ImageMap, error) {
+	var filters []string
+	for filter := range stacks {
+		filters = append(filters, filter)
+	}
+	sort.Strings(filters)
+
+	settings := hdrDefaults(*config.HDR)
+	radiance := make(map[string]*common.Plane)
+	for _, filter := range filters {
+		frames := stacks[filter]
+		merged, shifts, saturated, err := MergeHDR(frames, settings, config.Downsample, config.Metric, config.Search)
+		if err != nil {
+			return nil, fmt.Errorf("merging %s: %s", filter, err)
+		}
+
+		fmt.Printf("Merged %d %s exposures\n", len(frames), filter)
+		for i, frame := range frames {
+			fmt.Printf("  %s: shift (%d, %d), exposure %gs, saturated %d pixels\n",
+				frame.Config.Filename, shifts[i].X, shifts[i].Y, frame.Config.Exposure, saturated[i])
+		}
+		radiance[filter] = merged
+	}
+
+	images, err := ToneMap(radiance, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	imageMap := make(common.ImageMap)
+	for _, filter := range filters {
+		imageMap[filter] = common.LoadedConfig{Config: stacks[filter][0].Config, Image: images[filter]}
+	}
+	return imageMap, nil
+}
@@ -0,0 +1,76 @@
+package stack
+
+import (
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"math"
+	"testing"
+)
+
+func TestMergeHDR(t *testing.T) {
+	hot := image.Pt(3, 28)
+
+	tests := []struct {
+		name      string
+		exposures []float64
+	}{
+		{name: "equal exposures", exposures: []float64{1, 1}},
+		{name: "long exposure second", exposures: []float64{1, 2}},
+		{name: "long exposure first", exposures: []float64{4, 1}},
+		{name: "three exposures", exposures: []float64{2, 0.5, 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shortest := math.Inf(1)
+			frames := make([]common.LoadedConfig, len(test.exposures))
+			for i, exposure := range test.exposures {
+				shortest = math.Min(shortest, exposure)
+				frames[i] = blobFrame("frame", image.Pt(0, 0), exposure, hot)
+				frames[i].Config.Exposure = exposure
+			}
+			settings := hdrDefaults(common.HDRConfig{})
+
+			radiance, shifts, saturated, err := MergeHDR(frames, settings, 0, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, frame := range frames {
+				if shifts[i] != (image.Point{}) {
+					t.Errorf("shift of frame %d = %v, want none", i, shifts[i])
+				}
+				wantSaturated := 0
+				for _, v := range frame.Image.Pix {
+					if float64(v)/255 >= settings.Saturation {
+						wantSaturated++
+					}
+				}
+				if saturated[i] != wantSaturated {
+					t.Errorf("saturated pixels of frame %d = %d, want %d", i, saturated[i], wantSaturated)
+				}
+			}
+
+			// Every exposure sees the same scene, so the radiance is the blob wherever one
+			// frame isn't saturated, whichever frames it comes from.
+			clean := blobFrame("clean", image.Pt(0, 0), 1)
+			for _, p := range []image.Point{{16, 16}, {10, 14}, {0, 0}, {31, 5}} {
+				want := float64(clean.Image.GrayAt(p.X, p.Y).Y) / 255
+				if got := radiance.At(p.X, p.Y); math.Abs(got-want) > 2.0/255 {
+					t.Errorf("radiance at %v = %g, want %g", p, got, want)
+				}
+			}
+			if got, want := radiance.At(hot.X, hot.Y), 1/shortest; math.Abs(got-want) > 1e-9 {
+				t.Errorf("radiance of a pixel saturated in every frame = %g, want %g from the shortest exposure", got, want)
+			}
+		})
+	}
+}
+
+func TestMergeHDRWithoutExposure(t *testing.T) {
+	frames := []common.LoadedConfig{blobFrame("timed", image.Pt(0, 0), 1), blobFrame("untimed", image.Pt(0, 0), 1)}
+	frames[0].Config.Exposure = 1
+	if _, _, _, err := MergeHDR(frames, common.HDRConfig{}, 0, "", ""); err == nil {
+		t.Error("merging a frame without an exposure succeeded, want an error")
+	}
+}
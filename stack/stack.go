@@ -0,0 +1,264 @@
+// A package containing the functions to register and combine several frames of each filter to reduce noise or extend the dynamic range.
+package stack
+
+import (
+	"fmt"
+	"github.com/lewchuk/gostitcher/algv3aligning"
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"math"
+	"sort"
+)
+
+// The supported stacking methods.
+const (
+	MEAN   = "mean"
+	MEDIAN = "median"
+	SIGMA  = "sigma"
+)
+
+// Scales a median absolute deviation to a standard deviation for gaussian noise.
+const madScale = 1.4826
+
+// stackDefaults fills in any unset stacking parameters.
+func stackDefaults(config common.StackConfig) common.StackConfig {
+	if config.Method == "" {
+		config.Method = MEAN
+	}
+	if config.Sigma == 0 {
+		config.Sigma = 3
+	}
+	if config.MaxOffset == 0 {
+		config.MaxOffset = 10
+	}
+	return config
+}
+
+// noiseLevel estimates the standard deviation of the noise of an image from the median
+// absolute difference between horizontally neighbouring pixels, which is barely
+// affected by the features of the image.
+func noiseLevel(plane *common.Plane) float64 {
+	bounds := plane.Rect
+	differences := make([]float64, 0, len(plane.Pix))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X + 1; x < bounds.Max.X; x++ {
+			differences = append(differences, math.Abs(plane.At(x, y)-plane.At(x-1, y)))
+		}
+	}
+	if len(differences) == 0 {
+		return 1.0 / 255
+	}
+	sort.Float64s(differences)
+	// The difference of two pixels has sqrt(2) times the noise of one. Noise is never
+	// below the quantization of an 8 bit image.
+	return math.Max(madScale*differences[len(differences)/2]/math.Sqrt2, 1.0/255)
+}
+
+// weights returns the inverse variance weight of each frame from the noise of each
+// frame, normalized to sum to 1, so noisier frames count for less.
+func weights(noise []float64) []float64 {
+	w := make([]float64, len(noise))
+	total := 0.0
+	for i, n := range noise {
+		w[i] = 1 / (n * n)
+		total += w[i]
+	}
+	for i := range w {
+		w[i] /= total
+	}
+	return w
+}
+
+// alignFrames aligns each frame to the first, searching within maxOffset pixels on
+// images shrunk by downsample before refining the offsets at full resolution. The metric
+// defaults to ncc as the brightness of the frames may vary.
+// It returns the cost surface of each frame but the first, with offsets relative to the
+// first frame, and any error encountered.
+func alignFrames(frames []common.LoadedConfig, maxOffset, downsample int, metricName, searchName string) ([]*algv3aligning.CostSurface, error) {
+	if metricName == "" {
+		metricName = "ncc"
+	}
+	metric, err := algv3aligning.GetMetric(metricName)
+	if err != nil {
+		return nil, err
+	}
+	search, err := algv3aligning.GetSearch(searchName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Frames of a filter share its offset, so search around the first frame.
+	base := frames[0]
+	base.Config.OffsetX, base.Config.OffsetY = 0, 0
+	surfaces := make([]*algv3aligning.CostSurface, len(frames))
+	for i := 1; i < len(frames); i++ {
+		layer := frames[i]
+		layer.Config.OffsetX, layer.Config.OffsetY = 0, 0
+		surfaces[i] = algv3aligning.AlignPair(base, layer, maxOffset, downsample, nil, metric, search)
+	}
+	return surfaces, nil
+}
+
+// register aligns each frame to the first, see alignFrames.
+// It returns the shift of each frame relative to the first and any error encountered.
+func register(frames []common.LoadedConfig, maxOffset, downsample int, metricName, searchName string) ([]image.Point, error) {
+	surfaces, err := alignFrames(frames, maxOffset, downsample, metricName, searchName)
+	if err != nil {
+		return nil, err
+	}
+
+	shifts := make([]image.Point, len(frames))
+	for i, surface := range surfaces[1:] {
+		shifts[i+1], _ = surface.Best()
+	}
+	return shifts, nil
+}
+
+// median returns the median of values, using sorted as scratch space.
+func median(values, sorted []float64) float64 {
+	sorted = append(sorted[:0], values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 0 {
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	return sorted[n/2]
+}
+
+// combine merges the values of one pixel from several frames, with the weight and noise
+// of each frame, using the stacking method. Rejected values are flagged in rejected.
+// It returns the stacked value.
+func combine(values, w, noise, scratch []float64, rejected []bool, config common.StackConfig) float64 {
+	switch config.Method {
+	case MEDIAN:
+		return median(values, scratch)
+	case SIGMA:
+		// Stacks are usually too small to estimate the spread of a pixel, so values are
+		// compared to the noise of their frames instead.
+		m := median(values, scratch)
+		kept := 0
+		for i, v := range values {
+			rejected[i] = math.Abs(v-m) > config.Sigma*noise[i]
+			if !rejected[i] {
+				kept++
+			}
+		}
+		if kept == 0 {
+			return m
+		}
+	}
+	return weightedMean(values, w, rejected)
+}
+
+// weightedMean returns the weighted mean of the values that weren't rejected.
+func weightedMean(values, w []float64, rejected []bool) float64 {
+	sum, total := 0.0, 0.0
+	for i, v := range values {
+		if !rejected[i] {
+			sum += w[i] * v
+			total += w[i]
+		}
+	}
+	return sum / total
+}
+
+// Stack registers the frames of a filter to the first frame, as the filter images are
+// aligned, and combines them with the configured method. Pixels of the first frame that
+// other frames don't cover after shifting are stacked from the frames that do.
+// It returns the stacked image, the shift, weight and number of rejected pixels of each
+// frame, and any error encountered.
+func Stack(frames []common.LoadedConfig, config common.StackConfig, downsample int, metricName, searchName string) (*image.Gray, []image.Point, []float64, []int, error) {
+	config = stackDefaults(config)
+	if config.Method != MEAN && config.Method != MEDIAN && config.Method != SIGMA {
+		return nil, nil, nil, nil, fmt.Errorf("unknown stacking method %q, expected %s, %s or %s", config.Method, MEAN, MEDIAN, SIGMA)
+	}
+
+	shifts, err := register(frames, config.MaxOffset, downsample, metricName, searchName)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	planes := make([]*common.Plane, len(frames))
+	for i, frame := range frames {
+		planes[i] = common.PlaneFromGray(frame.Image)
+	}
+	noise := make([]float64, len(planes))
+	for i, plane := range planes {
+		noise[i] = noiseLevel(plane)
+	}
+	w := weights(noise)
+
+	bounds := planes[0].Rect
+	stacked := common.NewPlane(bounds)
+	bandRejections := make([][]int, common.Bands(bounds))
+	common.ParallelRows(bounds, func(band int, rows image.Rectangle) {
+		rejections := make([]int, len(frames))
+		values := make([]float64, len(frames))
+		frameWeights := make([]float64, len(frames))
+		frameNoise := make([]float64, len(frames))
+		scratch := make([]float64, len(frames))
+		rejected := make([]bool, len(frames))
+		indexes := make([]int, len(frames))
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := rows.Min.X; x < rows.Max.X; x++ {
+				n := 0
+				for i, plane := range planes {
+					p := image.Pt(x, y).Sub(shifts[i])
+					if !p.In(plane.Rect) {
+						continue
+					}
+					values[n], frameWeights[n], frameNoise[n], indexes[n] = plane.At(p.X, p.Y), w[i], noise[i], i
+					rejected[n] = false
+					n++
+				}
+				stacked.Set(x, y, combine(values[:n], frameWeights[:n], frameNoise[:n], scratch, rejected[:n], config))
+				for j, r := range rejected[:n] {
+					if r {
+						rejections[indexes[j]]++
+					}
+				}
+			}
+		}
+		bandRejections[band] = rejections
+	})
+
+	rejections := make([]int, len(frames))
+	for _, band := range bandRejections {
+		for i, count := range band {
+			rejections[i] += count
+		}
+	}
+
+	return stacked.Gray(), shifts, w, rejections, nil
+}
+
+// Apply stacks the frames of each filter into a single image, reporting the shift, weight
+// and rejected pixels of each frame. Each stacked image keeps the config of the first
+// frame of its filter.
+// It returns a map of filters to the stacked images and any error encountered.
+func Apply(config common.ConfigFile, stacks map[string][]common.LoadedConfig) (common.ImageMap, error) {
+	var filters []string
+	for filter := range stacks {
+		filters = append(filters, filter)
+	}
+	sort.Strings(filters)
+
+	settings := stackDefaults(*config.Stack)
+	imageMap := make(common.ImageMap)
+	for _, filter := range filters {
+		frames := stacks[filter]
+		stacked, shifts, w, rejections, err := Stack(frames, settings, config.Downsample, config.Metric, config.Search)
+		if err != nil {
+			return nil, fmt.Errorf("stacking %s: %s", filter, err)
+		}
+
+		fmt.Printf("Stacked %d %s frames with %s\n", len(frames), filter, settings.Method)
+		for i, frame := range frames {
+			fmt.Printf("  %s: shift (%d, %d), weight %.3f, rejected %d pixels\n",
+				frame.Config.Filename, shifts[i].X, shifts[i].Y, w[i], rejections[i])
+		}
+
+		imageMap[filter] = common.LoadedConfig{Config: frames[0].Config, Image: stacked}
+	}
+	return imageMap, nil
+}
@@ -0,0 +1,90 @@
+package stack
+
+import (
+	"github.com/lewchuk/gostitcher/common"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// blobFrame returns a frame of a smooth blob centred at (16, 16) moved by shift, scaled
+// by gain and with a hot pixel at each of the given points.
+func blobFrame(name string, shift image.Point, gain float64, hot ...image.Point) common.LoadedConfig {
+	img := image.NewGray(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			dx, dy := float64(x-16-shift.X), float64(y-16-shift.Y)
+			v := 40 + 140*math.Exp(-(dx*dx+dy*dy)/(2*6*6))
+			img.SetGray(x, y, color.Gray{uint8(math.Min(255, math.Round(gain*v)))})
+		}
+	}
+	for _, p := range hot {
+		img.Pix[img.PixOffset(p.X, p.Y)] = 255
+	}
+	return common.LoadedConfig{Config: common.ImageConfig{Filename: name, Filter: common.RED}, Image: img}
+}
+
+func TestStack(t *testing.T) {
+	hot := image.Pt(12, 20)
+	frames := []common.LoadedConfig{
+		blobFrame("first", image.Pt(0, 0), 1),
+		blobFrame("shifted", image.Pt(2, -1), 1),
+		blobFrame("still", image.Pt(0, 0), 1),
+		blobFrame("hot", image.Pt(0, 0), 1, hot),
+	}
+	// Shifts register each frame back onto the first, undoing the move.
+	wantShifts := []image.Point{{0, 0}, {-2, 1}, {0, 0}, {0, 0}}
+	clean := float64(frames[0].Image.GrayAt(hot.X, hot.Y).Y)
+
+	tests := []struct {
+		name           string
+		method         string
+		wantRejections []int
+		wantHot        bool
+	}{
+		{name: "mean", method: MEAN, wantRejections: []int{0, 0, 0, 0}, wantHot: true},
+		{name: "median", method: MEDIAN, wantRejections: []int{0, 0, 0, 0}},
+		{name: "sigma", method: SIGMA, wantRejections: []int{0, 0, 0, 1}},
+		{name: "default", method: "", wantRejections: []int{0, 0, 0, 0}, wantHot: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stacked, shifts, w, rejections, err := Stack(frames, common.StackConfig{Method: test.method}, 0, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range frames {
+				if shifts[i] != wantShifts[i] {
+					t.Errorf("shift of %s = %v, want %v", frames[i].Config.Filename, shifts[i], wantShifts[i])
+				}
+				if rejections[i] != test.wantRejections[i] {
+					t.Errorf("rejections of %s = %d, want %d", frames[i].Config.Filename, rejections[i], test.wantRejections[i])
+				}
+			}
+			total := 0.0
+			for _, weight := range w {
+				total += weight
+			}
+			if math.Abs(total-1) > 1e-9 {
+				t.Errorf("weights sum to %g, want 1", total)
+			}
+
+			got := float64(stacked.GrayAt(hot.X, hot.Y).Y)
+			if test.wantHot && got < clean+20 {
+				t.Errorf("hot pixel stacked to %g, want it to raise %g", got, clean)
+			}
+			if !test.wantHot && math.Abs(got-clean) > 1 {
+				t.Errorf("hot pixel stacked to %g, want %g", got, clean)
+			}
+		})
+	}
+}
+
+func TestStackUnknownMethod(t *testing.T) {
+	frames := []common.LoadedConfig{blobFrame("first", image.Pt(0, 0), 1), blobFrame("second", image.Pt(0, 0), 1)}
+	if _, _, _, _, err := Stack(frames, common.StackConfig{Method: "mode"}, 0, "", ""); err == nil {
+		t.Error("stacking with an unknown method succeeded, want an error")
+	}
+}